@@ -0,0 +1,313 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// WorkflowActor is recorded as the actor of transitions the workflow makes on its own
+const WorkflowActor = "workflow"
+
+// ApplicantAuditAction returns the AuditApplicantLog action recorded when an applicant moves to a
+// status, e.g. "applicant_in_review"
+func ApplicantAuditAction(to models.ApplicantStatus) string {
+	return "applicant_" + to.String()
+}
+
+// ApplicantWorkflow moves applicants through their statuses according to their verification
+// level and announces each move to the client's webhook
+type ApplicantWorkflow struct {
+	Emitter interfaces.EventEmitter // Receives an event for every transition, nil to send none
+}
+
+// NewApplicantWorkflow creates a workflow emitting events through emitter
+func NewApplicantWorkflow(emitter interfaces.EventEmitter) *ApplicantWorkflow {
+	return &ApplicantWorkflow{Emitter: emitter}
+}
+
+// Evaluate checks an applicant's documents against its verification level and advances it. A
+// pending applicant whose evaluation can proceed is submitted for review, or rejected when it was
+// already submitted as many times as the level allows. An applicant in review
+// whose documents are no longer complete, e.g. because one was rejected, goes back to pending to
+// upload them again, or is rejected once it was submitted for review as many times as the level
+// allows. Pending applicants and applicants in review whose rejected documents used up the
+// level's attempts are rejected. Other applicants are returned unchanged.
+func (w *ApplicantWorkflow) Evaluate(ctx context.Context, clientID, applicantID string) (models.Applicant, models.LevelEvaluation, error) {
+	applicant, _, evaluation, err := w.evaluate(ctx, clientID, applicantID)
+	return applicant, evaluation, err
+}
+
+// evaluate is Evaluate, also returning the level version the applicant was evaluated against
+func (w *ApplicantWorkflow) evaluate(ctx context.Context, clientID, applicantID string) (models.Applicant, models.VerificationLevel, models.LevelEvaluation, error) {
+	applicant, level, err := loadApplicantWithLevel(ctx, clientID, applicantID)
+	if err != nil {
+		return applicant, level, models.LevelEvaluation{}, err
+	}
+	documents, err := findApplicantDocuments(ctx, applicantID)
+	if err != nil {
+		return applicant, level, models.LevelEvaluation{}, err
+	}
+
+	evaluation := level.Evaluate(documents)
+	open := applicant.Status == models.ApplicantStatusPending || applicant.Status == models.ApplicantStatusInReview
+	switch {
+	case open && evaluation.AttemptsExhausted:
+		err = w.transition(ctx, &applicant, level, models.ApplicantStatusRejected, WorkflowActor,
+			fmt.Sprintf("%d documents were rejected, the level allows %d attempts", evaluation.AttemptsUsed, level.MaxAttempts))
+	case applicant.Status == models.ApplicantStatusPending && evaluation.CanProceed:
+		if !applicant.HasAttemptsLeft(level.MaxAttempts) {
+			// Complete, but it cannot be submitted again and would otherwise stay pending forever
+			err = w.transition(ctx, &applicant, level, models.ApplicantStatusRejected, WorkflowActor,
+				fmt.Sprintf("submitted for review %d times, the level allows %d attempts", applicant.Attempts, level.MaxAttempts))
+			break
+		}
+		err = w.transition(ctx, &applicant, level, models.ApplicantStatusInReview, WorkflowActor, "")
+	case applicant.Status == models.ApplicantStatusInReview && !evaluation.Complete():
+		if applicant.HasAttemptsLeft(level.MaxAttempts) {
+			err = w.transition(ctx, &applicant, level, models.ApplicantStatusPending, WorkflowActor, "required documents are missing or were rejected")
+		} else {
+			err = w.transition(ctx, &applicant, level, models.ApplicantStatusRejected, WorkflowActor,
+				fmt.Sprintf("required documents were not provided within %d attempts", level.MaxAttempts))
+		}
+	}
+	return applicant, level, evaluation, err
+}
+
+// Review records a reviewer's decision, ApplicantStatusVerified or ApplicantStatusRejected, on an
+// applicant in review. Rejections need a reason. The applicant is evaluated first, so one whose
+// documents were rejected or expired since it was submitted goes back to pending, or is rejected,
+// and the decision then fails with *models.IllegalApplicantTransitionError.
+func (w *ApplicantWorkflow) Review(ctx context.Context, clientID, applicantID string, decision models.ApplicantStatus, actor, reason string) (models.Applicant, error) {
+	if decision != models.ApplicantStatusVerified && decision != models.ApplicantStatusRejected {
+		return models.Applicant{}, &models.IllegalApplicantTransitionError{From: models.ApplicantStatusInReview, To: decision}
+	}
+	applicant, level, _, err := w.evaluate(ctx, clientID, applicantID)
+	if err != nil {
+		return applicant, err
+	}
+	err = w.transition(ctx, &applicant, level, decision, actor, reason)
+	return applicant, err
+}
+
+// Reopen sends a rejected applicant back to pending for another attempt. It fails with
+// models.ErrMaxAttemptsReached once the applicant used all the attempts of its level.
+func (w *ApplicantWorkflow) Reopen(ctx context.Context, clientID, applicantID, actor, reason string) (models.Applicant, error) {
+	applicant, level, err := loadApplicantWithLevel(ctx, clientID, applicantID)
+	if err != nil {
+		return applicant, err
+	}
+	err = w.transition(ctx, &applicant, level, models.ApplicantStatusPending, actor, reason)
+	return applicant, err
+}
+
+// TransitionDocument moves a document to a new status with TransitionDocument and then
+// re-evaluates its applicant, so accepting the last missing document submits the applicant for
+// review and rejecting one puts it back to pending
+func (w *ApplicantWorkflow) TransitionDocument(ctx context.Context, doc *models.Document, to models.DocumentStatus, actor, reason string) error {
+	if err := TransitionDocument(ctx, doc, to, actor, reason); err != nil {
+		return err
+	}
+	clientID := doc.ClientID
+	if clientID == "" {
+		var applicant models.Applicant
+		if err := findApplicant(ctx, bson.M{"applicant_id": doc.ApplicantID}, &applicant); err != nil {
+			return err
+		}
+		clientID = applicant.ClientID
+	}
+	_, _, err := w.Evaluate(ctx, clientID, doc.ApplicantID)
+	return err
+}
+
+// transition persists an applicant transition and emits its event. A failed delivery is logged
+// but does not undo the transition.
+func (w *ApplicantWorkflow) transition(ctx context.Context, applicant *models.Applicant, level models.VerificationLevel, to models.ApplicantStatus, actor, reason string) error {
+	logger := zaplogger.GetLogger()
+	transition, err := TransitionApplicant(ctx, applicant, to, level.MaxAttempts, actor, reason)
+	if err != nil || w.Emitter == nil {
+		return err
+	}
+	event := models.WebhookEvent{
+		Type:              transition.Event,
+		ApplicantID:       applicant.ApplicantID,
+		ExternalUserID:    applicant.ExternalUserId,
+		ClientID:          applicant.ClientID,
+		VerificationLevel: applicant.VerificationLevel,
+		LevelVersion:      applicant.LevelVersion,
+		Status:            transition.To.String(),
+		PreviousStatus:    transition.From.String(),
+		Reason:            transition.Reason,
+		Attempts:          applicant.Attempts,
+		CreatedAt:         transition.At,
+	}
+	if err := w.Emitter.Emit(ctx, event); err != nil {
+		logger.Error("Failed to emit applicant event",
+			zap.String("applicantID", applicant.ApplicantID),
+			zap.String("event", string(event.Type)),
+			zap.Error(err),
+		)
+	}
+	return nil
+}
+
+// TransitionApplicant moves an applicant to a new status through models.Applicant.Transition,
+// persists it and records an audit entry. The update only applies while the stored status and
+// attempts are still the ones the applicant was read with, so concurrent transitions cannot both
+// succeed: the loser gets mongo.ErrNoDocuments. Illegal moves return an error and leave applicant
+// unchanged. Once the status is stored the transition stands, a failed audit write is logged.
+func TransitionApplicant(ctx context.Context, applicant *models.Applicant, to models.ApplicantStatus, maxAttempts int, actor, reason string) (models.ApplicantTransition, error) {
+	logger := zaplogger.GetLogger()
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return models.ApplicantTransition{}, fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+
+	updated := *applicant
+	transition, err := updated.Transition(to, maxAttempts, actor, reason)
+	if err != nil {
+		return transition, err
+	}
+
+	filter := bson.M{
+		"applicant_id": applicant.ApplicantID,
+		"client_id":    applicant.ClientID,
+		"status":       transition.From,
+		"deleted":      false,
+	}
+	if applicant.Attempts == 0 {
+		// Applicants created before attempts were counted have no field
+		filter["attempts"] = bson.M{"$in": bson.A{0, nil}}
+	} else {
+		filter["attempts"] = applicant.Attempts
+	}
+	set := bson.M{
+		"status":           updated.Status,
+		"attempts":         updated.Attempts,
+		"rejection_reason": updated.RejectionReason,
+		"updated_at":       updated.UpdatedAt,
+	}
+	result, err := applicants.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		logger.Error("Failed to update applicant status", zap.String("applicantID", applicant.ApplicantID), zap.Error(err))
+		return transition, fmt.Errorf("failed to update applicant status: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return transition, mongo.ErrNoDocuments
+	}
+	*applicant = updated
+
+	if err := recordApplicantTransition(ctx, updated, transition); err != nil {
+		logger.Error("Failed to record applicant transition audit log",
+			zap.String("applicantID", applicant.ApplicantID),
+			zap.String("from", transition.From.String()),
+			zap.String("to", transition.To.String()),
+			zap.String("actor", actor),
+			zap.Error(err),
+		)
+	}
+	logger.Info("Applicant status changed",
+		zap.String("applicantID", applicant.ApplicantID),
+		zap.String("from", transition.From.String()),
+		zap.String("to", transition.To.String()),
+		zap.Int("attempts", updated.Attempts),
+		zap.String("actor", actor),
+	)
+	return transition, nil
+}
+
+// loadApplicantWithLevel returns the workflow fields of a client's applicant and the verification
+// level version it is pinned to, see ResolveApplicantLevel
+func loadApplicantWithLevel(ctx context.Context, clientID, applicantID string) (models.Applicant, models.VerificationLevel, error) {
+	var applicant models.Applicant
+	if err := findApplicant(ctx, bson.M{"applicant_id": applicantID, "client_id": clientID, "deleted": false}, &applicant); err != nil {
+		return applicant, models.VerificationLevel{}, err
+	}
+	level, err := ResolveApplicantLevel(ctx, &applicant)
+	return applicant, level, err
+}
+
+// findApplicant decodes the fields the workflow uses of the applicant matching filter, leaving
+// the encrypted personal data out
+func findApplicant(ctx context.Context, filter bson.M, applicant *models.Applicant) error {
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+	projection := bson.M{
+		"applicant_id":       1,
+		"client_id":          1,
+		"verification_level": 1,
+		"level_id":           1,
+		"level_version":      1,
+		"external_user_id":   1,
+		"status":             1,
+		"attempts":           1,
+		"rejection_reason":   1,
+		"updated_at":         1,
+	}
+	return applicants.FindOne(ctx, filter, options.FindOne().SetProjection(projection)).Decode(applicant)
+}
+
+// findApplicantDocuments returns the fields of an applicant's live documents levels are evaluated on
+func findApplicantDocuments(ctx context.Context, applicantID string) ([]models.Document, error) {
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return nil, fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+	cursor, err := documents.Find(ctx,
+		bson.M{"applicant_id": applicantID, "deleted": false},
+		options.Find().SetProjection(bson.M{
+			"document_id":   1,
+			"applicant_id":  1,
+			"document_type": 1,
+			"country":       1,
+			"status":        1,
+			"issued_at":     1,
+			"expires_at":    1,
+			"liveness":      1,
+			"deleted":       1,
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applicant documents: %w", err)
+	}
+	var found []models.Document
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode applicant documents: %w", err)
+	}
+	return found, nil
+}
+
+func recordApplicantTransition(ctx context.Context, applicant models.Applicant, transition models.ApplicantTransition) error {
+	auditLogs := GetCollection(constants.CollectionAuditLogs)
+	if auditLogs == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionAuditLogs)
+	}
+
+	details := fmt.Sprintf("Applicant moved from %s to %s by %s (attempt %d)", transition.From, transition.To, transition.Actor, applicant.Attempts)
+	if transition.Reason != "" {
+		details += ": " + transition.Reason
+	}
+	entry := models.AuditApplicantLog{
+		LogID:           uuid.New().String(),
+		ApplicantID:     applicant.ApplicantID,
+		ActionPerformed: ApplicantAuditAction(transition.To),
+		Details:         details,
+		Timestamp:       transition.At,
+		ClientID:        applicant.ClientID,
+	}
+	if _, err := auditLogs.InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to record audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// recordingEmitter collects the events emitted by the workflow
+type recordingEmitter struct {
+	events []models.WebhookEvent
+}
+
+func (e *recordingEmitter) Emit(ctx context.Context, event models.WebhookEvent) error {
+	e.events = append(e.events, event)
+	return nil
+}
+
+// mockDocument converts a record into the form mtest cursor responses take
+func mockDocument(t *testing.T, record interface{}) bson.D {
+	data, err := bson.Marshal(record)
+	require.NoError(t, err)
+	var document bson.D
+	require.NoError(t, bson.Unmarshal(data, &document))
+	return document
+}
+
+func TestWorkflowEvaluateRejectsCompleteApplicantWithoutAttempts(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("no attempts left", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		applicant := models.Applicant{
+			ApplicantID:  "applicant-1",
+			ClientID:     "client-1",
+			LevelID:      "level-1",
+			LevelVersion: 1,
+			Status:       models.ApplicantStatusPending,
+			Attempts:     2,
+		}
+		level := models.VerificationLevel{
+			LevelID:      "level-1",
+			ClientID:     "client-1",
+			RequiredDocs: []models.DocumentType{models.DocumentPassport},
+			MaxAttempts:  2,
+			Version:      1,
+			State:        models.LevelStatePublished,
+		}
+		passport := models.Document{DocumentID: "passport", ApplicantID: "applicant-1", DocumentType: models.DocumentPassport, Status: models.DocumentUploaded}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, mockDocument(t, applicant)),
+			mtest.CreateCursorResponse(0, "verus.verification_levels", mtest.FirstBatch, mockDocument(t, level)),
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, mockDocument(t, passport)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		evaluated, evaluation, err := NewApplicantWorkflow(nil).Evaluate(context.Background(), "client-1", "applicant-1")
+		assert.NoError(t, err)
+		assert.True(t, evaluation.CanProceed)
+		assert.Equal(t, models.ApplicantStatusRejected, evaluated.Status)
+		assert.Equal(t, "submitted for review 2 times, the level allows 2 attempts", evaluated.RejectionReason)
+	})
+}
+
+func TestWorkflowReviewEvaluatesFirst(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("document rejected since submission", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		applicant := models.Applicant{
+			ApplicantID:  "applicant-1",
+			ClientID:     "client-1",
+			LevelID:      "level-1",
+			LevelVersion: 1,
+			Status:       models.ApplicantStatusInReview,
+			Attempts:     1,
+		}
+		level := models.VerificationLevel{
+			LevelID:      "level-1",
+			ClientID:     "client-1",
+			RequiredDocs: []models.DocumentType{models.DocumentPassport},
+			MaxAttempts:  3,
+			Version:      1,
+			State:        models.LevelStatePublished,
+		}
+		passport := models.Document{DocumentID: "passport", ApplicantID: "applicant-1", DocumentType: models.DocumentPassport, Status: models.DocumentRejected}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, mockDocument(t, applicant)),
+			mtest.CreateCursorResponse(0, "verus.verification_levels", mtest.FirstBatch, mockDocument(t, level)),
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, mockDocument(t, passport)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		reviewed, err := NewApplicantWorkflow(nil).Review(context.Background(), "client-1", "applicant-1", models.ApplicantStatusVerified, "reviewer", "")
+		var illegal *models.IllegalApplicantTransitionError
+		assert.ErrorAs(t, err, &illegal)
+		assert.Equal(t, models.ApplicantStatusPending, reviewed.Status)
+	})
+}
+
+func TestWorkflowEmitsTransitionWhenAuditFails(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("audit insert fails", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		applicant := models.Applicant{
+			ApplicantID:  "applicant-1",
+			ClientID:     "client-1",
+			LevelID:      "level-1",
+			LevelVersion: 1,
+			Status:       models.ApplicantStatusRejected,
+			Attempts:     1,
+		}
+		level := models.VerificationLevel{LevelID: "level-1", ClientID: "client-1", MaxAttempts: 3, Version: 1, State: models.LevelStatePublished}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, mockDocument(t, applicant)),
+			mtest.CreateCursorResponse(0, "verus.verification_levels", mtest.FirstBatch, mockDocument(t, level)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted at shutdown"}),
+		)
+
+		emitter := &recordingEmitter{}
+		reopened, err := NewApplicantWorkflow(emitter).Reopen(context.Background(), "client-1", "applicant-1", "reviewer", "new documents")
+		require.NoError(t, err)
+		assert.Equal(t, models.ApplicantStatusPending, reopened.Status)
+		require.Len(t, emitter.events, 1)
+		assert.Equal(t, models.ApplicantStatusPending.String(), emitter.events[0].Status)
+	})
+}
+
+func TestWorkflowTransitionDocumentEvaluatesWhenAuditFails(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("audit insert fails", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		passport := models.Document{DocumentID: "passport", ApplicantID: "applicant-1", ClientID: "client-1", DocumentType: models.DocumentPassport, Status: models.DocumentUploaded}
+		applicant := models.Applicant{
+			ApplicantID:  "applicant-1",
+			ClientID:     "client-1",
+			LevelID:      "level-1",
+			LevelVersion: 1,
+			Status:       models.ApplicantStatusPending,
+		}
+		level := models.VerificationLevel{
+			LevelID:      "level-1",
+			ClientID:     "client-1",
+			RequiredDocs: []models.DocumentType{models.DocumentPassport},
+			MaxAttempts:  3,
+			Version:      1,
+			State:        models.LevelStatePublished,
+		}
+		verified := passport
+		verified.Status = models.DocumentVerified
+		mt.AddMockResponses(
+			// Document transition, its audit entry fails
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "client_id", Value: "client-1"}}}),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted at shutdown"}),
+			// Applicant evaluation submits it for review
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, mockDocument(t, applicant)),
+			mtest.CreateCursorResponse(0, "verus.verification_levels", mtest.FirstBatch, mockDocument(t, level)),
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, mockDocument(t, verified)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		emitter := &recordingEmitter{}
+		err := NewApplicantWorkflow(emitter).TransitionDocument(context.Background(), &passport, models.DocumentVerified, "reviewer", "")
+		require.NoError(t, err)
+		assert.Equal(t, models.DocumentVerified, passport.Status)
+		require.Len(t, emitter.events, 1)
+		assert.Equal(t, models.ApplicantStatusInReview.String(), emitter.events[0].Status)
+	})
+}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+// tagIndex keeps track of which cache keys belong to which tags so that every
+// key variant of an entity (by id, by name, list results) can be evicted together
+type tagIndex struct {
+	mu      sync.Mutex
+	keys    map[string]map[string]struct{} // tag -> cache keys
+	keyTags map[string]map[string]struct{} // cache key -> tags
+}
+
+var tags = newTagIndex()
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys:    make(map[string]map[string]struct{}),
+		keyTags: make(map[string]map[string]struct{}),
+	}
+}
+
+func (t *tagIndex) add(cacheKey string, tagList ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addLocked(cacheKey, tagList...)
+}
+
+// setTagged runs set, which stores cacheKey, and registers the key under tagList in one step, so
+// a concurrent take either sees the tagged key or runs before it is stored
+func (t *tagIndex) setTagged(cacheKey string, set func(), tagList ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	set()
+	t.addLocked(cacheKey, tagList...)
+}
+
+func (t *tagIndex) addLocked(cacheKey string, tagList ...string) {
+	for _, tag := range tagList {
+		if tag == "" {
+			continue
+		}
+		if t.keys[tag] == nil {
+			t.keys[tag] = make(map[string]struct{})
+		}
+		t.keys[tag][cacheKey] = struct{}{}
+		if t.keyTags[cacheKey] == nil {
+			t.keyTags[cacheKey] = make(map[string]struct{})
+		}
+		t.keyTags[cacheKey][tag] = struct{}{}
+	}
+}
+
+// remove drops a cache key from every tag it was registered under
+func (t *tagIndex) remove(cacheKey string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(cacheKey)
+}
+
+func (t *tagIndex) removeLocked(cacheKey string) {
+	for tag := range t.keyTags[cacheKey] {
+		delete(t.keys[tag], cacheKey)
+		if len(t.keys[tag]) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.keyTags, cacheKey)
+}
+
+// reset forgets every registered tag
+func (t *tagIndex) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys = make(map[string]map[string]struct{})
+	t.keyTags = make(map[string]map[string]struct{})
+}
+
+// take returns every cache key registered under the given tags and unregisters them, the caller
+// evicts the keys
+func (t *tagIndex) take(tagList ...string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]struct{})
+	var cacheKeys []string
+	for _, tag := range tagList {
+		for cacheKey := range t.keys[tag] {
+			if _, ok := seen[cacheKey]; ok {
+				continue
+			}
+			seen[cacheKey] = struct{}{}
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+	}
+	for _, cacheKey := range cacheKeys {
+		t.removeLocked(cacheKey)
+	}
+	return cacheKeys
+}
+
+// initCache creates the in-memory cache store and hooks eviction into the tag index
+func initCache(expiration, cleanupInterval time.Duration) {
+	tags.reset()
+	cacheStore = cache.New(expiration, cleanupInterval)
+	cacheStore.OnEvicted(func(cacheKey string, _ interface{}) {
+		tags.remove(cacheKey)
+	})
+}
+
+// CacheTag builds a tag such as "client:<id>" or "verification_level:<id>"
+func CacheTag(kind string, id string) string {
+	return fmt.Sprintf("%s:%s", kind, id)
+}
+
+// GetCached looks up a cache key and deserializes the entry into result. It reports whether the key was found.
+func GetCached(cacheKey string, result interface{}) (bool, error) {
+	if cacheStore == nil {
+		return false, nil
+	}
+	cached, found := cacheStore.Get(cacheKey)
+	if !found {
+		return false, nil
+	}
+	jsonData, ok := cached.(string)
+	if !ok {
+		return true, fmt.Errorf("cache data format error for key: %s", cacheKey)
+	}
+	return true, json.Unmarshal([]byte(jsonData), result)
+}
+
+// SetCached serializes value into the cache under cacheKey and registers the key under the given tags
+func SetCached(cacheKey string, value interface{}, tagList ...string) error {
+	if cacheStore == nil {
+		return nil
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to serialize data for caching: %w", err)
+	}
+	tags.setTagged(cacheKey, func() {
+		cacheStore.Set(cacheKey, string(jsonData), cache.DefaultExpiration)
+	}, tagList...)
+	return nil
+}
+
+// TagCacheKey registers an existing cache key under additional tags, e.g. once the id of a record fetched by name is known
+func TagCacheKey(cacheKey string, tagList ...string) {
+	if len(tagList) == 0 {
+		return
+	}
+	tags.add(cacheKey, tagList...)
+}
+
+// InvalidateTags evicts every cache key registered under any of the given tags and returns the number of keys evicted
+func InvalidateTags(tagList ...string) int {
+	logger := zaplogger.GetLogger()
+	cacheKeys := tags.take(tagList...)
+	// Evicted outside the index lock, OnEvicted takes it. A key stored again in between is
+	// evicted too, which is safe.
+	for _, cacheKey := range cacheKeys {
+		if cacheStore != nil {
+			cacheStore.Delete(cacheKey)
+		}
+	}
+
+	logger.Debug("Cache invalidation for tags",
+		zap.String("function", "InvalidateTags"),
+		zap.Strings("tags", tagList),
+		zap.Int("evicted", len(cacheKeys)),
+	)
+	return len(cacheKeys)
+}
+
+// FlushCache evicts every cached entry, used when a change cannot be mapped to specific tags
+func FlushCache() {
+	if cacheStore != nil {
+		cacheStore.Flush()
+	}
+	tags.reset()
+}
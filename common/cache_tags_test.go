@@ -0,0 +1,88 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/stretchr/testify/assert"
+)
+
+type cachedLevel struct {
+	LevelID string `json:"level_id"`
+	Name    string `json:"name"`
+}
+
+func TestInvalidateTagsEvictsEveryKeyVariant(t *testing.T) {
+	initCache(time.Minute, time.Minute)
+
+	level := cachedLevel{LevelID: "level-1", Name: "basic"}
+	levelTag := CacheTag("verification_level", "level-1")
+	clientTag := CacheTag("client", "client-1")
+
+	assert.NoError(t, SetCached("levels:by-id", level, clientTag, levelTag))
+	assert.NoError(t, SetCached("levels:by-name", level, clientTag))
+	TagCacheKey("levels:by-name", levelTag)
+	assert.NoError(t, SetCached("levels:list", []cachedLevel{level}, clientTag, levelTag))
+	assert.NoError(t, SetCached("levels:other", cachedLevel{LevelID: "level-2"}, clientTag))
+
+	evicted := InvalidateTags(levelTag)
+	assert.Equal(t, 3, evicted)
+
+	var result cachedLevel
+	for _, key := range []string{"levels:by-id", "levels:by-name", "levels:list"} {
+		found, err := GetCached(key, &result)
+		assert.NoError(t, err)
+		assert.False(t, found, key)
+	}
+
+	found, err := GetCached("levels:other", &result)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "level-2", result.LevelID)
+
+	// The other key is still reachable through the client tag
+	assert.Equal(t, 1, InvalidateTags(clientTag))
+	found, _ = GetCached("levels:other", &result)
+	assert.False(t, found)
+}
+
+func TestDeleteRemovesKeyFromTagIndex(t *testing.T) {
+	initCache(time.Minute, time.Minute)
+
+	tag := CacheTag("client", "client-1")
+	assert.NoError(t, SetCached("key", "value", tag))
+
+	cacheStore.Delete("key")
+	assert.Equal(t, 0, InvalidateTags(tag))
+}
+
+func TestCacheTag(t *testing.T) {
+	assert.Equal(t, "client:abc", CacheTag("client", "abc"))
+}
+
+func TestSetCachedIsTaggedWhenStored(t *testing.T) {
+	initCache(time.Minute, time.Minute)
+	tag := CacheTag(constants.CacheTagVerificationLevel, "level-1")
+
+	for i := 0; i < 200; i++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, SetCached("levels:by-name", "cached", tag))
+		}()
+		go func() {
+			defer wg.Done()
+			InvalidateTags(tag)
+		}()
+		wg.Wait()
+
+		// Whichever ran first, a cached entry can still be invalidated
+		var value string
+		if found, _ := GetCached("levels:by-name", &value); found {
+			assert.Equal(t, 1, InvalidateTags(tag))
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// DomainAction is the kind of change that happened to an entity
+type DomainAction string
+
+const (
+	DomainActionCreated DomainAction = "created"
+	DomainActionUpdated DomainAction = "updated"
+	DomainActionDeleted DomainAction = "deleted"
+)
+
+// DomainEventType identifies a domain event, e.g. "verification_level.updated"
+type DomainEventType string
+
+// DomainEvent is a change stream event republished in terms of the entity it affects
+type DomainEvent struct {
+	Type       DomainEventType `json:"type"`        // <entity>.<action>
+	Entity     string          `json:"entity"`      // Entity name, e.g. "verification_level"
+	Action     DomainAction    `json:"action"`      // created, updated or deleted
+	Collection string          `json:"collection"`  // Collection the change happened in
+	EntityID   string          `json:"entity_id"`   // Value of the collection's id field, if known
+	ClientID   string          `json:"client_id"`   // Owning client, if known
+	Document   bson.Raw        `json:"-"`           // Full document after (or before, for deletes) the change, if available
+	Tags       []string        `json:"tags"`        // Cache tags evicted for this change
+	OccurredAt time.Time       `json:"occurred_at"` // Wall clock time of the change
+}
+
+// DomainEventHandler receives domain events published by a ChangeStreamWatcher
+type DomainEventHandler func(ctx context.Context, event DomainEvent)
+
+// WatchedCollection configures how changes to a collection map to cache tags and domain events
+type WatchedCollection struct {
+	Name    string                           // Collection name
+	Entity  string                           // Entity name, used for event types and as the tag kind
+	IDField string                           // Field holding the entity id (e.g. "level_id")
+	Tags    func(event DomainEvent) []string // Optional, defaults to client and entity tags
+}
+
+// DefaultWatchedCollections returns the collections whose changes affect common's cache
+func DefaultWatchedCollections() []WatchedCollection {
+	return []WatchedCollection{
+		{Name: constants.CollectionVerificationLevels, Entity: constants.CacheTagVerificationLevel, IDField: "level_id"},
+		{Name: constants.CollectionClients, Entity: constants.CacheTagClient, IDField: "client_id"},
+	}
+}
+
+// ResumeTokenStore persists change stream resume tokens so a watcher can pick up where it left off
+type ResumeTokenStore interface {
+	LoadResumeToken(ctx context.Context, watcherID string) (bson.Raw, error)
+	SaveResumeToken(ctx context.Context, watcherID string, token bson.Raw) error
+	DeleteResumeToken(ctx context.Context, watcherID string) error // Drops a token that can no longer be resumed from
+}
+
+// MongoResumeTokenStore stores resume tokens in a MongoDB collection, one document per watcher
+type MongoResumeTokenStore struct {
+	CollectionName string
+}
+
+// NewMongoResumeTokenStore returns a store backed by the change_stream_tokens collection
+func NewMongoResumeTokenStore() *MongoResumeTokenStore {
+	return &MongoResumeTokenStore{CollectionName: constants.CollectionChangeStreamTokens}
+}
+
+func (s *MongoResumeTokenStore) LoadResumeToken(ctx context.Context, watcherID string) (bson.Raw, error) {
+	collection := GetCollection(s.CollectionName)
+	if collection == nil {
+		return nil, fmt.Errorf("failed to get collection: %s", s.CollectionName)
+	}
+
+	var stored struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := collection.FindOne(ctx, bson.M{"watcher_id": watcherID}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load resume token: %w", err)
+	}
+	return stored.Token, nil
+}
+
+func (s *MongoResumeTokenStore) SaveResumeToken(ctx context.Context, watcherID string, token bson.Raw) error {
+	collection := GetCollection(s.CollectionName)
+	if collection == nil {
+		return fmt.Errorf("failed to get collection: %s", s.CollectionName)
+	}
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"watcher_id": watcherID},
+		bson.M{"$set": bson.M{"token": token, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save resume token: %w", err)
+	}
+	return nil
+}
+
+func (s *MongoResumeTokenStore) DeleteResumeToken(ctx context.Context, watcherID string) error {
+	collection := GetCollection(s.CollectionName)
+	if collection == nil {
+		return fmt.Errorf("failed to get collection: %s", s.CollectionName)
+	}
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"watcher_id": watcherID}); err != nil {
+		return fmt.Errorf("failed to delete resume token: %w", err)
+	}
+	return nil
+}
+
+// ChangeStreamWatcher subscribes to MongoDB change streams for the configured collections,
+// evicts the matching cache tags and republishes each change as a DomainEvent.
+// Writes made outside this library (admin scripts, other services) are picked up this way.
+type ChangeStreamWatcher struct {
+	WatcherID    string              // Identifies the watcher's resume token
+	Collections  []WatchedCollection // Collections to watch
+	TokenStore   ResumeTokenStore    // Optional, resume tokens are not persisted when nil
+	RetryBackoff time.Duration       // Delay before reopening a failed stream
+
+	mu       sync.RWMutex
+	handlers []DomainEventHandler
+}
+
+// NewChangeStreamWatcher creates a watcher persisting its resume token in MongoDB
+func NewChangeStreamWatcher(watcherID string, collections []WatchedCollection) *ChangeStreamWatcher {
+	return &ChangeStreamWatcher{
+		WatcherID:    watcherID,
+		Collections:  collections,
+		TokenStore:   NewMongoResumeTokenStore(),
+		RetryBackoff: 5 * time.Second,
+	}
+}
+
+// Subscribe registers a handler for every domain event the watcher publishes
+func (w *ChangeStreamWatcher) Subscribe(handler DomainEventHandler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers = append(w.handlers, handler)
+}
+
+// changeDocument is the subset of a change stream event the watcher needs
+type changeDocument struct {
+	OperationType string `bson:"operationType"`
+	NS            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	WallTime                 time.Time `bson:"wallTime"`
+	FullDocument             bson.Raw  `bson:"fullDocument"`
+	FullDocumentBeforeChange bson.Raw  `bson:"fullDocumentBeforeChange"`
+}
+
+// Run watches until ctx is cancelled, reopening the stream from the last resume token after errors.
+// When the token fell off the oplog the changes in between are lost: the cache is flushed and the
+// stream reopened from now.
+func (w *ChangeStreamWatcher) Run(ctx context.Context) error {
+	logger := zaplogger.GetLogger()
+	var lastToken bson.Raw // Resume point for retries within this run
+	for {
+		token, err := w.watch(ctx, lastToken)
+		lastToken = token
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if resumeTokenLost(err) {
+			logger.Warn("Change stream resume token expired, flushing the cache and watching from now",
+				zap.String("function", "ChangeStreamWatcher.Run"),
+				zap.String("watcherID", w.WatcherID),
+				zap.Error(err),
+			)
+			lastToken = nil
+			FlushCache()
+			if w.TokenStore == nil {
+				continue
+			}
+			// Otherwise the stored token is loaded again, retried after the backoff if this fails
+			if err = w.TokenStore.DeleteResumeToken(ctx, w.WatcherID); err == nil {
+				continue
+			}
+		}
+		logger.Error("Change stream stopped, retrying",
+			zap.String("function", "ChangeStreamWatcher.Run"),
+			zap.String("watcherID", w.WatcherID),
+			zap.Duration("backoff", w.RetryBackoff),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.RetryBackoff):
+		}
+	}
+}
+
+// resumeTokenLost reports whether a change stream failed because its resume token is no longer in
+// the oplog or not valid
+func resumeTokenLost(err error) bool {
+	const (
+		codeInvalidResumeToken      = 260
+		codeChangeStreamHistoryLost = 286
+	)
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) &&
+		(serverErr.HasErrorCode(codeInvalidResumeToken) || serverErr.HasErrorCode(codeChangeStreamHistoryLost))
+}
+
+// watch streams changes, resuming after token or else the stored token, and returns the resume
+// token of the last change handled
+func (w *ChangeStreamWatcher) watch(ctx context.Context, token bson.Raw) (bson.Raw, error) {
+	logger := zaplogger.GetLogger()
+	if Client == nil || databaseName == "" {
+		return token, fmt.Errorf("database is not connected")
+	}
+
+	names := make([]string, 0, len(w.Collections))
+	for _, wc := range w.Collections {
+		names = append(names, wc.Name)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"ns.coll": bson.M{"$in": names}}}}}
+
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if token == nil && w.TokenStore != nil {
+		stored, err := w.TokenStore.LoadResumeToken(ctx, w.WatcherID)
+		if err != nil {
+			return token, err
+		}
+		token = stored
+	}
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+
+	stream, err := Client.Database(databaseName).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return token, fmt.Errorf("failed to open change stream: %w", err)
+	}
+	defer stream.Close(context.Background())
+
+	logger.Info("Change stream opened",
+		zap.String("watcherID", w.WatcherID),
+		zap.Strings("collections", names),
+	)
+
+	for stream.Next(ctx) {
+		var change changeDocument
+		if err := stream.Decode(&change); err != nil {
+			return token, fmt.Errorf("failed to decode change event: %w", err)
+		}
+		w.handleChange(ctx, change)
+
+		token = stream.ResumeToken()
+		if w.TokenStore != nil {
+			if err := w.TokenStore.SaveResumeToken(ctx, w.WatcherID, token); err != nil {
+				logger.Warn("Failed to persist resume token", zap.String("watcherID", w.WatcherID), zap.Error(err))
+			}
+		}
+	}
+	return token, stream.Err()
+}
+
+// handleChange evicts the cache tags for a change and publishes it to subscribers
+func (w *ChangeStreamWatcher) handleChange(ctx context.Context, change changeDocument) {
+	logger := zaplogger.GetLogger()
+
+	var watched *WatchedCollection
+	for i := range w.Collections {
+		if w.Collections[i].Name == change.NS.Coll {
+			watched = &w.Collections[i]
+			break
+		}
+	}
+
+	var action DomainAction
+	switch change.OperationType {
+	case "insert":
+		action = DomainActionCreated
+	case "update", "replace":
+		action = DomainActionUpdated
+	case "delete":
+		action = DomainActionDeleted
+	default:
+		// drop, rename, invalidate etc. cannot be mapped to entities
+		logger.Debug("Flushing cache for unmapped change", zap.String("operationType", change.OperationType))
+		FlushCache()
+		return
+	}
+	if watched == nil {
+		return
+	}
+
+	event := DomainEvent{
+		Type:       DomainEventType(fmt.Sprintf("%s.%s", watched.Entity, action)),
+		Entity:     watched.Entity,
+		Action:     action,
+		Collection: watched.Name,
+		Document:   change.FullDocument,
+		OccurredAt: change.WallTime,
+	}
+	if event.Document == nil {
+		event.Document = change.FullDocumentBeforeChange
+	}
+	if event.Document != nil {
+		event.ClientID = lookupString(event.Document, "client_id")
+		if watched.IDField != "" {
+			event.EntityID = lookupString(event.Document, watched.IDField)
+		}
+	}
+
+	if watched.Tags != nil {
+		event.Tags = watched.Tags(event)
+	} else {
+		if event.ClientID != "" {
+			event.Tags = append(event.Tags, CacheTag(constants.CacheTagClient, event.ClientID))
+		}
+		if event.EntityID != "" {
+			event.Tags = append(event.Tags, CacheTag(watched.Entity, event.EntityID))
+		}
+	}
+
+	if len(event.Tags) == 0 {
+		// Typically a hard delete without pre-images, nothing identifies the cached entries
+		FlushCache()
+	} else {
+		InvalidateTags(event.Tags...)
+	}
+
+	w.mu.RLock()
+	handlers := append([]DomainEventHandler(nil), w.handlers...)
+	w.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(ctx, event)
+	}
+}
+
+func lookupString(doc bson.Raw, field string) string {
+	value, err := doc.LookupErr(field)
+	if err != nil {
+		return ""
+	}
+	str, _ := value.StringValueOK()
+	return str
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// memoryTokenStore keeps resume tokens in memory
+type memoryTokenStore struct {
+	tokens map[string]bson.Raw
+}
+
+func (s *memoryTokenStore) LoadResumeToken(ctx context.Context, watcherID string) (bson.Raw, error) {
+	return s.tokens[watcherID], nil
+}
+
+func (s *memoryTokenStore) SaveResumeToken(ctx context.Context, watcherID string, token bson.Raw) error {
+	s.tokens[watcherID] = token
+	return nil
+}
+
+func (s *memoryTokenStore) DeleteResumeToken(ctx context.Context, watcherID string) error {
+	delete(s.tokens, watcherID)
+	return nil
+}
+
+func newChange(t *testing.T, operationType, collection string, doc bson.M) changeDocument {
+	change := changeDocument{OperationType: operationType, WallTime: time.Now()}
+	change.NS.Coll = collection
+	if doc != nil {
+		raw, err := bson.Marshal(doc)
+		assert.NoError(t, err)
+		change.FullDocument = raw
+	}
+	return change
+}
+
+func TestHandleChangeEvictsTagsAndPublishesEvent(t *testing.T) {
+	initCache(time.Minute, time.Minute)
+
+	levelTag := CacheTag(constants.CacheTagVerificationLevel, "level-1")
+	assert.NoError(t, SetCached("levels:by-name", "cached", levelTag))
+	assert.NoError(t, SetCached("levels:unrelated", "cached", CacheTag(constants.CacheTagVerificationLevel, "level-2")))
+
+	watcher := NewChangeStreamWatcher("test", DefaultWatchedCollections())
+	var received []DomainEvent
+	watcher.Subscribe(func(ctx context.Context, event DomainEvent) {
+		received = append(received, event)
+	})
+
+	watcher.handleChange(context.Background(), newChange(t, "update", constants.CollectionVerificationLevels, bson.M{
+		"level_id":  "level-1",
+		"client_id": "client-1",
+	}))
+
+	var value string
+	found, _ := GetCached("levels:by-name", &value)
+	assert.False(t, found)
+	found, _ = GetCached("levels:unrelated", &value)
+	assert.True(t, found)
+
+	if assert.Len(t, received, 1) {
+		event := received[0]
+		assert.Equal(t, DomainEventType("verification_level.updated"), event.Type)
+		assert.Equal(t, DomainActionUpdated, event.Action)
+		assert.Equal(t, "level-1", event.EntityID)
+		assert.Equal(t, "client-1", event.ClientID)
+		assert.ElementsMatch(t, []string{"client:client-1", levelTag}, event.Tags)
+	}
+}
+
+func TestHandleChangeFlushesWhenUnmapped(t *testing.T) {
+	initCache(time.Minute, time.Minute)
+	assert.NoError(t, SetCached("key", "cached", "client:client-1"))
+
+	watcher := NewChangeStreamWatcher("test", DefaultWatchedCollections())
+	var received []DomainEvent
+	watcher.Subscribe(func(ctx context.Context, event DomainEvent) {
+		received = append(received, event)
+	})
+
+	// A hard delete without pre-images carries no document to derive tags from
+	watcher.handleChange(context.Background(), newChange(t, "delete", constants.CollectionClients, nil))
+
+	var value string
+	found, _ := GetCached("key", &value)
+	assert.False(t, found)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, DomainEventType("client.deleted"), received[0].Type)
+	}
+}
+
+func TestRunRecoversFromExpiredResumeToken(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("history lost", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+		initCache(time.Minute, time.Minute)
+		require.NoError(t, SetCached("key", "cached", "client:client-1"))
+
+		expired, err := bson.Marshal(bson.M{"_data": "expired"})
+		require.NoError(t, err)
+		store := &memoryTokenStore{tokens: map[string]bson.Raw{"test": expired}}
+		watcher := NewChangeStreamWatcher("test", DefaultWatchedCollections())
+		watcher.TokenStore = store
+		watcher.RetryBackoff = time.Hour
+
+		mt.AddMockResponses(
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 286, Name: "ChangeStreamHistoryLost", Message: "resume point no longer in the oplog"}),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Name: "BadValue", Message: "stop"}),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, watcher.Run(ctx), context.DeadlineExceeded)
+
+		// The expired token is dropped, the cache flushed and the stream reopened from now
+		assert.Empty(t, store.tokens)
+		var value string
+		found, _ := GetCached("key", &value)
+		assert.False(t, found)
+
+		first := mt.GetStartedEvent()
+		require.NotNil(t, first)
+		_, err = first.Command.Lookup("pipeline").Array().Index(0).Value().Document().LookupErr("$changeStream", "startAfter")
+		assert.NoError(t, err)
+		reopened := mt.GetStartedEvent()
+		require.NotNil(t, reopened)
+		_, err = reopened.Command.Lookup("pipeline").Array().Index(0).Value().Document().LookupErr("$changeStream", "startAfter")
+		assert.Error(t, err)
+	})
+}
@@ -2,8 +2,12 @@ package common
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
@@ -12,6 +16,8 @@ import (
 	"github.com/rachel-lawrie/verus_backend_core/models"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"go.uber.org/zap"
 )
 
@@ -38,7 +44,7 @@ type SingoleResultInterface interface {
 }
 
 func ConnectDatabase(cfg models.DatabaseConfig) error {
-	cacheStore = cache.New(time.Duration(cfg.CacheExpirationMins)*time.Minute, time.Duration(cfg.CacheCleanupIntervalMins)*time.Minute) // CacheExpirationMins-minute TTL, CacheCleanupIntervalMins-minute cleanup interval
+	initCache(time.Duration(cfg.CacheExpirationMins)*time.Minute, time.Duration(cfg.CacheCleanupIntervalMins)*time.Minute) // CacheExpirationMins-minute TTL, CacheCleanupIntervalMins-minute cleanup interval
 
 	var mongoURI string
 	if cfg.UseAtlas {
@@ -49,14 +55,15 @@ func ConnectDatabase(cfg models.DatabaseConfig) error {
 			cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)
 	}
 
-	var err error
-	Client, err = mongo.NewClient(options.Client().ApplyURI(mongoURI))
+	clientOpts, err := buildClientOptions(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create MongoDB client: %w", err)
+		return fmt.Errorf("invalid database configuration: %w", err)
 	}
+	clientOpts.ApplyURI(mongoURI)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = Client.Connect(ctx)
+	Client, err = mongo.Connect(ctx, clientOpts)
 	if err != nil {
 		return fmt.Errorf("failed to connect to MongoDB at %s:%d: %w", cfg.Host, cfg.Port, err)
 	}
@@ -64,6 +71,12 @@ func ConnectDatabase(cfg models.DatabaseConfig) error {
 	// Store the database name for use in GetCollection
 	databaseName = cfg.Name
 
+	if err := pingWithRetry(cfg); err != nil {
+		Client.Disconnect(context.Background())
+		Client = nil
+		return fmt.Errorf("failed to reach MongoDB at %s:%d: %w", cfg.Host, cfg.Port, err)
+	}
+
 	logger := zaplogger.GetLogger()
 	logger.Info("Database connection established",
 		zap.String("host", cfg.Host),
@@ -72,6 +85,153 @@ func ConnectDatabase(cfg models.DatabaseConfig) error {
 	return nil
 }
 
+// buildClientOptions translates the pool, timeout, read/write concern and TLS settings of the config
+func buildClientOptions(cfg models.DatabaseConfig) (*options.ClientOptions, error) {
+	clientOpts := options.Client()
+
+	if cfg.MaxPoolSize > 0 {
+		clientOpts.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+	if cfg.MinPoolSize > 0 {
+		clientOpts.SetMinPoolSize(cfg.MinPoolSize)
+	}
+	if cfg.MaxConnIdleTimeSecs > 0 {
+		clientOpts.SetMaxConnIdleTime(time.Duration(cfg.MaxConnIdleTimeSecs) * time.Second)
+	}
+	if cfg.ConnectTimeoutSecs > 0 {
+		clientOpts.SetConnectTimeout(time.Duration(cfg.ConnectTimeoutSecs) * time.Second)
+	}
+	if cfg.ServerSelectionTimeoutSecs > 0 {
+		clientOpts.SetServerSelectionTimeout(time.Duration(cfg.ServerSelectionTimeoutSecs) * time.Second)
+	}
+	if cfg.SocketTimeoutSecs > 0 {
+		clientOpts.SetSocketTimeout(time.Duration(cfg.SocketTimeoutSecs) * time.Second)
+	}
+
+	if cfg.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(cfg.ReadPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read preference %q: %w", cfg.ReadPreference, err)
+		}
+		readPref, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read preference %q: %w", cfg.ReadPreference, err)
+		}
+		clientOpts.SetReadPreference(readPref)
+	}
+
+	if cfg.WriteConcern != "" || cfg.WriteConcernJournal {
+		wc := &writeconcern.WriteConcern{}
+		switch cfg.WriteConcern {
+		case "":
+		case "majority":
+			wc.W = "majority"
+		default:
+			w, err := strconv.Atoi(cfg.WriteConcern)
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid write concern %q", cfg.WriteConcern)
+			}
+			wc.W = w
+		}
+		if cfg.WriteConcernJournal {
+			journal := true
+			wc.Journal = &journal
+		}
+		clientOpts.SetWriteConcern(wc)
+	}
+
+	if cfg.TLSEnabled || cfg.TLSCAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.TLSCAFile != "" {
+			caPEM, err := os.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read TLS CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates found in TLS CA file: %s", cfg.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+
+	return clientOpts, nil
+}
+
+// pingWithRetry pings the primary until it answers, backing off exponentially between attempts
+func pingWithRetry(cfg models.DatabaseConfig) error {
+	logger := zaplogger.GetLogger()
+	attempts := cfg.ConnectAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	backoff := time.Duration(cfg.ConnectRetryBackoffSecs) * time.Second
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = PingDatabase(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+		logger.Warn("MongoDB ping failed, retrying",
+			zap.String("function", "ConnectDatabase"),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// PingDatabase checks that the primary is reachable
+func PingDatabase(ctx context.Context) error {
+	if Client == nil {
+		return fmt.Errorf("MongoDB client is not initialized")
+	}
+	return Client.Ping(ctx, readpref.Primary())
+}
+
+// Disconnect closes the MongoDB connection pool, waiting for in-use connections until ctx expires
+func Disconnect(ctx context.Context) error {
+	if Client == nil {
+		return nil
+	}
+	if err := Client.Disconnect(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect from MongoDB: %w", err)
+	}
+	Client = nil
+
+	logger := zaplogger.GetLogger()
+	logger.Info("Database connection closed")
+	return nil
+}
+
+// CacheReady reports whether the in-memory cache has been initialized
+func CacheReady() error {
+	if cacheStore == nil {
+		return fmt.Errorf("cache is not initialized")
+	}
+	return nil
+}
+
+// UseDatabase makes GetCollection return collections of the named database on an already
+// connected client, e.g. one shared with another library or a mocked one in tests
+func UseDatabase(client *mongo.Client, name string) {
+	Client = client
+	databaseName = name
+}
+
 // Helper function to simplify getting data. example: clientsCollection := GetCollection("clients")
 func GetCollection(name string) *mongo.Collection {
 	logger := zaplogger.GetLogger()
@@ -98,23 +258,19 @@ func GetCollection(name string) *mongo.Collection {
 	return Client.Database(databaseName).Collection(name)
 }
 
-// CacheWrapper is a helper function to fetch data from MongoDB and cache the result
-func CacheWrapper(ctx context.Context, collectionName string, cacheKey string, filter interface{}, projection interface{}, result interface{}) error {
+// CacheWrapper is a helper function to fetch data from MongoDB and cache the result.
+// The cache key is registered under the given tags so it can be evicted with InvalidateTags.
+func CacheWrapper(ctx context.Context, collectionName string, cacheKey string, filter interface{}, projection interface{}, result interface{}, tagList ...string) error {
 	logger := zaplogger.GetLogger()
 	// Check the cache first
-	cached, found := cacheStore.Get(cacheKey)
+	found, err := GetCached(cacheKey, result)
 	if found {
 		logger.Debug("Cache hit for key",
 			zap.String("function", "CacheWrapper"),
 			zap.String("cacheKey", cacheKey),
 			zap.String("collection", collectionName),
 		)
-		// Deserialize the cached data
-		jsonData, ok := cached.(string)
-		if !ok {
-			return fmt.Errorf("cache data format error for key: %s", cacheKey)
-		}
-		return json.Unmarshal([]byte(jsonData), result)
+		return err
 	}
 
 	logger.Debug("Cache miss for key",
@@ -141,19 +297,13 @@ func CacheWrapper(ctx context.Context, collectionName string, cacheKey string, f
 	}
 
 	// Decode the result into the provided `result` interface
-	err := singleResult.Decode(result)
+	err = singleResult.Decode(result)
 	if err != nil {
 		return fmt.Errorf("failed to decode MongoDB result: %w", err)
 	}
 
 	// Serialize and store the result in the cache
-	jsonData, err := json.Marshal(result)
-	if err != nil {
-		return fmt.Errorf("failed to serialize data for caching: %w", err)
-	}
-	cacheStore.Set(cacheKey, string(jsonData), cache.DefaultExpiration)
-
-	return nil
+	return SetCached(cacheKey, result, tagList...)
 }
 
 func GenerateCacheKey(collectionName string, filter interface{}) (string, error) {
@@ -43,18 +43,24 @@ func TestConnectDatabase(t *testing.T) {
 		Host:     "localhost",
 		Port:     27017,
 		Name:     "testdb",
+
+		ServerSelectionTimeoutSecs: 2,
+		ConnectAttempts:            1,
 	}
 
 	err := ConnectDatabase(cfg)
-	assert.NoError(t, err)
+	if err != nil {
+		t.Skipf("MongoDB is not reachable: %v", err)
+	}
 	assert.NotNil(t, Client)
 	assert.Equal(t, "testdb", databaseName)
 
 	// Disconnect after test
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = Client.Disconnect(ctx)
+	err = Disconnect(ctx)
 	assert.NoError(t, err)
+	assert.Nil(t, Client)
 }
 
 func TestGetCollection(t *testing.T) {
@@ -64,10 +70,15 @@ func TestGetCollection(t *testing.T) {
 		Host:     "localhost",
 		Port:     27017,
 		Name:     "testdb",
+
+		ServerSelectionTimeoutSecs: 2,
+		ConnectAttempts:            1,
 	}
 
 	err := ConnectDatabase(cfg)
-	assert.NoError(t, err)
+	if err != nil {
+		t.Skipf("MongoDB is not reachable: %v", err)
+	}
 	assert.NotNil(t, Client)
 	assert.Equal(t, "testdb", databaseName)
 
@@ -82,6 +93,36 @@ func TestGetCollection(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestBuildClientOptions(t *testing.T) {
+	cfg := models.DatabaseConfig{
+		MaxPoolSize:         50,
+		MinPoolSize:         5,
+		ConnectTimeoutSecs:  3,
+		ReadPreference:      "secondaryPreferred",
+		WriteConcern:        "majority",
+		WriteConcernJournal: true,
+	}
+
+	opts, err := buildClientOptions(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(50), *opts.MaxPoolSize)
+	assert.Equal(t, uint64(5), *opts.MinPoolSize)
+	assert.Equal(t, 3*time.Second, *opts.ConnectTimeout)
+	assert.Equal(t, "secondaryPreferred", opts.ReadPreference.Mode().String())
+	assert.Equal(t, "majority", opts.WriteConcern.W)
+	assert.True(t, *opts.WriteConcern.Journal)
+	assert.Nil(t, opts.TLSConfig)
+
+	_, err = buildClientOptions(models.DatabaseConfig{ReadPreference: "fastest"})
+	assert.Error(t, err)
+
+	_, err = buildClientOptions(models.DatabaseConfig{WriteConcern: "all"})
+	assert.Error(t, err)
+
+	_, err = buildClientOptions(models.DatabaseConfig{TLSCAFile: "/nonexistent/ca.pem"})
+	assert.Error(t, err)
+}
+
 func TestGetCollectionWithoutInitialization(t *testing.T) {
 	// Ensure Client and databaseName are not set
 	Client = nil
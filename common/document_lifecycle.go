@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// DocumentAuditAction returns the AuditApplicantLog action recorded when a document moves to a
+// status, e.g. "document_rejected"
+func DocumentAuditAction(to models.DocumentStatus) string {
+	return "document_" + to.String()
+}
+
+// TransitionDocument moves a document to a new status through models.Document.Transition and
+// persists it, together with the applicant's embedded copy, and records an audit entry. The update
+// only applies while the stored status is still the one the document was read with, so concurrent
+// transitions cannot both succeed: the loser gets mongo.ErrNoDocuments. Illegal moves return a
+// *models.IllegalTransitionError and leave doc unchanged. Once the status is stored the transition
+// stands, failures to update the embedded copy or write the audit entry are logged.
+func TransitionDocument(ctx context.Context, doc *models.Document, to models.DocumentStatus, actor, reason string) error {
+	logger := zaplogger.GetLogger()
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+
+	updated := *doc
+	transition, err := updated.Transition(to, actor, reason)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{"status": updated.Status, "rejection_reason": updated.RejectionReason, "updated_at": updated.UpdatedAt}
+	result, err := documents.UpdateOne(ctx, bson.M{"document_id": doc.DocumentID, "status": transition.From, "deleted": false}, bson.M{"$set": set})
+	if err != nil {
+		logger.Error("Failed to update document status", zap.String("documentID", doc.DocumentID), zap.Error(err))
+		return fmt.Errorf("failed to update document status: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	*doc = updated
+
+	clientID, err := updateEmbeddedDocument(ctx, updated, set)
+	if err != nil {
+		logger.Error("Failed to update document status on applicant", zap.String("documentID", doc.DocumentID), zap.Error(err))
+	}
+	if doc.ClientID != "" {
+		clientID = doc.ClientID
+	}
+
+	if err := recordTransition(ctx, updated, clientID, transition); err != nil {
+		logger.Error("Failed to record document transition audit log",
+			zap.String("documentID", doc.DocumentID),
+			zap.String("from", transition.From.String()),
+			zap.String("to", transition.To.String()),
+			zap.String("actor", actor),
+			zap.Error(err),
+		)
+	}
+	logger.Info("Document status changed",
+		zap.String("documentID", doc.DocumentID),
+		zap.String("from", transition.From.String()),
+		zap.String("to", transition.To.String()),
+		zap.String("actor", actor),
+	)
+	return nil
+}
+
+// updateEmbeddedDocument applies set to the applicant's copy of a document and returns the
+// applicant's client ID
+func updateEmbeddedDocument(ctx context.Context, document models.Document, set bson.M) (string, error) {
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return "", fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+
+	embedded := bson.M{}
+	for field, value := range set {
+		embedded["documents.$[doc]."+field] = value
+	}
+	var applicant struct {
+		ClientID string `bson:"client_id"`
+	}
+	err := applicants.FindOneAndUpdate(ctx,
+		bson.M{"applicant_id": document.ApplicantID},
+		bson.M{"$set": embedded},
+		options.FindOneAndUpdate().
+			SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"doc.document_id": document.DocumentID}}}).
+			SetProjection(bson.M{"client_id": 1}),
+	).Decode(&applicant)
+	return applicant.ClientID, err
+}
+
+func recordTransition(ctx context.Context, document models.Document, clientID string, transition models.DocumentTransition) error {
+	auditLogs := GetCollection(constants.CollectionAuditLogs)
+	if auditLogs == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionAuditLogs)
+	}
+
+	details := fmt.Sprintf("Document %s moved from %s to %s by %s", document.DocumentID, transition.From, transition.To, transition.Actor)
+	if transition.Reason != "" {
+		details += ": " + transition.Reason
+	}
+	entry := models.AuditApplicantLog{
+		LogID:           uuid.New().String(),
+		ApplicantID:     document.ApplicantID,
+		ActionPerformed: DocumentAuditAction(transition.To),
+		Details:         details,
+		Timestamp:       transition.At,
+		ClientID:        clientID,
+	}
+	if _, err := auditLogs.InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to record audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// ScanDocument scans the file of a document uploaded with status DocumentUploadPending and moves it
+// to DocumentUploaded when it is clean or DocumentQuarantined when malware was found, recording
+// the scan result on the document and on the applicant's embedded copy. The status change goes
+// through TransitionDocument and is audited.
+//
+// When the file cannot be scanned the document stays pending and the error is returned so the
+// scan can be retried. Returns mongo.ErrNoDocuments when no pending document has the ID.
+func ScanDocument(ctx context.Context, documentID string, uploader interfaces.Uploader, kmsUploader interfaces.KMSUploader, scanner interfaces.Scanner) (models.Document, error) {
+	logger := zaplogger.GetLogger()
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return models.Document{}, fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+
+	pending := bson.M{"document_id": documentID, "status": models.DocumentUploadPending, "deleted": false}
+	var document models.Document
+	if err := documents.FindOne(ctx, pending).Decode(&document); err != nil {
+		return document, err
+	}
+
+	content, err := uploader.DownloadDecrypted(ctx, document.StorageKey(), kmsUploader)
+	if err != nil {
+		logger.Error("Failed to open document for scanning", zap.String("documentID", documentID), zap.Error(err))
+		return document, fmt.Errorf("failed to open document for scanning: %w", err)
+	}
+	result, err := scanner.Scan(ctx, content)
+	content.Close()
+	if err != nil {
+		logger.Error("Failed to scan document", zap.String("documentID", documentID), zap.Error(err))
+		return document, fmt.Errorf("failed to scan document: %w", err)
+	}
+
+	updateResult, err := documents.UpdateOne(ctx, pending, bson.M{"$set": bson.M{"scan": result}})
+	if err != nil {
+		logger.Error("Failed to record document scan result", zap.String("documentID", documentID), zap.Error(err))
+		return document, fmt.Errorf("failed to record scan result: %w", err)
+	}
+	if updateResult.MatchedCount == 0 {
+		// Deleted or scanned concurrently, leave the document as the other writer left it
+		return document, mongo.ErrNoDocuments
+	}
+	document.Scan = &result
+	if _, err := updateEmbeddedDocument(ctx, document, bson.M{"scan": result}); err != nil {
+		logger.Error("Failed to record scan result on applicant", zap.String("documentID", documentID), zap.Error(err))
+	}
+
+	status, reason := models.DocumentUploaded, ""
+	if !result.Clean {
+		status, reason = models.DocumentQuarantined, "malware detected: "+result.Signature
+		logger.Warn("Quarantined document",
+			zap.String("documentID", documentID),
+			zap.String("applicantID", document.ApplicantID),
+			zap.String("signature", result.Signature),
+		)
+	}
+	if err := TransitionDocument(ctx, &document, status, "scanner:"+result.Scanner, reason); err != nil {
+		return document, err
+	}
+	return document, nil
+}
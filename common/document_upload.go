@@ -0,0 +1,35 @@
+package common
+
+import (
+	"context"
+
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+// UploadDocument validates, normalizes, hashes, encrypts and stores the file of a new document
+// with the default upload rules (see utils.UploadRules.Upload), then checks whether its content,
+// or for images a near-duplicate of it within fraud.SimilarityThreshold, was already uploaded for
+// another applicant of the client.
+// The document is not saved, the caller inserts it once this returns and must then run
+// ScanDocument: the document is DocumentUploadPending until its scan finished clean, it is not
+// served and does not count towards its applicant's level before. Rejections are returned as
+// *errors.FieldError. A failed check is logged rather than returned, the file is stored by then
+// and the upload must not be lost.
+func UploadDocument(ctx context.Context, uploader interfaces.Uploader, file utils.DocumentFile, document *models.Document, kmsUploader interfaces.KMSUploader, fraud models.FraudConfig) error {
+	logger := zaplogger.GetLogger()
+	if err := utils.DefaultUploadRules.Upload(ctx, uploader, file, document, kmsUploader); err != nil {
+		return err
+	}
+
+	if _, err := DetectDuplicateDocument(ctx, *document); err != nil {
+		logger.Error("Failed to check document for duplicates", zap.String("documentID", document.DocumentID), zap.Error(err))
+	}
+	if _, err := DetectSimilarDocument(ctx, *document, fraud.SimilarityThreshold); err != nil {
+		logger.Error("Failed to check document for similar images", zap.String("documentID", document.DocumentID), zap.Error(err))
+	}
+	return nil
+}
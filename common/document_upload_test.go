@@ -0,0 +1,125 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// uploadTestPassport uploads a passport image for applicant-1 through UploadDocument
+func uploadTestPassport(t *testing.T, content []byte, fraud models.FraudConfig) models.Document {
+	client, err := utils.NewLocalKMSClient(map[string][]byte{"dev-key": []byte("0123456789abcdef0123456789abcdef")})
+	require.NoError(t, err)
+	kmsUploader := &utils.KMSUploader{Client: client, KeyID: "dev-key"}
+	uploader, err := utils.NewLocalUploader(t.TempDir())
+	require.NoError(t, err)
+
+	document := models.Document{DocumentID: "doc-1", ApplicantID: "applicant-1", ClientID: "client-1", DocumentType: models.DocumentPassport}
+	err = UploadDocument(context.Background(), uploader, utils.DocumentFile{
+		Content:   bytes.NewReader(content),
+		Size:      int64(len(content)),
+		ObjectKey: "applicant-1/doc-1",
+	}, &document, kmsUploader, fraud)
+	require.NoError(t, err)
+	return document
+}
+
+func testPassportImage(t *testing.T) []byte {
+	img := image.NewGray(image.Rect(0, 0, 800, 600))
+	for x := 0; x < 800; x++ {
+		for y := 0; y < 600; y++ {
+			img.Pix[y*img.Stride+x] = uint8(x * y % 251)
+		}
+	}
+	var content bytes.Buffer
+	require.NoError(t, png.Encode(&content, img))
+	return content.Bytes()
+}
+
+func TestUploadDocumentPendingUntilScanned(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("upload", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		// No duplicates and no similar images
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch),
+		)
+
+		document := uploadTestPassport(t, testPassportImage(t), models.FraudConfig{})
+		assert.Equal(t, models.DocumentUploadPending, document.Status)
+		assert.False(t, document.Servable())
+
+		level := models.VerificationLevel{LevelID: "level-1", RequiredDocs: []models.DocumentType{models.DocumentPassport}}
+		assert.False(t, level.EvaluateWith([]models.Document{document}, models.EvaluationContext{}).CanProceed)
+	})
+}
+
+func TestUploadDocumentSimilarityThreshold(t *testing.T) {
+	content := testPassportImage(t)
+	perceptualHash, err := utils.ImagePerceptualHash(content)
+	require.NoError(t, err)
+	hash, err := utils.ParsePerceptualHash(perceptualHash)
+	require.NoError(t, err)
+	// 12 bits apart, beyond the default threshold
+	candidate := models.Document{
+		DocumentID:     "doc-2",
+		ApplicantID:    "applicant-2",
+		ClientID:       "client-1",
+		DocumentType:   models.DocumentPassport,
+		PerceptualHash: utils.FormatPerceptualHash(hash ^ 0xfff),
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		similar   bool
+	}{
+		{"default threshold", 0, false},
+		{"configured threshold", 16, true},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			UseDatabase(mt.Client, "verus")
+			defer UseDatabase(nil, "")
+
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch),
+				mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, mockDocument(t, candidate)),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			)
+
+			uploadTestPassport(t, content, models.FraudConfig{SimilarityThreshold: tt.threshold})
+
+			// Only recent images are compared
+			mt.GetStartedEvent()
+			query := mt.GetStartedEvent()
+			require.NotNil(t, query)
+			assert.Equal(t, int64(SimilarDocumentLimit), query.Command.Lookup("limit").AsInt64())
+			assert.Equal(t, bson.TypeDateTime, query.Command.Lookup("filter", "created_at", "$gte").Type)
+
+			// A match records a risk signal on the applicant after the two queries
+			signal := mt.GetStartedEvent()
+			if tt.similar {
+				require.NotNil(t, signal)
+				assert.Equal(t, "update", signal.CommandName)
+			} else {
+				assert.Nil(t, signal)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	// Names of the indexes duplicate and similarity detection queries use
+	documentContentHashIndex    = "client_id_content_hash"
+	documentPerceptualHashIndex = "client_id_perceptual_hash_created_at"
+
+	// SimilarDocumentWindow and SimilarDocumentLimit bound the images an upload is compared with
+	SimilarDocumentWindow = 365 * 24 * time.Hour
+	SimilarDocumentLimit  = 10000
+)
+
+// EnsureDocumentIndexes creates the indexes of the documents collection. It is idempotent and
+// must run at startup after ConnectDatabase, together with EnsureVerificationLevelVersions.
+func EnsureDocumentIndexes(ctx context.Context) error {
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+	// Documents without the hashes, e.g. uploaded before hashing or not images, are left out
+	_, err := documents.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "client_id", Value: 1}, {Key: "content_hash", Value: 1}},
+			Options: options.Index().
+				SetName(documentContentHashIndex).
+				SetPartialFilterExpression(bson.M{"content_hash": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.D{{Key: "client_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().
+				SetName(documentPerceptualHashIndex).
+				SetPartialFilterExpression(bson.M{"perceptual_hash": bson.M{"$type": "string"}}),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create document indexes: %w", err)
+	}
+	return nil
+}
+
+// FindDuplicateDocuments returns the live documents of the client's other applicants with the
+// given content hash
+func FindDuplicateDocuments(ctx context.Context, clientID, contentHash, applicantID string) ([]models.Document, error) {
+	var duplicates []models.Document
+	if contentHash == "" {
+		return duplicates, nil
+	}
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return nil, fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+
+	cursor, err := documents.Find(ctx, bson.M{
+		"client_id":    clientID,
+		"content_hash": contentHash,
+		"applicant_id": bson.M{"$ne": applicantID},
+		"deleted":      false,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate documents: %w", err)
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return nil, fmt.Errorf("failed to decode duplicate documents: %w", err)
+	}
+	return duplicates, nil
+}
+
+// DetectDuplicateDocument checks whether the content of a newly uploaded document was already
+// uploaded for another applicant of the same client, a common sign of identity fraud. Any reuse
+// is recorded as a RiskSignalDuplicateDocument on the document's applicant, once per document.
+// The duplicates found are returned.
+func DetectDuplicateDocument(ctx context.Context, document models.Document) ([]models.Document, error) {
+	logger := zaplogger.GetLogger()
+	duplicates, err := FindDuplicateDocuments(ctx, document.ClientID, document.ContentHash, document.ApplicantID)
+	if err != nil || len(duplicates) == 0 {
+		return duplicates, err
+	}
+
+	related := otherApplicants(duplicates)
+	signal := models.RiskSignal{
+		Type:                models.RiskSignalDuplicateDocument,
+		DocumentID:          document.DocumentID,
+		RelatedApplicantIDs: related,
+		Details:             fmt.Sprintf("%s content was also uploaded for applicants %s", document.DocumentType, strings.Join(related, ", ")),
+		DetectedAt:          time.Now(),
+	}
+	logger.Warn("Detected document reused across applicants",
+		zap.String("documentID", document.DocumentID),
+		zap.String("applicantID", document.ApplicantID),
+		zap.String("clientID", document.ClientID),
+		zap.Strings("relatedApplicantIDs", related),
+	)
+	return duplicates, recordRiskSignal(ctx, document, signal)
+}
+
+// SimilarDocument is a document whose image is a near-duplicate of another
+type SimilarDocument struct {
+	Document models.Document
+	Distance int // Hamming distance between the perceptual hashes, 0 for identical pictures
+}
+
+// FindSimilarDocuments returns the live image documents of the client's other applicants whose
+// perceptual hash is within threshold bits of perceptualHash, closest first. Hamming distance
+// cannot be queried, so hashes are compared here: only the SimilarDocumentLimit most recent
+// images uploaded within SimilarDocumentWindow are, older reuse goes undetected.
+func FindSimilarDocuments(ctx context.Context, clientID, perceptualHash, applicantID string, threshold int) ([]SimilarDocument, error) {
+	var similar []SimilarDocument
+	hash, err := utils.ParsePerceptualHash(perceptualHash)
+	if err != nil {
+		return nil, err
+	}
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		return nil, fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments)
+	}
+
+	// The index serves the newest first, the projection keeps the documents small
+	cursor, err := documents.Find(ctx,
+		bson.M{
+			"client_id":       clientID,
+			"perceptual_hash": bson.M{"$type": "string"},
+			"created_at":      bson.M{"$gte": time.Now().Add(-SimilarDocumentWindow)},
+			"applicant_id":    bson.M{"$ne": applicantID},
+			"deleted":         false,
+		},
+		options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: -1}}).
+			SetLimit(SimilarDocumentLimit).
+			SetProjection(bson.M{"document_id": 1, "applicant_id": 1, "client_id": 1, "document_type": 1, "perceptual_hash": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query document perceptual hashes: %w", err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var candidate models.Document
+		if err := cursor.Decode(&candidate); err != nil {
+			return nil, fmt.Errorf("failed to decode document: %w", err)
+		}
+		candidateHash, err := utils.ParsePerceptualHash(candidate.PerceptualHash)
+		if err != nil {
+			continue
+		}
+		if distance := utils.HammingDistance(hash, candidateHash); distance <= threshold {
+			similar = append(similar, SimilarDocument{Document: candidate, Distance: distance})
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read document perceptual hashes: %w", err)
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+	return similar, nil
+}
+
+// DetectSimilarDocument checks whether the image of a newly uploaded document is a near-duplicate,
+// e.g. a re-cropped or re-compressed copy, of another applicant's of the same client, and records
+// a RiskSignalSimilarDocument on the document's applicant if so. threshold is the maximum Hamming
+// distance, utils.DefaultSimilarityThreshold when zero. The similar documents found are returned.
+func DetectSimilarDocument(ctx context.Context, document models.Document, threshold int) ([]SimilarDocument, error) {
+	logger := zaplogger.GetLogger()
+	if document.PerceptualHash == "" {
+		return nil, nil
+	}
+	if threshold <= 0 {
+		threshold = utils.DefaultSimilarityThreshold
+	}
+	similar, err := FindSimilarDocuments(ctx, document.ClientID, document.PerceptualHash, document.ApplicantID, threshold)
+	if err != nil || len(similar) == 0 {
+		return similar, err
+	}
+
+	matches := make([]models.Document, len(similar))
+	for i, match := range similar {
+		matches[i] = match.Document
+	}
+	related := otherApplicants(matches)
+	signal := models.RiskSignal{
+		Type:                models.RiskSignalSimilarDocument,
+		DocumentID:          document.DocumentID,
+		RelatedApplicantIDs: related,
+		Details: fmt.Sprintf("%s image resembles documents of applicants %s (closest distance %d of %d)",
+			document.DocumentType, strings.Join(related, ", "), similar[0].Distance, threshold),
+		DetectedAt: time.Now(),
+	}
+	logger.Warn("Detected near-duplicate document image across applicants",
+		zap.String("documentID", document.DocumentID),
+		zap.String("applicantID", document.ApplicantID),
+		zap.String("clientID", document.ClientID),
+		zap.Strings("relatedApplicantIDs", related),
+		zap.Int("distance", similar[0].Distance),
+	)
+	return similar, recordRiskSignal(ctx, document, signal)
+}
+
+// otherApplicants returns the distinct applicants of documents, in order
+func otherApplicants(documents []models.Document) []string {
+	var applicantIDs []string
+	seen := map[string]bool{}
+	for _, document := range documents {
+		if !seen[document.ApplicantID] {
+			seen[document.ApplicantID] = true
+			applicantIDs = append(applicantIDs, document.ApplicantID)
+		}
+	}
+	return applicantIDs
+}
+
+// recordRiskSignal adds a signal raised by a document to its applicant, unless that document
+// already raised a signal of the same type
+func recordRiskSignal(ctx context.Context, document models.Document, signal models.RiskSignal) error {
+	logger := zaplogger.GetLogger()
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+	_, err := applicants.UpdateOne(ctx,
+		bson.M{
+			"applicant_id": document.ApplicantID,
+			"client_id":    document.ClientID,
+			"risk_signals": bson.M{"$not": bson.M{"$elemMatch": bson.M{"type": signal.Type, "document_id": signal.DocumentID}}},
+		},
+		bson.M{
+			"$push": bson.M{"risk_signals": signal},
+			"$set":  bson.M{"updated_at": signal.DetectedAt},
+		},
+	)
+	if err != nil {
+		logger.Error("Failed to record risk signal", zap.String("type", signal.Type), zap.String("applicantID", document.ApplicantID), zap.Error(err))
+		return fmt.Errorf("failed to record risk signal: %w", err)
+	}
+	return nil
+}
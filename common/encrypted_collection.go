@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EncryptedCollection wraps a collection so that `verus:"encrypt"` fields are encrypted on write
+// and decrypted on read, without callers handling PII fields one by one
+type EncryptedCollection struct {
+	Collection CollectionInterface
+	Encryptor  *utils.FieldEncryptor
+}
+
+// NewEncryptedCollection wraps the named collection with the given field encryptor
+func NewEncryptedCollection(name string, encryptor *utils.FieldEncryptor) (*EncryptedCollection, error) {
+	collection := GetCollection(name)
+	if collection == nil {
+		return nil, fmt.Errorf("failed to get collection: %s", name)
+	}
+	return &EncryptedCollection{Collection: collection, Encryptor: encryptor}, nil
+}
+
+// InsertOne encrypts a copy of record and inserts it. The generated DEK is written back to record
+// so the caller can keep using it.
+func (ec *EncryptedCollection) InsertOne(ctx context.Context, record interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	encrypted, err := ec.encryptedCopy(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.CopyDataKey(encrypted, record); err != nil {
+		return nil, err
+	}
+	return ec.Collection.InsertOne(ctx, encrypted, opts...)
+}
+
+// UpdateRecord encrypts a copy of record and $sets all of its fields on the document matching filter
+func (ec *EncryptedCollection) UpdateRecord(ctx context.Context, filter interface{}, record interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	encrypted, err := ec.encryptedCopy(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.CopyDataKey(encrypted, record); err != nil {
+		return nil, err
+	}
+	return ec.Collection.UpdateOne(ctx, filter, map[string]interface{}{"$set": encrypted}, opts...)
+}
+
+// FindOne decodes the first document matching filter into result and decrypts it
+func (ec *EncryptedCollection) FindOne(ctx context.Context, filter interface{}, result interface{}, opts ...*options.FindOneOptions) error {
+	if err := ec.Collection.FindOne(ctx, filter, opts...).Decode(result); err != nil {
+		return err
+	}
+	return ec.Encryptor.Decrypt(ctx, result)
+}
+
+// Find decodes every document matching filter into results, a pointer to a slice of structs, and decrypts them
+func (ec *EncryptedCollection) Find(ctx context.Context, filter interface{}, results interface{}, opts ...*options.FindOptions) error {
+	cursor, err := ec.Collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, results); err != nil {
+		return err
+	}
+
+	slice := reflect.ValueOf(results).Elem()
+	for i := 0; i < slice.Len(); i++ {
+		if err := ec.Encryptor.Decrypt(ctx, slice.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedCopy returns a pointer to an encrypted copy of record, leaving the caller's plaintext intact
+func (ec *EncryptedCollection) encryptedCopy(ctx context.Context, record interface{}) (interface{}, error) {
+	v := reflect.ValueOf(record)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("record must be a non-nil pointer to a struct, got %T", record)
+	}
+	copied := reflect.New(v.Elem().Type())
+	copyStruct(copied.Elem(), v.Elem())
+	if err := ec.Encryptor.Encrypt(ctx, copied.Interface()); err != nil {
+		return nil, err
+	}
+	return copied.Interface(), nil
+}
+
+// copyStruct copies src into dst, giving dst its own copy of every nested struct pointer the
+// field encryptor descends into so encrypting dst never writes through to src
+func copyStruct(dst, src reflect.Value) {
+	dst.Set(src)
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Type().Field(i).IsExported() {
+			continue
+		}
+		field := src.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			copyStruct(dst.Field(i), field)
+		case reflect.Ptr:
+			if !field.IsNil() && field.Elem().Kind() == reflect.Struct {
+				copied := reflect.New(field.Elem().Type())
+				copyStruct(copied.Elem(), field.Elem())
+				dst.Field(i).Set(copied)
+			}
+		}
+	}
+}
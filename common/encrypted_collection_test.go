@@ -0,0 +1,51 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rachel-lawrie/verus_backend_core/mocks"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type encryptedContact struct {
+	Email string `bson:"email" verus:"encrypt"`
+}
+
+type encryptedRecord struct {
+	RecordID string            `bson:"record_id" verus:"aad"`
+	Name     string            `bson:"name" verus:"encrypt"`
+	Contact  *encryptedContact `bson:"contact"`
+	DEK      []byte            `bson:"dek" verus:"dek"`
+}
+
+func TestEncryptedCollectionLeavesCallerPlaintext(t *testing.T) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		CiphertextBlob: []byte("wrapped-key"),
+	}, nil)
+	collection := new(MockCollection)
+	collection.On("InsertOne", mock.Anything, mock.Anything, mock.Anything).Return(&mongo.InsertOneResult{}, nil)
+
+	ec := &EncryptedCollection{
+		Collection: collection,
+		Encryptor:  utils.NewFieldEncryptor(&utils.KMSUploader{Client: mockKmsClient, KeyID: "test-key-id"}),
+	}
+	record := &encryptedRecord{RecordID: "record123", Name: "Ada", Contact: &encryptedContact{Email: "ada@example.com"}}
+
+	_, err := ec.InsertOne(context.TODO(), record)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", record.Name)
+	assert.Equal(t, "ada@example.com", record.Contact.Email)
+	assert.Equal(t, []byte("wrapped-key"), record.DEK)
+
+	inserted := collection.Calls[0].Arguments.Get(1).(*encryptedRecord)
+	assert.True(t, utils.IsEncryptedValue(inserted.Name))
+	assert.True(t, utils.IsEncryptedValue(inserted.Contact.Email))
+	assert.NotSame(t, record.Contact, inserted.Contact)
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// AuditActionErased is the AuditApplicantLog action recorded for right-to-erasure requests
+const AuditActionErased = "erased"
+
+// ErasureResult summarizes an erasure request
+type ErasureResult struct {
+	ApplicantID      string
+	KeyDestroyedAt   time.Time
+	DocumentsMarked  int // Documents flagged for purge together with their files
+	AuditLogRecorded bool
+}
+
+// EraseApplicant crypto-shreds an applicant for a right-to-erasure request: the applicant's DEK is
+// destroyed, which makes every ciphertext encrypted with it unrecoverable, the plaintext PII fields
+// are wiped, and the applicant and its documents are flagged so the purge job deletes them and
+// their files. An AuditApplicantLog entry records the request.
+//
+// Later decryption attempts fail with utils.DataKeyDestroyedError. envelope is optional and only
+// used to drop the unwrapped key from memory. Returns mongo.ErrNoDocuments when the applicant does
+// not exist, or a DataKeyDestroyedError when it was already erased.
+func EraseApplicant(c *gin.Context, applicantID string, reason string, envelope *utils.EnvelopeService) (ErasureResult, error) {
+	logger := zaplogger.GetLogger()
+	result := ErasureResult{ApplicantID: applicantID}
+	ctx := c.Request.Context()
+
+	clientID, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return result, err
+	}
+	actor, err := utils.GetActorFromContext(c)
+	if err != nil {
+		return result, err
+	}
+
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return result, fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+
+	filter := bson.M{"applicant_id": applicantID, "client_id": clientID}
+	var applicant models.Applicant
+	if err := applicants.FindOne(ctx, filter).Decode(&applicant); err != nil {
+		return result, err
+	}
+	if applicant.EncryptedData.KeyDestroyedAt != nil {
+		return result, &utils.DataKeyDestroyedError{DestroyedAt: *applicant.EncryptedData.KeyDestroyedAt}
+	}
+
+	// Destroy the key first and only once: the filter fails if a concurrent request got there before
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"first_name":                      "",
+			"middle_name":                     "",
+			"last_name":                       "",
+			"email":                           "",
+			"phone":                           "",
+			"encrypted_data.encrypted_key":    nil,
+			"encrypted_data.key_destroyed_at": now,
+			"deleted":                         true,
+			"deleted_at":                      now,
+			"deleted_by":                      actor,
+			"erase_requested":                 true,
+			"updated_at":                      now,
+		},
+		"$unset": bson.M{"sumsub_applicant": "", "payload": ""},
+	}
+	if len(applicant.Documents) > 0 {
+		set := update["$set"].(bson.M)
+		set["documents.$[].deleted"] = true
+		set["documents.$[].deleted_at"] = now
+		set["documents.$[].deleted_by"] = actor
+		set["documents.$[].erase_requested"] = true
+	}
+	shredFilter := bson.M{"applicant_id": applicantID, "client_id": clientID, "encrypted_data.key_destroyed_at": bson.M{"$exists": false}}
+	updateResult, err := applicants.UpdateOne(ctx, shredFilter, update)
+	if err != nil {
+		logger.Error("Failed to destroy applicant data key", zap.String("applicantID", applicantID), zap.Error(err))
+		return result, fmt.Errorf("failed to destroy applicant data key: %w", err)
+	}
+	if updateResult.MatchedCount == 0 {
+		return result, &utils.DataKeyDestroyedError{DestroyedAt: now}
+	}
+	result.KeyDestroyedAt = now
+	if envelope != nil && len(applicant.EncryptedData.EncryptedKey) > 0 {
+		envelope.ForgetDataKey(applicant.EncryptedData.EncryptedKey)
+	}
+
+	// From here on the data is unrecoverable, failures are logged and reported but not rolled back
+	var errs []error
+	documents := GetCollection(constants.CollectionDocuments)
+	if documents == nil {
+		errs = append(errs, fmt.Errorf("failed to get collection: %s", constants.CollectionDocuments))
+	} else {
+		marked, err := documents.UpdateMany(ctx,
+			bson.M{"applicant_id": applicantID, "erase_requested": bson.M{"$ne": true}},
+			bson.M{"$set": bson.M{
+				"deleted":         true,
+				"deleted_at":      now,
+				"deleted_by":      actor,
+				"erase_requested": true,
+				"updated_at":      now,
+			}},
+		)
+		if err != nil {
+			logger.Error("Failed to mark documents of erased applicant", zap.String("applicantID", applicantID), zap.Error(err))
+			errs = append(errs, fmt.Errorf("failed to mark documents for deletion: %w", err))
+		} else {
+			result.DocumentsMarked = int(marked.ModifiedCount)
+		}
+	}
+
+	if err := recordErasure(c, applicantID, clientID, actor, reason, now); err != nil {
+		logger.Error("Failed to record erasure audit log", zap.String("applicantID", applicantID), zap.Error(err))
+		errs = append(errs, err)
+	} else {
+		result.AuditLogRecorded = true
+	}
+
+	logger.Info("Erased applicant",
+		zap.String("function", "EraseApplicant"),
+		zap.String("applicantID", applicantID),
+		zap.String("clientID", clientID),
+		zap.String("erasedBy", actor),
+		zap.Int("documentsMarked", result.DocumentsMarked),
+	)
+	return result, errors.Join(errs...)
+}
+
+func recordErasure(c *gin.Context, applicantID, clientID, actor, reason string, at time.Time) error {
+	auditLogs := GetCollection(constants.CollectionAuditLogs)
+	if auditLogs == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionAuditLogs)
+	}
+
+	details := fmt.Sprintf("Applicant data key destroyed and PII erased by %s", actor)
+	if reason != "" {
+		details += ": " + reason
+	}
+	entry := models.AuditApplicantLog{
+		LogID:           uuid.New().String(),
+		ApplicantID:     applicantID,
+		ActionPerformed: AuditActionErased,
+		Details:         details,
+		Timestamp:       at,
+		ClientID:        clientID,
+		IP:              c.ClientIP(),
+	}
+	if _, err := auditLogs.InsertOne(c.Request.Context(), entry); err != nil {
+		return fmt.Errorf("failed to record erasure audit log: %w", err)
+	}
+	return nil
+}
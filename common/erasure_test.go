@@ -0,0 +1,51 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEraseApplicantFlagsApplicantForPurge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("erase", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodDelete, "/applicants/applicant-1/erase", nil)
+		c.Set("client_id", "client-1")
+
+		applicant := models.Applicant{ApplicantID: "applicant-1", ClientID: "client-1", FirstName: "Jane"}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, mockDocument(t, applicant)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		result, err := EraseApplicant(c, "applicant-1", "requested by applicant", nil)
+		require.NoError(t, err)
+		assert.False(t, result.KeyDestroyedAt.IsZero())
+		assert.True(t, result.AuditLogRecorded)
+
+		// The applicant record itself is picked up by the purge job, not only its documents
+		mt.GetStartedEvent()
+		shred := mt.GetStartedEvent()
+		require.NotNil(t, shred)
+		require.Equal(t, "update", shred.CommandName)
+		set := shred.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$set").Document()
+		assert.True(t, set.Lookup("deleted").Boolean())
+		assert.True(t, set.Lookup("erase_requested").Boolean())
+		assert.Equal(t, "client-1", set.Lookup("deleted_by").StringValue())
+	})
+}
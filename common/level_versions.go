@@ -0,0 +1,222 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	// levelVersionIndex makes version numbers unique per level, so concurrent drafts conflict
+	levelVersionIndex = "client_id_level_id_version"
+
+	// AuditActionApplicantLevelMigrated is recorded when an applicant is moved to another level version
+	AuditActionApplicantLevelMigrated = "applicant_level_migrated"
+)
+
+// ErrLevelVersionNotPublished is returned when applicants are migrated to a version that is not
+// published
+var ErrLevelVersionNotPublished = errors.New("verification level version is not published")
+
+// CurrentLevelFilter matches the live current versions of a client's verification levels. Levels
+// stored before versioning have no current flag and are their own current version.
+func CurrentLevelFilter(clientID string) bson.M {
+	return bson.M{"client_id": clientID, "deleted": false, "current": bson.M{"$ne": false}}
+}
+
+// EnsureVerificationLevelVersions marks levels stored before versioning as published version 1
+// and creates the index keeping version numbers unique. It is idempotent and must run at startup
+// after ConnectDatabase, together with EnsureDocumentIndexes: without the index concurrent
+// updates can create two drafts of the same level.
+func EnsureVerificationLevelVersions(ctx context.Context) error {
+	levels := GetCollection(constants.CollectionVerificationLevels)
+	if levels == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionVerificationLevels)
+	}
+	_, err := levels.UpdateMany(ctx,
+		bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1, "state": models.LevelStatePublished, "current": true}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to backfill verification level versions: %w", err)
+	}
+	_, err = levels.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "client_id", Value: 1}, {Key: "level_id", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetName(levelVersionIndex).SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create verification level version index: %w", err)
+	}
+	return nil
+}
+
+// FindLevelVersion returns a published version of a client's verification level. Versions stay
+// available after the level is deleted so the applicants pinned to them can still be evaluated,
+// the purge job keeps them as long as applicants are pinned to them.
+func FindLevelVersion(ctx context.Context, clientID, levelID string, version int) (models.VerificationLevel, error) {
+	var level models.VerificationLevel
+	levels := GetCollection(constants.CollectionVerificationLevels)
+	if levels == nil {
+		return level, fmt.Errorf("failed to get collection: %s", constants.CollectionVerificationLevels)
+	}
+	err := levels.FindOne(ctx, bson.M{
+		"client_id": clientID,
+		"level_id":  levelID,
+		"version":   version,
+		"state":     models.LevelStatePublished,
+	}).Decode(&level)
+	return level, err
+}
+
+// ResolveApplicantLevel returns the verification level version an applicant is evaluated
+// against. Applicants that are not pinned yet are pinned to the current version of their level,
+// which they then keep when newer versions are published until they are migrated.
+func ResolveApplicantLevel(ctx context.Context, applicant *models.Applicant) (models.VerificationLevel, error) {
+	logger := zaplogger.GetLogger()
+	var level models.VerificationLevel
+	if applicant.LevelID != "" && applicant.LevelVersion > 0 {
+		pinned, err := FindLevelVersion(ctx, applicant.ClientID, applicant.LevelID, applicant.LevelVersion)
+		if err != nil {
+			return pinned, fmt.Errorf("failed to load version %d of verification level %s: %w", applicant.LevelVersion, applicant.LevelID, err)
+		}
+		return pinned, nil
+	}
+
+	levels := GetCollection(constants.CollectionVerificationLevels)
+	applicants := GetCollection(constants.CollectionApplicants)
+	if levels == nil || applicants == nil {
+		return level, fmt.Errorf("failed to get collections: %s, %s", constants.CollectionVerificationLevels, constants.CollectionApplicants)
+	}
+	filter := CurrentLevelFilter(applicant.ClientID)
+	filter["name"] = applicant.VerificationLevel
+	if err := levels.FindOne(ctx, filter).Decode(&level); err != nil {
+		return level, fmt.Errorf("failed to load verification level %q: %w", applicant.VerificationLevel, err)
+	}
+	if level.Version == 0 {
+		// Not backfilled yet, see EnsureVerificationLevelVersions
+		return level, nil
+	}
+
+	_, err := applicants.UpdateOne(ctx,
+		bson.M{"applicant_id": applicant.ApplicantID, "client_id": applicant.ClientID, "level_version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"level_id": level.LevelID, "level_version": level.Version}},
+	)
+	if err != nil {
+		logger.Error("Failed to pin applicant to verification level version", zap.String("applicantID", applicant.ApplicantID), zap.Error(err))
+		return level, fmt.Errorf("failed to pin applicant level: %w", err)
+	}
+	applicant.LevelID, applicant.LevelVersion = level.LevelID, level.Version
+	return level, nil
+}
+
+// MigrateApplicantsToLevelVersion moves the applicants of a client's verification level selected
+// by migration to a published version, recording an audit entry for each. Only pinned applicants
+// are moved, unpinned ones start on the current version anyway. Each applicant is only moved while
+// it is still on the version it was selected on, so concurrent migrations do not move it twice.
+func MigrateApplicantsToLevelVersion(ctx context.Context, clientID, levelID string, migration models.LevelMigration) (models.LevelMigrationResult, error) {
+	logger := zaplogger.GetLogger()
+	result := models.LevelMigrationResult{LevelID: levelID, DryRun: migration.DryRun}
+	levels := GetCollection(constants.CollectionVerificationLevels)
+	applicants := GetCollection(constants.CollectionApplicants)
+	auditLogs := GetCollection(constants.CollectionAuditLogs)
+	if levels == nil || applicants == nil || auditLogs == nil {
+		return result, fmt.Errorf("failed to get collections: %s, %s, %s",
+			constants.CollectionVerificationLevels, constants.CollectionApplicants, constants.CollectionAuditLogs)
+	}
+
+	var target models.VerificationLevel
+	var err error
+	if migration.ToVersion == 0 {
+		filter := CurrentLevelFilter(clientID)
+		filter["level_id"] = levelID
+		err = levels.FindOne(ctx, filter).Decode(&target)
+	} else {
+		target, err = FindLevelVersion(ctx, clientID, levelID, migration.ToVersion)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, ErrLevelVersionNotPublished
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to load target verification level version: %w", err)
+	}
+	result.ToVersion = target.Version
+
+	statuses := migration.Statuses
+	if len(statuses) == 0 {
+		statuses = []models.ApplicantStatus{models.ApplicantStatusPending}
+	}
+	filter := bson.M{
+		"client_id":     clientID,
+		"level_id":      levelID,
+		"level_version": bson.M{"$lt": target.Version},
+		"status":        bson.M{"$in": statuses},
+		"deleted":       false,
+	}
+	if len(migration.FromVersions) > 0 {
+		filter["level_version"] = bson.M{"$lt": target.Version, "$in": migration.FromVersions}
+	}
+	if len(migration.ApplicantIDs) > 0 {
+		filter["applicant_id"] = bson.M{"$in": migration.ApplicantIDs}
+	}
+
+	cursor, err := applicants.Find(ctx, filter, options.Find().SetProjection(bson.M{"applicant_id": 1, "level_version": 1}))
+	if err != nil {
+		return result, fmt.Errorf("failed to query applicants to migrate: %w", err)
+	}
+	var selected []models.Applicant
+	if err := cursor.All(ctx, &selected); err != nil {
+		return result, fmt.Errorf("failed to decode applicants to migrate: %w", err)
+	}
+
+	result.ApplicantIDs = []string{}
+	for _, applicant := range selected {
+		if migration.DryRun {
+			result.ApplicantIDs = append(result.ApplicantIDs, applicant.ApplicantID)
+			continue
+		}
+		now := time.Now()
+		updated, err := applicants.UpdateOne(ctx,
+			bson.M{"applicant_id": applicant.ApplicantID, "client_id": clientID, "level_id": levelID, "level_version": applicant.LevelVersion},
+			bson.M{"$set": bson.M{"level_version": target.Version, "updated_at": now}},
+		)
+		if err != nil {
+			return result, fmt.Errorf("failed to migrate applicant %s: %w", applicant.ApplicantID, err)
+		}
+		if updated.ModifiedCount == 0 {
+			continue
+		}
+		result.ApplicantIDs = append(result.ApplicantIDs, applicant.ApplicantID)
+
+		entry := models.AuditApplicantLog{
+			LogID:           uuid.New().String(),
+			ApplicantID:     applicant.ApplicantID,
+			ActionPerformed: AuditActionApplicantLevelMigrated,
+			Details:         fmt.Sprintf("Applicant moved from version %d to %d of verification level %s by %s", applicant.LevelVersion, target.Version, levelID, migration.Actor),
+			Timestamp:       now,
+			ClientID:        clientID,
+		}
+		if _, err := auditLogs.InsertOne(ctx, entry); err != nil {
+			logger.Error("Failed to record level migration audit log", zap.String("applicantID", applicant.ApplicantID), zap.Error(err))
+			return result, fmt.Errorf("failed to record audit log: %w", err)
+		}
+	}
+
+	logger.Info("Migrated applicants to verification level version",
+		zap.String("levelID", levelID),
+		zap.Int("toVersion", target.Version),
+		zap.Int("applicants", len(result.ApplicantIDs)),
+		zap.Bool("dryRun", migration.DryRun),
+		zap.String("actor", migration.Actor),
+	)
+	return result, nil
+}
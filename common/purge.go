@@ -0,0 +1,261 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// PurgeTarget is a collection whose soft deleted records are hard deleted after the retention period
+type PurgeTarget struct {
+	CollectionName string
+	Files          func(record bson.Raw) []string                           // Optional, returns the object keys owned by a record
+	Keep           func(ctx context.Context, record bson.Raw) (bool, error) // Optional, reports whether a record is still in use and must be kept
+}
+
+// DefaultPurgeTargets returns the collections purged by default, deleting the S3 objects of documents.
+// Published versions of deleted verification levels are kept while applicants are pinned to them.
+func DefaultPurgeTargets() []PurgeTarget {
+	return []PurgeTarget{
+		{CollectionName: constants.CollectionApplicants, Files: applicantFiles},
+		{CollectionName: constants.CollectionDocuments, Files: documentFiles},
+		{CollectionName: constants.CollectionVerificationLevels, Keep: levelVersionInUse},
+	}
+}
+
+// PurgeResult summarizes a purge run
+type PurgeResult struct {
+	Purged       map[string]int // Records hard deleted per collection
+	FilesDeleted int
+	Failed       int // Records kept because their files could not be deleted
+	Kept         int // Records kept because they are still in use
+}
+
+// PurgeJob hard deletes records that were soft deleted longer than Retention ago, and records
+// flagged erase_requested by an erasure request right away
+type PurgeJob struct {
+	Retention time.Duration
+	Interval  time.Duration
+	Targets   []PurgeTarget
+	Uploader  interfaces.Uploader // Used to delete the objects of purged records
+}
+
+// NewPurgeJob creates a purge job from the retention settings of the database config
+func NewPurgeJob(cfg models.DatabaseConfig, uploader interfaces.Uploader) *PurgeJob {
+	interval := time.Duration(cfg.PurgeIntervalMins) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &PurgeJob{
+		Retention: time.Duration(cfg.SoftDeleteRetentionDays) * 24 * time.Hour,
+		Interval:  interval,
+		Targets:   DefaultPurgeTargets(),
+		Uploader:  uploader,
+	}
+}
+
+// Start runs the purge job every Interval until ctx is cancelled. When Retention is not set only
+// records flagged by erasure requests are purged.
+func (j *PurgeJob) Start(ctx context.Context) {
+	logger := zaplogger.GetLogger()
+	if j.Retention <= 0 {
+		logger.Info("No soft delete retention period configured, only purging erased records")
+	}
+
+	go func() {
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		for {
+			result, err := j.RunOnce(ctx)
+			if err != nil {
+				logger.Error("Soft delete purge failed", zap.Error(err))
+			} else {
+				logger.Info("Soft delete purge finished",
+					zap.Any("purged", result.Purged),
+					zap.Int("filesDeleted", result.FilesDeleted),
+					zap.Int("failed", result.Failed),
+					zap.Int("kept", result.Kept),
+				)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunOnce purges every target once
+func (j *PurgeJob) RunOnce(ctx context.Context) (PurgeResult, error) {
+	result := PurgeResult{Purged: make(map[string]int)}
+	cutoff := time.Now().Add(-j.Retention)
+
+	for _, target := range j.Targets {
+		if err := j.purgeTarget(ctx, target, cutoff, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (j *PurgeJob) purgeTarget(ctx context.Context, target PurgeTarget, cutoff time.Time, result *PurgeResult) error {
+	logger := zaplogger.GetLogger()
+	collection := GetCollection(target.CollectionName)
+	if collection == nil {
+		return fmt.Errorf("failed to get collection: %s", target.CollectionName)
+	}
+
+	filter := bson.M{"deleted": true, "erase_requested": true}
+	if j.Retention > 0 {
+		filter = bson.M{"deleted": true, "$or": bson.A{
+			bson.M{"deleted_at": bson.M{"$lt": cutoff}},
+			bson.M{"erase_requested": true},
+		}}
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to find purgeable records in %s: %w", target.CollectionName, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		record := cursor.Current
+		if target.Keep != nil {
+			keep, err := target.Keep(ctx, record)
+			if err != nil {
+				return fmt.Errorf("failed to check whether a record of %s is in use: %w", target.CollectionName, err)
+			}
+			if keep {
+				result.Kept++
+				continue
+			}
+		}
+
+		var files []string
+		if target.Files != nil {
+			files = target.Files(record)
+		}
+		deleted, err := j.deleteFiles(ctx, files)
+		result.FilesDeleted += deleted
+		if err != nil {
+			// Keep the record so the remaining files are retried on the next run
+			logger.Error("Failed to delete files of purged record",
+				zap.String("collection", target.CollectionName),
+				zap.Error(err),
+			)
+			result.Failed++
+			continue
+		}
+
+		_, err = collection.DeleteOne(ctx, bson.M{"_id": record.Lookup("_id")})
+		if err != nil {
+			return fmt.Errorf("failed to purge record from %s: %w", target.CollectionName, err)
+		}
+		result.Purged[target.CollectionName]++
+	}
+	return cursor.Err()
+}
+
+func (j *PurgeJob) deleteFiles(ctx context.Context, files []string) (int, error) {
+	if len(files) == 0 {
+		return 0, nil
+	}
+	if j.Uploader == nil {
+		return 0, fmt.Errorf("no uploader configured to delete %d files", len(files))
+	}
+	deleted := 0
+	for _, objectKey := range files {
+		// A file that is already gone, e.g. deleted by an earlier run that failed later on, is done
+		if err := j.Uploader.DeleteFile(ctx, objectKey); err != nil && !errors.Is(err, utils.ErrObjectNotFound) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// levelVersionInUse reports whether applicants are pinned to a published verification level
+// version, FindLevelVersion must keep finding it for them
+func levelVersionInUse(ctx context.Context, record bson.Raw) (bool, error) {
+	if lookupString(record, "state") != string(models.LevelStatePublished) {
+		return false, nil
+	}
+	version, ok := record.Lookup("version").AsInt64OK()
+	if !ok {
+		return false, nil
+	}
+	applicants := GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return false, fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+	pinned, err := applicants.CountDocuments(ctx,
+		bson.M{
+			"client_id":     lookupString(record, "client_id"),
+			"level_id":      lookupString(record, "level_id"),
+			"level_version": version,
+		},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+	return pinned > 0, nil
+}
+
+func documentFiles(record bson.Raw) []string {
+	if objectKey := lookupString(record, "object_key"); objectKey != "" {
+		return []string{objectKey}
+	}
+	fileURL := lookupString(record, "file_url")
+	if fileURL == "" {
+		return nil
+	}
+	return []string{ObjectKeyFromFileURL(fileURL)}
+}
+
+func applicantFiles(record bson.Raw) []string {
+	value, err := record.LookupErr("documents")
+	if err != nil {
+		return nil
+	}
+	documents, ok := value.ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, err := documents.Values()
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, v := range values {
+		if doc, ok := v.DocumentOK(); ok {
+			files = append(files, documentFiles(doc)...)
+		}
+	}
+	return files
+}
+
+// ObjectKeyFromFileURL extracts the object key from a URL returned by older versions of UploadFile.
+// Values that are not URLs are assumed to already be object keys.
+func ObjectKeyFromFileURL(fileURL string) string {
+	parsed, err := url.Parse(fileURL)
+	if err != nil || parsed.Host == "" {
+		return fileURL
+	}
+	return strings.TrimPrefix(parsed.Path, "/")
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/mocks"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestObjectKeyFromFileURL(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"https://bucket.s3.amazonaws.com/applicants/a1/passport.jpg", "applicants/a1/passport.jpg"},
+		{"applicants/a1/passport.jpg", "applicants/a1/passport.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ObjectKeyFromFileURL(tt.input))
+		})
+	}
+}
+
+func TestApplicantFiles(t *testing.T) {
+	record, err := bson.Marshal(bson.M{
+		"applicant_id": "a1",
+		"documents": bson.A{
+			bson.M{"document_id": "d1", "file_url": "https://bucket.s3.amazonaws.com/d1.jpg"},
+			bson.M{"document_id": "d2", "file_url": ""},
+			bson.M{"document_id": "d3", "file_url": "d3.pdf"},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"d1.jpg", "d3.pdf"}, applicantFiles(record))
+
+	empty, err := bson.Marshal(bson.M{"applicant_id": "a2"})
+	assert.NoError(t, err)
+	assert.Empty(t, applicantFiles(empty))
+}
+
+func TestPurgeMissingFileCountsAsDeleted(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("file already gone", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		uploader := new(mocks.MockS3Uploader)
+		uploader.On("DeleteFile", mock.Anything, "client-1/doc-1").
+			Return(fmt.Errorf("failed to delete object client-1/doc-1 from S3: %w", utils.ErrObjectNotFound))
+
+		document := models.Document{DocumentID: "doc-1", ObjectKey: "client-1/doc-1", Deleted: true, EraseRequested: true}
+		record := append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, mockDocument(t, document)...)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, record),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		job := &PurgeJob{
+			Targets:  []PurgeTarget{{CollectionName: constants.CollectionDocuments, Files: documentFiles}},
+			Uploader: uploader,
+		}
+		result, err := job.RunOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Purged[constants.CollectionDocuments])
+		assert.Equal(t, 1, result.FilesDeleted)
+		assert.Zero(t, result.Failed)
+		uploader.AssertExpectations(t)
+	})
+}
+
+func TestPurgeKeepsPinnedLevelVersions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("deleted level", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		published := models.VerificationLevel{LevelID: "level-1", ClientID: "client-1", Version: 1, State: models.LevelStatePublished, Deleted: true}
+		draft := models.VerificationLevel{LevelID: "level-1", ClientID: "client-1", Version: 2, State: models.LevelStateDraft, Deleted: true}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "verus.verification_levels", mtest.FirstBatch,
+				append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, mockDocument(t, published)...),
+				append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, mockDocument(t, draft)...),
+			),
+			// An applicant is still pinned to the published version
+			mtest.CreateCursorResponse(0, "verus.applicants", mtest.FirstBatch, bson.D{{Key: "n", Value: 1}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		job := &PurgeJob{Targets: []PurgeTarget{{CollectionName: constants.CollectionVerificationLevels, Keep: levelVersionInUse}}}
+		result, err := job.RunOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Kept)
+		assert.Equal(t, 1, result.Purged[constants.CollectionVerificationLevels])
+
+		mt.GetStartedEvent()
+		count := mt.GetStartedEvent()
+		require.NotNil(t, count)
+		assert.Equal(t, "aggregate", count.CommandName)
+		purge := mt.GetStartedEvent()
+		require.NotNil(t, purge)
+		assert.Equal(t, "delete", purge.CommandName)
+	})
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// RewrapResult summarizes a re-wrap run
+type RewrapResult struct {
+	Rewrapped int
+	Skipped   int // Records changed concurrently, picked up on the next run
+	Failed    int
+}
+
+// RewrapJob re-encrypts the DEKs of records under the envelope service's current KMS key.
+// Only the wrapped key and its key reference change, field ciphertexts are left untouched.
+type RewrapJob struct {
+	CollectionName string
+	KeyPath        string // Path of the embedded models.EncryptedData, e.g. "encrypted_data"
+	Envelope       *utils.EnvelopeService
+	From           interfaces.KMSUploader // Unwraps old keys, defaults to the envelope's KMS uploader
+	Interval       time.Duration
+}
+
+// NewApplicantRewrapJob creates a re-wrap job for the applicants collection
+func NewApplicantRewrapJob(envelope *utils.EnvelopeService, from interfaces.KMSUploader) *RewrapJob {
+	return &RewrapJob{
+		CollectionName: constants.CollectionApplicants,
+		KeyPath:        "encrypted_data",
+		Envelope:       envelope,
+		From:           from,
+		Interval:       time.Hour,
+	}
+}
+
+// Start runs the re-wrap job every Interval until ctx is cancelled
+func (j *RewrapJob) Start(ctx context.Context) {
+	logger := zaplogger.GetLogger()
+	go func() {
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		for {
+			result, err := j.RunOnce(ctx)
+			if err != nil {
+				logger.Error("DEK rewrap failed", zap.String("collection", j.CollectionName), zap.Error(err))
+			} else if result.Rewrapped > 0 || result.Failed > 0 {
+				logger.Info("DEK rewrap finished",
+					zap.String("collection", j.CollectionName),
+					zap.Int("rewrapped", result.Rewrapped),
+					zap.Int("skipped", result.Skipped),
+					zap.Int("failed", result.Failed),
+				)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunOnce re-wraps every record whose DEK was not produced by the current key and version
+func (j *RewrapJob) RunOnce(ctx context.Context) (RewrapResult, error) {
+	logger := zaplogger.GetLogger()
+	var result RewrapResult
+
+	collection := GetCollection(j.CollectionName)
+	if collection == nil {
+		return result, fmt.Errorf("failed to get collection: %s", j.CollectionName)
+	}
+
+	keyIDField := j.KeyPath + ".key_id"
+	keyVersionField := j.KeyPath + ".key_version"
+	encryptedKeyField := j.KeyPath + ".encrypted_key"
+
+	filter := bson.M{
+		encryptedKeyField: bson.M{"$exists": true, "$ne": nil},
+		"$or": bson.A{
+			bson.M{keyIDField: bson.M{"$ne": j.Envelope.KeyID}},
+			bson.M{keyVersionField: bson.M{"$lt": j.Envelope.KeyVersion}},
+		},
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return result, fmt.Errorf("failed to find records to rewrap: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var record struct {
+			ID   interface{}          `bson:"_id"`
+			Data models.EncryptedData `bson:"-"`
+		}
+		if err := cursor.Decode(&record); err != nil {
+			return result, fmt.Errorf("failed to decode record: %w", err)
+		}
+		if err := cursor.Current.Lookup(strings.Split(j.KeyPath, ".")...).Unmarshal(&record.Data); err != nil {
+			return result, fmt.Errorf("failed to decode encrypted data: %w", err)
+		}
+
+		old := record.Data.WrappedKey()
+		if len(old.EncryptedKey) == 0 || !j.Envelope.NeedsRewrap(old) {
+			continue
+		}
+
+		rewrapped, err := j.Envelope.Rewrap(ctx, old, j.From)
+		if errors.Is(err, utils.ErrKeyVersionBehind) {
+			// Every other record would fail the same way, stop until the key is rotated
+			return result, err
+		}
+		if err != nil {
+			logger.Error("Failed to rewrap DEK", zap.Any("id", record.ID), zap.Error(err))
+			result.Failed++
+			continue
+		}
+
+		// Only replace the key if nobody changed it since it was read
+		updateResult, err := collection.UpdateOne(ctx,
+			bson.M{"_id": record.ID, encryptedKeyField: old.EncryptedKey},
+			bson.M{"$set": bson.M{
+				encryptedKeyField: rewrapped.EncryptedKey,
+				keyIDField:        rewrapped.KeyID,
+				keyVersionField:   rewrapped.KeyVersion,
+			}},
+		)
+		if err != nil {
+			return result, fmt.Errorf("failed to store rewrapped DEK: %w", err)
+		}
+		if updateResult.MatchedCount == 0 {
+			result.Skipped++
+			continue
+		}
+		result.Rewrapped++
+	}
+	return result, cursor.Err()
+}
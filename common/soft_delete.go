@@ -0,0 +1,118 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// ErrEraseRequested is returned by Restore for records flagged by an erasure request, their data is
+// destroyed and the purge job deletes them
+var ErrEraseRequested = errors.New("record was erased and cannot be restored")
+
+// SoftDelete flags the record matching filter as deleted, recording the actor from the gin context.
+// Cached entries registered under the given tags are evicted. Returns mongo.ErrNoDocuments when no
+// live record matches.
+func SoftDelete(c *gin.Context, collectionName string, filter bson.M, tagList ...string) error {
+	logger := zaplogger.GetLogger()
+	actor, err := utils.GetActorFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	collection := GetCollection(collectionName)
+	if collection == nil {
+		return fmt.Errorf("failed to get collection: %s", collectionName)
+	}
+
+	liveFilter := bson.M{"deleted": false}
+	for field, value := range filter {
+		liveFilter[field] = value
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"deleted":    true,
+		"deleted_at": now,
+		"deleted_by": actor,
+		"updated_at": now,
+	}}
+	result, err := collection.UpdateOne(c.Request.Context(), liveFilter, update)
+	if err != nil {
+		return fmt.Errorf("failed to soft delete document: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	InvalidateTags(tagList...)
+
+	logger.Info("Soft deleted document",
+		zap.String("function", "SoftDelete"),
+		zap.String("collection", collectionName),
+		zap.Any("filter", filter),
+		zap.String("deletedBy", actor),
+	)
+	return nil
+}
+
+// Restore clears the soft delete flag of the record matching filter and evicts the given cache tags.
+// Returns mongo.ErrNoDocuments when no deleted record matches, or ErrEraseRequested when the record
+// was deleted by an erasure request.
+func Restore(c *gin.Context, collectionName string, filter bson.M, tagList ...string) error {
+	logger := zaplogger.GetLogger()
+	actor, err := utils.GetActorFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	collection := GetCollection(collectionName)
+	if collection == nil {
+		return fmt.Errorf("failed to get collection: %s", collectionName)
+	}
+
+	deletedFilter := bson.M{"deleted": true, "erase_requested": bson.M{"$ne": true}}
+	for field, value := range filter {
+		deletedFilter[field] = value
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"deleted": false, "updated_at": time.Now()},
+		"$unset": bson.M{"deleted_at": "", "deleted_by": ""},
+	}
+	result, err := collection.UpdateOne(c.Request.Context(), deletedFilter, update)
+	if err != nil {
+		return fmt.Errorf("failed to restore document: %w", err)
+	}
+	if result.MatchedCount == 0 {
+		erasedFilter := bson.M{"deleted": true, "erase_requested": true}
+		for field, value := range filter {
+			erasedFilter[field] = value
+		}
+		erased, err := collection.CountDocuments(c.Request.Context(), erasedFilter)
+		if err != nil {
+			return fmt.Errorf("failed to restore document: %w", err)
+		}
+		if erased > 0 {
+			return ErrEraseRequested
+		}
+		return mongo.ErrNoDocuments
+	}
+
+	InvalidateTags(tagList...)
+
+	logger.Info("Restored document",
+		zap.String("function", "Restore"),
+		zap.String("collection", collectionName),
+		zap.Any("filter", filter),
+		zap.String("restoredBy", actor),
+	)
+	return nil
+}
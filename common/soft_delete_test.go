@@ -0,0 +1,40 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRestoreRefusesErasedRecords(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("erase requested", func(mt *mtest.T) {
+		UseDatabase(mt.Client, "verus")
+		defer UseDatabase(nil, "")
+
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/documents/doc-1/restore", nil)
+		c.Set("client_id", "client-1")
+
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, bson.D{{Key: "n", Value: 1}}),
+		)
+
+		err := Restore(c, constants.CollectionDocuments, bson.M{"document_id": "doc-1"})
+		assert.ErrorIs(t, err, ErrEraseRequested)
+
+		// The restore itself skips erased records
+		started := mt.GetStartedEvent()
+		filter := started.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q").Document()
+		assert.True(t, filter.Lookup("erase_requested", "$ne").Boolean())
+	})
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	// Headers sent with webhook deliveries. The signature is the hex HMAC-SHA256, keyed with the
+	// webhook's secret, of the timestamp, a dot and the body, so receivers can reject payloads
+	// older than the webhook's expiry.
+	WebhookSignatureHeader = "X-Verus-Signature"
+	WebhookTimestampHeader = "X-Verus-Timestamp"
+	WebhookEventHeader     = "X-Verus-Event"
+
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookEmitter posts applicant events to the webhook configured on the applicant's client
+type WebhookEmitter struct {
+	HTTPClient *http.Client
+}
+
+// NewWebhookEmitter creates a webhook emitter with a default timeout
+func NewWebhookEmitter() *WebhookEmitter {
+	return &WebhookEmitter{HTTPClient: &http.Client{Timeout: defaultWebhookTimeout}}
+}
+
+// Emit loads the webhook of the event's client and delivers the event to it
+func (e *WebhookEmitter) Emit(ctx context.Context, event models.WebhookEvent) error {
+	clients := GetCollection(constants.CollectionClients)
+	if clients == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionClients)
+	}
+	var client models.Client
+	err := clients.FindOne(ctx,
+		bson.M{"client_id": event.ClientID, "deleted": false},
+		options.FindOne().SetProjection(bson.M{"webhook": 1}),
+	).Decode(&client)
+	if err != nil {
+		return fmt.Errorf("failed to load client webhook: %w", err)
+	}
+	return e.Deliver(ctx, client.Webhook, event)
+}
+
+// Deliver posts a signed event to a webhook. Disabled webhooks and events the webhook is not
+// subscribed to are skipped; a non-2xx response is an error.
+func (e *WebhookEmitter) Deliver(ctx context.Context, webhook models.ClientWebhook, event models.WebhookEvent) error {
+	logger := zaplogger.GetLogger()
+	if !webhook.Enabled || webhook.Deleted || webhook.URL == "" || !slices.Contains(webhook.EventTypes, event.Type) {
+		return nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, string(event.Type))
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, utils.GenerateHMAC(timestamp+"."+string(body), webhook.SecretKey))
+
+	httpClient := e.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		logger.Error("Failed to deliver webhook", zap.String("clientID", event.ClientID), zap.String("event", string(event.Type)), zap.Error(err))
+		return fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logger.Error("Webhook rejected event", zap.String("clientID", event.ClientID), zap.String("event", string(event.Type)), zap.Int("status", response.StatusCode))
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	logger.Debug("Delivered webhook", zap.String("clientID", event.ClientID), zap.String("event", string(event.Type)))
+	return nil
+}
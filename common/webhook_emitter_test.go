@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookEmitterDeliversSignedEvents(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	webhook := models.ClientWebhook{
+		URL:        server.URL,
+		Enabled:    true,
+		SecretKey:  "secret",
+		EventTypes: []models.EventType{models.ApplicantPending},
+	}
+	event := models.WebhookEvent{Type: models.ApplicantPending, ApplicantID: "app-1", ClientID: "client-1"}
+
+	emitter := NewWebhookEmitter()
+	assert.NoError(t, emitter.Deliver(context.Background(), webhook, event))
+	if assert.NotNil(t, received) {
+		assert.Equal(t, string(models.ApplicantPending), received.Header.Get(WebhookEventHeader))
+		timestamp := received.Header.Get(WebhookTimestampHeader)
+		assert.Equal(t, utils.GenerateHMAC(timestamp+"."+string(body), "secret"), received.Header.Get(WebhookSignatureHeader))
+		assert.Contains(t, string(body), `"applicant_id":"app-1"`)
+	}
+
+	// Events the webhook is not subscribed to, and disabled webhooks, are skipped
+	received = nil
+	event.Type = models.ApplicantRejected
+	assert.NoError(t, emitter.Deliver(context.Background(), webhook, event))
+	webhook.Enabled = false
+	event.Type = models.ApplicantPending
+	assert.NoError(t, emitter.Deliver(context.Background(), webhook, event))
+	assert.Nil(t, received)
+}
+
+func TestWebhookEmitterFailsOnErrorResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	webhook := models.ClientWebhook{URL: server.URL, Enabled: true, EventTypes: []models.EventType{models.ApplicantReviewed}}
+	err := NewWebhookEmitter().Deliver(context.Background(), webhook, models.WebhookEvent{Type: models.ApplicantReviewed})
+	assert.ErrorContains(t, err, "503")
+}
@@ -7,6 +7,13 @@ const (
 	CollectionDocuments          = "documents"
 	CollectionAuditLogs          = "audit_logs"
 	CollectionVerificationLevels = "verification_levels"
+	CollectionChangeStreamTokens = "change_stream_tokens"
+)
+
+const (
+	// Cache tag kinds, combined with an id via common.CacheTag (e.g. "client:<id>")
+	CacheTagClient            = "client"
+	CacheTagVerificationLevel = "verification_level"
 )
 
 const (
@@ -21,6 +28,7 @@ const (
 	DOCUMENT_STATUS_VERIFIED       = "verified"
 	DOCUMENT_STATUS_REJECTED       = "rejected"
 	DOCUMENT_STATUS_UPLOAD_PENDING = "uploadpending"
+	DOCUMENT_STATUS_QUARANTINED    = "quarantined"
 
 	// Verus DocumentType
 	DOCUMENT_TYPE_PASSPORT              = "PASSPORT"
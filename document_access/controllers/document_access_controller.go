@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// inlineContentTypes are the sniffed content types shown in the browser, anything else is downloaded
+var inlineContentTypes = []string{utils.MimeTypeJPEG, utils.MimeTypePNG, utils.MimeTypePDF, utils.MimeTypeMP4, utils.MimeTypeWebM}
+
+// contentDisposition returns the Content-Disposition of a document of the sniffed content type
+func contentDisposition(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if slices.Contains(inlineContentTypes, mediaType) {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// RegisterRoutes registers the access URL endpoint on an authenticated router and the proxy
+// endpoint the signed URLs point to on a public one, the signature being its only credential
+func RegisterRoutes(authenticated gin.IRoutes, public gin.IRoutes, service interfaces.DocumentAccessService) {
+	authenticated.POST("/documents/:document_id/access", func(c *gin.Context) { IssueDocumentAccessURL(c, service) })
+	public.GET(utils.DocumentAccessPath(":document_id"), func(c *gin.Context) { StreamDocument(c, service) })
+}
+
+// IssueDocumentAccessURL is the handler function returning a short-lived signed URL for a document
+func IssueDocumentAccessURL(c *gin.Context, service interfaces.DocumentAccessService) {
+	logger := zaplogger.GetLogger()
+	documentID := c.Param("document_id")
+
+	grant, err := service.IssueAccessURL(c, documentID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("IssueDocumentAccessURL: Error issuing access URL", zap.String("documentID", documentID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not issue document access URL"})
+		return
+	}
+	c.JSON(http.StatusOK, grant)
+}
+
+// StreamDocument is the handler function behind signed access URLs. It decrypts the document and
+// streams it to the client without it ever being stored in plaintext.
+func StreamDocument(c *gin.Context, service interfaces.DocumentAccessService) {
+	logger := zaplogger.GetLogger()
+	documentID := c.Param("document_id")
+
+	_, content, err := service.OpenDocument(c, documentID)
+	switch {
+	case errors.Is(err, utils.ErrAccessURLExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access URL has expired"})
+		return
+	case errors.Is(err, utils.ErrAccessURLInvalid):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access URL is invalid"})
+		return
+	case errors.Is(err, mongo.ErrNoDocuments):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	case err != nil:
+		logger.Error("StreamDocument: Error opening document", zap.String("documentID", documentID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not open document"})
+		return
+	}
+	defer content.Close()
+
+	// Sniff the content type from the decrypted bytes, the stored object only holds ciphertext
+	reader := bufio.NewReaderSize(content, 512)
+	head, _ := reader.Peek(512)
+	contentType := http.DetectContentType(head)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", contentDisposition(contentType))
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		// Headers are already sent, the client sees a truncated response
+		logger.Error("StreamDocument: Error streaming document", zap.String("documentID", documentID), zap.Error(err))
+	}
+}
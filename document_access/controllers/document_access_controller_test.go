@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/common"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/document_access/services"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestStreamDocumentPendingNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("pending document", func(mt *mtest.T) {
+		common.UseDatabase(mt.Client, "verus")
+		defer common.UseDatabase(nil, "")
+
+		key := []byte("0123456789abcdef0123456789abcdef")
+		service := &services.DocumentAccessServiceImpl{CollectionName: constants.CollectionDocuments, SigningKey: key}
+		router := gin.New()
+		RegisterRoutes(router, router, service)
+
+		signedURL, err := utils.SignAccessURL("", key, utils.AccessClaims{
+			DocumentID: "doc-1",
+			ClientID:   "client-1",
+			Actor:      "reviewer",
+			ExpiresAt:  time.Now().Add(time.Minute),
+		})
+		require.NoError(t, err)
+		target, err := url.Parse(signedURL)
+		require.NoError(t, err)
+
+		// Even if the store returned the pending document, it must not be served
+		pending, err := bson.Marshal(models.Document{DocumentID: "doc-1", ApplicantID: "applicant-1", Status: models.DocumentUploadPending})
+		require.NoError(t, err)
+		var raw bson.D
+		require.NoError(t, bson.Unmarshal(pending, &raw))
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "verus.documents", mtest.FirstBatch, raw))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target.RequestURI(), nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		// The query itself only asks for documents that finished their scan
+		started := mt.GetStartedEvent()
+		require.NotNil(t, started)
+		filter := started.Command.Lookup("filter").Document()
+		values, err := filter.Lookup("status", "$in").Array().Values()
+		require.NoError(t, err)
+		var statuses []models.DocumentStatus
+		for _, value := range values {
+			statuses = append(statuses, models.DocumentStatus(value.AsInt64()))
+		}
+		assert.ElementsMatch(t, models.ServableDocumentStatuses, statuses)
+	})
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{"image/jpeg", "inline"},
+		{"image/png", "inline"},
+		{"application/pdf", "inline"},
+		{"video/mp4", "inline"},
+		{"text/html; charset=utf-8", "attachment"},
+		{"image/svg+xml", "attachment"},
+		{"text/plain; charset=utf-8", "attachment"},
+		{"application/octet-stream", "attachment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			assert.Equal(t, tt.expected, contentDisposition(tt.contentType))
+		})
+	}
+}
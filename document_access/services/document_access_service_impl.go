@@ -0,0 +1,182 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rachel-lawrie/verus_backend_core/common"
+	"github.com/rachel-lawrie/verus_backend_core/constants"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	zap "go.uber.org/zap"
+)
+
+// defaultAccessURLTTL is the lifetime of access URLs when none is configured
+const defaultAccessURLTTL = 5 * time.Minute
+
+const (
+	// Audit actions recorded for document access
+	AuditActionDocumentAccessIssued = "document_access_issued"
+	AuditActionDocumentAccessed     = "document_accessed"
+)
+
+type DocumentAccessServiceImpl struct {
+	CollectionName string
+	BaseURL        string
+	SigningKey     []byte
+	TTL            time.Duration
+	Uploader       interfaces.Uploader
+	KMS            interfaces.KMSUploader
+}
+
+// NewDocumentAccessService creates a document access service from the document access config
+func NewDocumentAccessService(cfg models.DocumentAccessConfig, uploader interfaces.Uploader, kmsUploader interfaces.KMSUploader) (*DocumentAccessServiceImpl, error) {
+	signingKey, err := base64.StdEncoding.DecodeString(cfg.SigningKey)
+	if err != nil || len(signingKey) < 32 {
+		return nil, fmt.Errorf("document access signing key must be at least 32 base64 encoded bytes")
+	}
+	ttl := time.Duration(cfg.URLTTLSecs) * time.Second
+	if ttl <= 0 {
+		ttl = defaultAccessURLTTL
+	}
+	return &DocumentAccessServiceImpl{
+		CollectionName: constants.CollectionDocuments,
+		BaseURL:        cfg.BaseURL,
+		SigningKey:     signingKey,
+		TTL:            ttl,
+		Uploader:       uploader,
+		KMS:            kmsUploader,
+	}, nil
+}
+
+// IssueAccessURL returns a signed URL to the decrypting proxy endpoint, valid for TTL
+func (s *DocumentAccessServiceImpl) IssueAccessURL(c *gin.Context, documentID string) (models.DocumentAccessGrant, error) {
+	logger := zaplogger.GetLogger()
+	clientID, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return models.DocumentAccessGrant{}, err
+	}
+	actor, err := utils.GetActorFromContext(c)
+	if err != nil {
+		return models.DocumentAccessGrant{}, err
+	}
+
+	document, err := s.findDocument(c, documentID, clientID)
+	if err != nil {
+		return models.DocumentAccessGrant{}, err
+	}
+
+	claims := utils.AccessClaims{
+		DocumentID: documentID,
+		ClientID:   clientID,
+		Actor:      actor,
+		ExpiresAt:  time.Now().Add(s.TTL).Truncate(time.Second),
+	}
+	signedURL, err := utils.SignAccessURL(s.BaseURL, s.SigningKey, claims)
+	if err != nil {
+		return models.DocumentAccessGrant{}, err
+	}
+
+	if err := s.audit(c, document, clientID, AuditActionDocumentAccessIssued,
+		fmt.Sprintf("Access URL issued to %s, expires %s", actor, claims.ExpiresAt.UTC().Format(time.RFC3339))); err != nil {
+		return models.DocumentAccessGrant{}, err
+	}
+	logger.Info("Issued document access URL", zap.String("documentID", documentID), zap.String("actor", actor))
+
+	return models.DocumentAccessGrant{DocumentID: documentID, URL: signedURL, ExpiresAt: claims.ExpiresAt}, nil
+}
+
+// OpenDocument verifies the signature and expiry of the request's access URL and returns the
+// decrypted document content. It returns utils.ErrAccessURLInvalid or utils.ErrAccessURLExpired
+// for rejected URLs and mongo.ErrNoDocuments when the document no longer exists.
+func (s *DocumentAccessServiceImpl) OpenDocument(c *gin.Context, documentID string) (models.Document, io.ReadCloser, error) {
+	logger := zaplogger.GetLogger()
+	claims, err := utils.VerifyAccessQuery(s.SigningKey, documentID, c.Request.URL.Query(), time.Now())
+	if err != nil {
+		logger.Warn("Rejected document access URL", zap.String("documentID", documentID), zap.String("ip", c.ClientIP()), zap.Error(err))
+		return models.Document{}, nil, err
+	}
+
+	// The document may have been deleted or erased since the URL was issued
+	document, err := s.findDocument(c, documentID, claims.ClientID)
+	if err != nil {
+		return models.Document{}, nil, err
+	}
+
+	content, err := s.Uploader.DownloadDecrypted(c.Request.Context(), document.StorageKey(), s.KMS)
+	if err != nil {
+		logger.Error("Failed to open document content", zap.String("documentID", documentID), zap.Error(err))
+		return document, nil, err
+	}
+
+	// Access is only granted once it has been recorded
+	if err := s.audit(c, document, claims.ClientID, AuditActionDocumentAccessed, fmt.Sprintf("Document content accessed via URL issued to %s", claims.Actor)); err != nil {
+		content.Close()
+		return document, nil, err
+	}
+	return document, content, nil
+}
+
+// findDocument returns a live document that finished its malware scan and belongs to an applicant
+// of the client
+func (s *DocumentAccessServiceImpl) findDocument(c *gin.Context, documentID, clientID string) (models.Document, error) {
+	ctx := c.Request.Context()
+	var document models.Document
+	collection := common.GetCollection(s.CollectionName)
+	if collection == nil {
+		return document, fmt.Errorf("failed to get collection: %s", s.CollectionName)
+	}
+	// Pending and quarantined files are never served
+	filter := bson.M{"document_id": documentID, "deleted": false, "status": bson.M{"$in": models.ServableDocumentStatuses}}
+	if err := collection.FindOne(ctx, filter).Decode(&document); err != nil {
+		return document, err
+	}
+	if !document.Servable() {
+		return models.Document{}, mongo.ErrNoDocuments
+	}
+
+	applicants := common.GetCollection(constants.CollectionApplicants)
+	if applicants == nil {
+		return document, fmt.Errorf("failed to get collection: %s", constants.CollectionApplicants)
+	}
+	count, err := applicants.CountDocuments(ctx, bson.M{"applicant_id": document.ApplicantID, "client_id": clientID})
+	if err != nil {
+		return document, fmt.Errorf("failed to check document owner: %w", err)
+	}
+	if count == 0 {
+		// Do not reveal documents of other clients
+		return models.Document{}, mongo.ErrNoDocuments
+	}
+	return document, nil
+}
+
+// audit records an access event
+func (s *DocumentAccessServiceImpl) audit(c *gin.Context, document models.Document, clientID, action, details string) error {
+	logger := zaplogger.GetLogger()
+	auditLogs := common.GetCollection(constants.CollectionAuditLogs)
+	if auditLogs == nil {
+		return fmt.Errorf("failed to get collection: %s", constants.CollectionAuditLogs)
+	}
+	entry := models.AuditApplicantLog{
+		LogID:           uuid.New().String(),
+		ApplicantID:     document.ApplicantID,
+		ActionPerformed: action,
+		Details:         fmt.Sprintf("%s (document %s)", details, document.DocumentID),
+		Timestamp:       time.Now(),
+		ClientID:        clientID,
+		IP:              c.ClientIP(),
+	}
+	if _, err := auditLogs.InsertOne(c.Request.Context(), entry); err != nil {
+		logger.Error("Failed to record document access audit log", zap.String("action", action), zap.Error(err))
+		return fmt.Errorf("failed to record audit log: %w", err)
+	}
+	return nil
+}
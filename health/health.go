@@ -0,0 +1,111 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rachel-lawrie/verus_backend_core/common"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+const (
+	// checkTimeout bounds how long a readiness check may take
+	checkTimeout = 5 * time.Second
+
+	// kmsCheckTTL is how long a KMS check result is reused, KMS calls are billed and rate limited
+	kmsCheckTTL = time.Minute
+)
+
+// Check is a named readiness check
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// MongoCheck pings the MongoDB primary
+func MongoCheck() Check {
+	return Check{Name: "mongo", Check: common.PingDatabase}
+}
+
+// CacheCheck verifies that the in-memory cache has been initialized
+func CacheCheck() Check {
+	return Check{Name: "cache", Check: func(ctx context.Context) error {
+		return common.CacheReady()
+	}}
+}
+
+// KMSCheck verifies that the KMS key can be used by encrypting a small probe value. The result is
+// reused for a minute so probe traffic does not compete with real encryption for the KMS quota.
+func KMSCheck(kmsUploader interfaces.KMSUploader) Check {
+	return CachedCheck(Check{Name: "kms", Check: func(ctx context.Context) error {
+		_, err := kmsUploader.EncryptData(ctx, []byte("readyz"))
+		return err
+	}}, kmsCheckTTL)
+}
+
+// CachedCheck wraps a check so it runs at most once per ttl, returning the last result in between
+func CachedCheck(check Check, ttl time.Duration) Check {
+	var (
+		mu        sync.Mutex
+		checkedAt time.Time
+		lastErr   error
+	)
+	return Check{Name: check.Name, Check: func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return lastErr
+		}
+		lastErr = check.Check(ctx)
+		checkedAt = time.Now()
+		return lastErr
+	}}
+}
+
+// Healthz is the liveness handler, it only reports that the process is serving requests
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz returns a readiness handler that runs every check and answers 503 if any of them fails
+func Readyz(checks ...Check) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := zaplogger.GetLogger()
+		results := make(map[string]string, len(checks))
+		ready := true
+
+		for _, check := range checks {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), checkTimeout)
+			err := check.Check(ctx)
+			cancel()
+			if err != nil {
+				logger.Warn("Readiness check failed", zap.String("check", check.Name), zap.Error(err))
+				results[check.Name] = err.Error()
+				ready = false
+				continue
+			}
+			results[check.Name] = "ok"
+		}
+
+		if !ready {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": results})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": results})
+	}
+}
+
+// RegisterRoutes adds /healthz and /readyz, checking Mongo, the cache and, when given, KMS
+func RegisterRoutes(router gin.IRoutes, kmsUploader interfaces.KMSUploader) {
+	checks := []Check{MongoCheck(), CacheCheck()}
+	if kmsUploader != nil {
+		checks = append(checks, KMSCheck(kmsUploader))
+	}
+	router.GET("/healthz", Healthz)
+	router.GET("/readyz", Readyz(checks...))
+}
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		checks   []Check
+		expected int
+	}{
+		{"all checks pass", []Check{{Name: "ok", Check: func(ctx context.Context) error { return nil }}}, http.StatusOK},
+		{"one check fails", []Check{
+			{Name: "ok", Check: func(ctx context.Context) error { return nil }},
+			{Name: "down", Check: func(ctx context.Context) error { return errors.New("unreachable") }},
+		}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/readyz", Readyz(tt.checks...))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/healthz", Healthz)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := CachedCheck(Check{Name: "kms", Check: func(ctx context.Context) error {
+		calls++
+		return nil
+	}}, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, check.Check(context.Background()))
+	}
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "kms", check.Name)
+
+	expiring := CachedCheck(Check{Name: "kms", Check: func(ctx context.Context) error {
+		calls++
+		return errors.New("throttled")
+	}}, 0)
+	assert.Error(t, expiring.Check(context.Background()))
+	assert.Error(t, expiring.Check(context.Background()))
+	assert.Equal(t, 3, calls)
+}
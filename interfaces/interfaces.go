@@ -2,8 +2,7 @@ package interfaces
 
 import (
 	"context"
-
-	"mime/multipart"
+	"io"
 
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -11,12 +10,21 @@ import (
 	models "github.com/rachel-lawrie/verus_backend_core/models"
 )
 
-// Uploader defines the method that an uploader must implement
+// Uploader defines the methods a storage backend must implement
 type Uploader interface {
-	UploadFile(ctx context.Context, file multipart.File, fileName string, mimeType string, kmsUploader KMSUploader) (string, error)
+	// UploadFile encrypts and stores a file, returning its object key. Document files are uploaded
+	// through utils.UploadRules.Upload, which validates them first.
+	UploadFile(ctx context.Context, file io.Reader, fileName string, mimeType string, kmsUploader KMSUploader) (string, error)
+
+	// DownloadFile returns the raw, still encrypted, object body and its metadata
+	DownloadFile(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error)
+
+	// DownloadDecrypted downloads a file uploaded with UploadFile and returns its decrypted content
+	DownloadDecrypted(ctx context.Context, objectKey string, kmsUploader KMSUploader) (io.ReadCloser, error)
 
-	// DownloadFile downloads a file from S3 and returns the GetObjectOutput or an error
-	DownloadFile(ctx context.Context, objectKey string) (*s3.GetObjectOutput, error)
+	// DeleteFile permanently removes a file from storage. A missing file is either not an error or
+	// reported as utils.ErrObjectNotFound.
+	DeleteFile(ctx context.Context, objectKey string) error
 }
 
 // KMSUploader defines the methods available for KMS operations
@@ -26,12 +34,56 @@ type KMSUploader interface {
 	DecryptData(ctx context.Context, encrypted []byte) ([]byte, error) // Decrypts encrypted data
 }
 
+// KeyReporter is implemented by KMS uploaders that can report which key new data keys are wrapped with
+type KeyReporter interface {
+	CurrentKey() (keyID string, keyVersion int)
+}
+
+// KeyRewrapper is implemented by KMS uploaders that can re-encrypt a wrapped key under their
+// current key without the plaintext leaving the KMS
+type KeyRewrapper interface {
+	RewrapData(ctx context.Context, encrypted []byte) ([]byte, error)
+}
+
+// S3Client is the subset of the S3 API used by the S3 uploader
+type S3Client interface {
+	PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, input *s3.UploadPartInput, opts ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, opts ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
 type KMSClient interface {
 	GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
 	Encrypt(ctx context.Context, input *kms.EncryptInput, opts ...func(*kms.Options)) (*kms.EncryptOutput, error)
 	Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error)
 }
 
+// Scanner scans file content for malware
+type Scanner interface {
+	// Scan reads content to the end and reports whether it is clean. An error means the content
+	// could not be scanned and must not be treated as clean.
+	Scan(ctx context.Context, content io.Reader) (models.ScanResult, error)
+}
+
+// EventEmitter delivers applicant events to the client they belong to
+type EventEmitter interface {
+	// Emit sends an event, doing nothing when the client is not subscribed to its type
+	Emit(ctx context.Context, event models.WebhookEvent) error
+}
+
+// DocumentAccessService issues and redeems short-lived signed URLs for document content
+type DocumentAccessService interface {
+	// IssueAccessURL returns a signed URL to the decrypting proxy endpoint for a document of the client
+	IssueAccessURL(c *gin.Context, documentID string) (models.DocumentAccessGrant, error)
+
+	// OpenDocument verifies the signed URL of the request and returns the decrypted document content
+	OpenDocument(c *gin.Context, documentID string) (models.Document, io.ReadCloser, error)
+}
+
 type VerificationLevelService interface {
 	// UploadApplicant handles the upload of a applicant and returns metadata
 	CreateVerificationLevel(c *gin.Context, verificationLevel *models.VerificationLevel) (models.VerificationLevel, error)
@@ -45,6 +97,18 @@ type VerificationLevelService interface {
 	// GetVerificationLevelByName retrieves a applicant by its name
 	GetVerificationLevelByName(c *gin.Context, levelName string) (models.VerificationLevel, error)
 
-	// UpdateApplicant updates a applicant by its ID with new data
-	UpdateVerificationLevel(c *gin.Context, levelID string, updates map[string]interface{}) (models.VerificationLevel, error)
+	// UpdateVerificationLevel applies an update to the draft of a verification level
+	UpdateVerificationLevel(c *gin.Context, levelID string, update models.VerificationLevelUpdate) (models.VerificationLevel, error)
+
+	// DeleteVerificationLevel soft deletes a verification level by its ID
+	DeleteVerificationLevel(c *gin.Context, levelID string) error
+
+	// PublishVerificationLevel publishes the draft of a verification level as its current version
+	PublishVerificationLevel(c *gin.Context, levelID string) (models.VerificationLevel, error)
+
+	// GetVerificationLevelHistory retrieves every version of a verification level, oldest first
+	GetVerificationLevelHistory(c *gin.Context, levelID string) ([]models.VerificationLevel, error)
+
+	// MigrateApplicants moves applicants of a verification level to another published version
+	MigrateApplicants(c *gin.Context, levelID string, migration models.LevelMigration) (models.LevelMigrationResult, error)
 }
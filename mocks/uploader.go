@@ -2,10 +2,11 @@ package mocks
 
 import (
 	"context"
-	"mime/multipart"
+	"io"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -18,6 +19,36 @@ func (m *MockS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput,
 	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
 }
 
+func (m *MockS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.CreateMultipartUploadOutput), args.Error(1)
+}
+
+func (m *MockS3Client) UploadPart(ctx context.Context, input *s3.UploadPartInput, opts ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.UploadPartOutput), args.Error(1)
+}
+
+func (m *MockS3Client) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.CompleteMultipartUploadOutput), args.Error(1)
+}
+
+func (m *MockS3Client) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, opts ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*s3.AbortMultipartUploadOutput), args.Error(1)
+}
+
 // MockS3Uploader mocks the S3Uploader service
 type MockS3Uploader struct {
 	mock.Mock
@@ -26,16 +57,31 @@ type MockS3Uploader struct {
 }
 
 // UploadFile mocks the UploadFile method of S3Uploader
-func (m *MockS3Uploader) UploadFile(ctx context.Context, file multipart.File, fileName string, mimeType string, kmsUploader interfaces.KMSUploader) (string, error) {
+func (m *MockS3Uploader) UploadFile(ctx context.Context, file io.Reader, fileName string, mimeType string, kmsUploader interfaces.KMSUploader) (string, error) {
 	args := m.Called(ctx, file, fileName, mimeType)
 	return args.String(0), args.Error(1)
 }
 
-// DownloadFile mocks the DownloadFile method of S3Uploader <- This may be need changes
-func (m *MockS3Uploader) DownloadFile(ctx context.Context, objectKey string) (*s3.GetObjectOutput, error) {
+// DownloadFile mocks the DownloadFile method of S3Uploader
+func (m *MockS3Uploader) DownloadFile(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error) {
 	args := m.Called(ctx, objectKey)
 	if args.Get(0) != nil {
-		return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+		return args.Get(0).(io.ReadCloser), args.Get(1).(models.ObjectInfo), args.Error(2)
+	}
+	return nil, models.ObjectInfo{}, args.Error(2)
+}
+
+// DownloadDecrypted mocks the DownloadDecrypted method of S3Uploader
+func (m *MockS3Uploader) DownloadDecrypted(ctx context.Context, objectKey string, kmsUploader interfaces.KMSUploader) (io.ReadCloser, error) {
+	args := m.Called(ctx, objectKey)
+	if args.Get(0) != nil {
+		return args.Get(0).(io.ReadCloser), args.Error(1)
 	}
 	return nil, args.Error(1)
 }
+
+// DeleteFile mocks the DeleteFile method of S3Uploader
+func (m *MockS3Uploader) DeleteFile(ctx context.Context, objectKey string) error {
+	args := m.Called(ctx, objectKey)
+	return args.Error(0)
+}
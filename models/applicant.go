@@ -2,6 +2,9 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/rachel-lawrie/verus_backend_core/constants"
@@ -11,25 +14,31 @@ import (
 
 // Applicant represents an applicant associated with a client
 type Applicant struct {
-	ApplicantID       string           `bson:"applicant_id" json:"applicant_id"` // Unique ID for the applicant
-	FirstName         string           `bson:"first_name" json:"first_name"`     // First name of the applicant
-	MiddleName        string           `bson:"middle_name" json:"middle_name"`   // Middle name of the applicant
-	LastName          string           `bson:"last_name" json:"last_name"`
-	Email             string           `bson:"email" json:"email"`                           // Applicant's email address
-	Phone             string           `bson:"phone" json:"phone"`                           // Applicant's phone number
-	ClientID          string           `bson:"client_id" json:"client_id"`                   // ID of the associated client (foreign key)
-	VerificationLevel string           `bson:"verification_level" json:"verification_level"` // Name of the associated verification level (foreign key)
-	ExternalUserId    string           `bson:"external_user_id" json:"external_user_id"`     // External user ID
-	Status            ApplicantStatus  `bson:"status" json:"status"`                         // PENDING, IN_REVIEW, VERIFIED, REJECTED
-	CreatedAt         time.Time        `bson:"created_at" json:"created_at"`                 // Creation timestamp
-	UpdatedAt         time.Time        `bson:"updated_at" json:"updated_at"`                 // Last update timestamp
-	Deleted           bool             `bson:"deleted" json:"deleted"`                       // Soft delete flag
-	DeletedAt         *time.Time       `bson:"deleted_at" json:"deleted_at"`                 // Soft delete timestamp
-	DeletedBy         *string          `bson:"deleted_by" json:"deleted_by"`                 // User/system that deleted the applicant
-	EncryptedData     EncryptedData    `bson:"encrypted_data" json:"encrypted_data"`         // Encrypted fields (DOB, Address, and key)
-	Documents         []Document       `bson:"documents" json:"documents"`                   // List of documents associated with the applicant
-	SumsubApplicant   sumsub.Applicant `bson:"sumsub_applicant" json:"sumsub_applicant"`     // Sumsub applicant object
-	Payload           Payload          `bson:"payload" json:"payload"`                       // Payload object
+	ApplicantID       string           `bson:"applicant_id" json:"applicant_id" verus:"aad"`                 // Unique ID for the applicant
+	FirstName         string           `bson:"first_name" json:"first_name" verus:"encrypt"`                 // First name of the applicant
+	MiddleName        string           `bson:"middle_name" json:"middle_name" verus:"encrypt"`               // Middle name of the applicant
+	LastName          string           `bson:"last_name" json:"last_name" verus:"encrypt"`                   // Last name of the applicant
+	Email             string           `bson:"email" json:"email" verus:"encrypt"`                           // Applicant's email address
+	Phone             string           `bson:"phone" json:"phone" verus:"encrypt"`                           // Applicant's phone number
+	ClientID          string           `bson:"client_id" json:"client_id" verus:"aad"`                       // ID of the associated client (foreign key)
+	VerificationLevel string           `bson:"verification_level" json:"verification_level"`                 // Name of the associated verification level (foreign key)
+	LevelID           string           `bson:"level_id,omitempty" json:"level_id,omitempty"`                 // Verification level the applicant is pinned to
+	LevelVersion      int              `bson:"level_version,omitempty" json:"level_version,omitempty"`       // Version of the level the applicant is evaluated against
+	ExternalUserId    string           `bson:"external_user_id" json:"external_user_id"`                     // External user ID
+	Status            ApplicantStatus  `bson:"status" json:"status"`                                         // PENDING, IN_REVIEW, VERIFIED, REJECTED
+	CreatedAt         time.Time        `bson:"created_at" json:"created_at"`                                 // Creation timestamp
+	UpdatedAt         time.Time        `bson:"updated_at" json:"updated_at"`                                 // Last update timestamp
+	Deleted           bool             `bson:"deleted" json:"deleted"`                                       // Soft delete flag
+	DeletedAt         *time.Time       `bson:"deleted_at" json:"deleted_at"`                                 // Soft delete timestamp
+	DeletedBy         *string          `bson:"deleted_by" json:"deleted_by"`                                 // User/system that deleted the applicant
+	EraseRequested    bool             `bson:"erase_requested,omitempty" json:"erase_requested,omitempty"`   // Purged with its files on the next purge run, regardless of retention
+	EncryptedData     EncryptedData    `bson:"encrypted_data" json:"encrypted_data"`                         // Encrypted fields (DOB, Address, and key)
+	Documents         []Document       `bson:"documents" json:"documents"`                                   // List of documents associated with the applicant
+	SumsubApplicant   sumsub.Applicant `bson:"sumsub_applicant" json:"sumsub_applicant"`                     // Sumsub applicant object
+	Payload           Payload          `bson:"payload" json:"payload"`                                       // Payload object
+	RiskSignals       []RiskSignal     `bson:"risk_signals,omitempty" json:"risk_signals,omitempty"`         // Fraud indicators detected for the applicant
+	Attempts          int              `bson:"attempts" json:"attempts"`                                     // Number of times the applicant was submitted for review
+	RejectionReason   string           `bson:"rejection_reason,omitempty" json:"rejection_reason,omitempty"` // Why the applicant was last rejected
 }
 
 // Payload represents the payload associated with an applicant
@@ -39,15 +48,46 @@ type Payload struct {
 
 // EncryptedField represents an encrypted field with ciphertext and nonce
 type EncryptedField struct {
-	Ciphertext []byte `bson:"ciphertext" json:"ciphertext"` // Encrypted data
-	Nonce      []byte `bson:"nonce" json:"nonce"`           // Nonce used for encryption
+	Ciphertext []byte `bson:"ciphertext" json:"ciphertext"`               // Encrypted data
+	Nonce      []byte `bson:"nonce" json:"nonce"`                         // Nonce used for encryption
+	Version    int    `bson:"version,omitempty" json:"version,omitempty"` // Ciphertext format, see EncryptedFieldVersion*
 }
 
+const (
+	EncryptedFieldVersionUnbound = 0 // Legacy AES-GCM ciphertext without associated data
+	EncryptedFieldVersionBound   = 1 // AES-GCM ciphertext bound to its encryption context as associated data
+)
+
 // EncryptedData contains the encrypted sensitive fields (DOB and Address) and the encrypted key
 type EncryptedData struct {
-	DOB          EncryptedField   `bson:"dob" json:"dob"`                     // Encrypted DOB
-	Address      EncryptedAddress `bson:"address" json:"address"`             // Encrypted Address
-	EncryptedKey []byte           `bson:"encrypted_key" json:"encrypted_key"` // Encrypted data encryption key (DEK)
+	DOB          EncryptedField   `bson:"dob" json:"dob"`                                         // Encrypted DOB
+	Address      EncryptedAddress `bson:"address" json:"address"`                                 // Encrypted Address
+	EncryptedKey []byte           `bson:"encrypted_key" json:"encrypted_key" verus:"dek"`         // Encrypted data encryption key (DEK), also used for verus:"encrypt" fields
+	KeyID        string           `bson:"key_id" json:"key_id" verus:"dek_key_id"`                // KMS key that wrapped the DEK
+	KeyVersion   int              `bson:"key_version" json:"key_version" verus:"dek_key_version"` // Version of the KMS key that wrapped the DEK
+
+	KeyDestroyedAt *time.Time `bson:"key_destroyed_at,omitempty" json:"key_destroyed_at,omitempty" verus:"dek_destroyed_at"` // Set when the DEK was destroyed by an erasure request
+}
+
+// WrappedKey is a DEK encrypted under a KMS key, with the key that produced it
+type WrappedKey struct {
+	EncryptedKey []byte `bson:"encrypted_key" json:"encrypted_key"` // KMS ciphertext of the DEK
+	KeyID        string `bson:"key_id" json:"key_id"`               // KMS key ID (ARN or alias)
+	KeyVersion   int    `bson:"key_version" json:"key_version"`     // Version of the KMS key
+
+	DestroyedAt *time.Time `bson:"destroyed_at,omitempty" json:"destroyed_at,omitempty"` // Set once the key was crypto-shredded
+}
+
+// WrappedKey returns the DEK of the encrypted data together with its key reference
+func (d EncryptedData) WrappedKey() WrappedKey {
+	return WrappedKey{EncryptedKey: d.EncryptedKey, KeyID: d.KeyID, KeyVersion: d.KeyVersion, DestroyedAt: d.KeyDestroyedAt}
+}
+
+// SetWrappedKey replaces the DEK and key reference, leaving the field ciphertexts untouched
+func (d *EncryptedData) SetWrappedKey(key WrappedKey) {
+	d.EncryptedKey = key.EncryptedKey
+	d.KeyID = key.KeyID
+	d.KeyVersion = key.KeyVersion
 }
 
 // Address represents the address fields
@@ -106,3 +146,108 @@ func ParseApplicantStatus(s string) (ApplicantStatus, error) {
 	}
 	return ApplicantStatusPending, errors.New("Unknown applicant status")
 }
+
+// applicantTransitions lists the statuses an applicant may move to from each status. Verified is
+// final; a review may send an applicant back to pending when documents have to be uploaded again,
+// a pending applicant is rejected once its rejected documents or its submissions used up the
+// level's attempts, and a rejected applicant may be reopened while it has attempts left.
+var applicantTransitions = map[ApplicantStatus][]ApplicantStatus{
+	ApplicantStatusPending:  {ApplicantStatusInReview, ApplicantStatusRejected},
+	ApplicantStatusInReview: {ApplicantStatusVerified, ApplicantStatusRejected, ApplicantStatusPending},
+	ApplicantStatusRejected: {ApplicantStatusPending},
+}
+
+var (
+	// ErrApplicantRejectionReasonRequired is returned when an applicant is rejected without a reason
+	ErrApplicantRejectionReasonRequired = errors.New("a reason is required to reject an applicant")
+	// ErrMaxAttemptsReached is returned when an applicant that used all the attempts of its
+	// verification level is submitted for review or reopened
+	ErrMaxAttemptsReached = errors.New("applicant has no verification attempts left")
+)
+
+// IllegalApplicantTransitionError is returned when an applicant cannot move between two statuses
+type IllegalApplicantTransitionError struct {
+	From ApplicantStatus
+	To   ApplicantStatus
+}
+
+func (e *IllegalApplicantTransitionError) Error() string {
+	return fmt.Sprintf("applicant cannot move from %s to %s", e.From, e.To)
+}
+
+// CanTransitionTo reports whether an applicant may move from s to the given status
+func (s ApplicantStatus) CanTransitionTo(to ApplicantStatus) bool {
+	return slices.Contains(applicantTransitions[s], to)
+}
+
+// ApplicantTransitionEvent returns the webhook event sent when an applicant moves between two
+// statuses, or an empty EventType when the move is not one the transition table allows
+func ApplicantTransitionEvent(from, to ApplicantStatus) EventType {
+	switch {
+	case !from.CanTransitionTo(to):
+		return ""
+	case to == ApplicantStatusInReview:
+		return ApplicantPending
+	case to == ApplicantStatusVerified:
+		return ApplicantReviewed
+	case to == ApplicantStatusRejected:
+		return ApplicantRejected
+	case from == ApplicantStatusRejected:
+		return InspectionReopened
+	default:
+		return ApplicantOnHold
+	}
+}
+
+// HasAttemptsLeft reports whether the applicant may be submitted for review again under a level
+// allowing maxAttempts attempts, zero meaning unlimited
+func (a *Applicant) HasAttemptsLeft(maxAttempts int) bool {
+	return maxAttempts <= 0 || a.Attempts < maxAttempts
+}
+
+// ApplicantTransition records an applicant moving between statuses
+type ApplicantTransition struct {
+	ApplicantID string
+	From        ApplicantStatus
+	To          ApplicantStatus
+	Event       EventType
+	Actor       string
+	Reason      string
+	At          time.Time
+}
+
+// Transition moves the applicant to a new status, refusing moves the transition table does not
+// allow, rejections without a reason, and submissions or reopenings beyond maxAttempts. Entering
+// review counts as an attempt. It only changes the applicant in memory, use
+// common.TransitionApplicant to persist, audit and announce it.
+func (a *Applicant) Transition(to ApplicantStatus, maxAttempts int, actor, reason string) (ApplicantTransition, error) {
+	if !a.Status.CanTransitionTo(to) {
+		return ApplicantTransition{}, &IllegalApplicantTransitionError{From: a.Status, To: to}
+	}
+	if to == ApplicantStatusRejected && strings.TrimSpace(reason) == "" {
+		return ApplicantTransition{}, ErrApplicantRejectionReasonRequired
+	}
+	if (to == ApplicantStatusInReview || a.Status == ApplicantStatusRejected) && !a.HasAttemptsLeft(maxAttempts) {
+		return ApplicantTransition{}, ErrMaxAttemptsReached
+	}
+
+	transition := ApplicantTransition{
+		ApplicantID: a.ApplicantID,
+		From:        a.Status,
+		To:          to,
+		Event:       ApplicantTransitionEvent(a.Status, to),
+		Actor:       actor,
+		Reason:      reason,
+		At:          time.Now(),
+	}
+	if to == ApplicantStatusInReview {
+		a.Attempts++
+	}
+	a.Status = to
+	a.UpdatedAt = transition.At
+	a.RejectionReason = ""
+	if to == ApplicantStatusRejected {
+		a.RejectionReason = reason
+	}
+	return transition, nil
+}
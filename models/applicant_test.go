@@ -0,0 +1,76 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplicantTransition(t *testing.T) {
+	applicant := Applicant{ApplicantID: "app-1", Status: ApplicantStatusPending}
+
+	// Entering review counts as an attempt
+	transition, err := applicant.Transition(ApplicantStatusInReview, 2, "workflow", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ApplicantPending, transition.Event)
+	assert.Equal(t, ApplicantStatusInReview, applicant.Status)
+	assert.Equal(t, 1, applicant.Attempts)
+
+	_, err = applicant.Transition(ApplicantStatusRejected, 2, "reviewer", "")
+	assert.ErrorIs(t, err, ErrApplicantRejectionReasonRequired)
+	transition, err = applicant.Transition(ApplicantStatusRejected, 2, "reviewer", "document forged")
+	assert.NoError(t, err)
+	assert.Equal(t, ApplicantRejected, transition.Event)
+	assert.Equal(t, "document forged", applicant.RejectionReason)
+
+	transition, err = applicant.Transition(ApplicantStatusPending, 2, "reviewer", "")
+	assert.NoError(t, err)
+	assert.Equal(t, InspectionReopened, transition.Event)
+	assert.Empty(t, applicant.RejectionReason)
+
+	_, err = applicant.Transition(ApplicantStatusInReview, 2, "workflow", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, applicant.Attempts)
+	transition, err = applicant.Transition(ApplicantStatusVerified, 2, "reviewer", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ApplicantReviewed, transition.Event)
+}
+
+func TestApplicantTransitionEnforcesMaxAttempts(t *testing.T) {
+	applicant := Applicant{Status: ApplicantStatusRejected, Attempts: 2}
+	_, err := applicant.Transition(ApplicantStatusPending, 2, "reviewer", "")
+	assert.ErrorIs(t, err, ErrMaxAttemptsReached)
+	assert.Equal(t, ApplicantStatusRejected, applicant.Status)
+
+	// Zero allows unlimited attempts
+	_, err = applicant.Transition(ApplicantStatusPending, 0, "reviewer", "")
+	assert.NoError(t, err)
+
+	applicant = Applicant{Status: ApplicantStatusPending, Attempts: 3}
+	_, err = applicant.Transition(ApplicantStatusInReview, 3, "workflow", "")
+	assert.ErrorIs(t, err, ErrMaxAttemptsReached)
+	assert.Equal(t, 3, applicant.Attempts)
+}
+
+func TestApplicantTransitionRefusesIllegalMoves(t *testing.T) {
+	tests := []struct {
+		from ApplicantStatus
+		to   ApplicantStatus
+	}{
+		{ApplicantStatusPending, ApplicantStatusVerified},
+		{ApplicantStatusVerified, ApplicantStatusPending},
+		{ApplicantStatusVerified, ApplicantStatusRejected},
+		{ApplicantStatusRejected, ApplicantStatusInReview},
+		{ApplicantStatusInReview, ApplicantStatusInReview},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			applicant := Applicant{Status: tt.from}
+			_, err := applicant.Transition(tt.to, 0, "reviewer", "reason")
+			var illegal *IllegalApplicantTransitionError
+			assert.ErrorAs(t, err, &illegal)
+			assert.Equal(t, tt.from, applicant.Status)
+			assert.Empty(t, ApplicantTransitionEvent(tt.from, tt.to))
+		})
+	}
+}
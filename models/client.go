@@ -41,16 +41,22 @@ type VerificationSetting struct {
 }
 
 type VerificationLevel struct {
-	LevelID        string           `bson:"level_id" json:"level_id"`             // Unique ID for the verification level
-	ClientID       string           `bson:"client_id" json:"client_id"`           // ID of the associated client
-	Name           string           `bson:"name" json:"name"`                     // Verification level name
-	RequiredDocs   []DocumentType   `bson:"requiredDocs" json:"requiredDocs"`     // Mandatory docs (use DocumentType)
-	OptionalGroups [][]DocumentType `bson:"optionalGroups" json:"optionalGroups"` // At least one per group
-	MaxAttempts    int              `bson:"maxAttempts" json:"maxAttempts"`       // Maximum attempts allowed
-	CreatedAt      time.Time        `bson:"created_at" json:"created_at"`         // Creation timestamp
-	UpdatedAt      time.Time        `bson:"updated_at" json:"updated_at"`         // Last update timestamp
-	Deleted        bool             `bson:"deleted" json:"deleted"`               // Soft delete flag
-	DeletedAt      *time.Time       `bson:"deleted_at" json:"deleted_at"`         // Soft delete timestamp
+	LevelID        string           `bson:"level_id" json:"level_id"`                             // Unique ID for the verification level
+	ClientID       string           `bson:"client_id" json:"client_id"`                           // ID of the associated client
+	Name           string           `bson:"name" json:"name"`                                     // Verification level name
+	RequiredDocs   []DocumentType   `bson:"requiredDocs" json:"requiredDocs"`                     // Mandatory docs (use DocumentType)
+	OptionalGroups [][]DocumentType `bson:"optionalGroups" json:"optionalGroups"`                 // At least one per group
+	MaxAttempts    int              `bson:"maxAttempts" json:"maxAttempts"`                       // Maximum attempts allowed
+	Rules          []LevelRule      `bson:"rules,omitempty" json:"rules,omitempty"`               // Conditional requirements, see LevelRule
+	Version        int              `bson:"version" json:"version"`                               // Version number, starting at 1; versions share the LevelID
+	State          LevelState       `bson:"state" json:"state"`                                   // Drafts are editable, published versions are immutable
+	Current        bool             `bson:"current" json:"current"`                               // The published version new applicants start on
+	PublishedAt    *time.Time       `bson:"published_at,omitempty" json:"published_at,omitempty"` // When the version was published
+	CreatedAt      time.Time        `bson:"created_at" json:"created_at"`                         // Creation timestamp
+	UpdatedAt      time.Time        `bson:"updated_at" json:"updated_at"`                         // Last update timestamp
+	Deleted        bool             `bson:"deleted" json:"deleted"`                               // Soft delete flag
+	DeletedAt      *time.Time       `bson:"deleted_at" json:"deleted_at"`                         // Soft delete timestamp
+	DeletedBy      *string          `bson:"deleted_by" json:"deleted_by"`                         // User/system that deleted the level
 }
 
 // ClientWebhook represents a webhook document
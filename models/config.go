@@ -5,6 +5,28 @@ type Config struct {
 	Database DatabaseConfig
 	AWS      AWSConfig
 	Vendors  map[string]VendorConfig
+
+	DocumentAccess DocumentAccessConfig
+	Scanner        ScannerConfig
+	Fraud          FraudConfig
+}
+
+// FraudConfig configures fraud signals raised on uploaded documents
+type FraudConfig struct {
+	SimilarityThreshold int // Maximum Hamming distance between perceptual hashes of near-duplicate images, defaults to 10
+}
+
+// ScannerConfig configures the malware scanning of uploaded documents
+type ScannerConfig struct {
+	ClamAVAddress string // clamd address, "host:port" or a unix socket path, empty disables scanning
+	TimeoutSecs   int    // Timeout of a single scan, defaults to 60
+}
+
+// DocumentAccessConfig configures the signed URLs issued for document downloads
+type DocumentAccessConfig struct {
+	BaseURL    string // Public base URL of the API serving the document proxy endpoint
+	SigningKey string // HMAC key signing access URLs, base64 encoded
+	URLTTLSecs int    // Lifetime of access URLs, defaults to 300
 }
 
 type VendorConfig struct {
@@ -25,6 +47,27 @@ type DatabaseConfig struct {
 	CacheCleanupIntervalMins int
 	UseAtlas                 bool   // Indicate whether to use MongoDB Atlas
 	AtlasConnectionURI       string // Full connection string for MongoDB Atlas
+
+	// Connection pool and timeouts, zero values keep the driver defaults
+	MaxPoolSize                uint64
+	MinPoolSize                uint64
+	MaxConnIdleTimeSecs        int
+	ConnectTimeoutSecs         int
+	ServerSelectionTimeoutSecs int
+	SocketTimeoutSecs          int
+
+	ReadPreference      string // primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	WriteConcern        string // "majority" or the number of acknowledging nodes, e.g. "1"
+	WriteConcernJournal bool   // Require writes to be journaled before acknowledging
+
+	TLSEnabled bool   // Connect over TLS (implied when TLSCAFile is set)
+	TLSCAFile  string // PEM file with the CA certificates used to verify the server
+
+	ConnectAttempts         int // Number of ping attempts on connect, defaults to 3
+	ConnectRetryBackoffSecs int // Initial delay between attempts, doubled after each failure, defaults to 1
+
+	SoftDeleteRetentionDays int // Days a soft deleted record is kept before it is purged, 0 disables purging
+	PurgeIntervalMins       int // How often the purge job runs, defaults to 60
 }
 
 type AWSConfig struct {
@@ -33,4 +76,20 @@ type AWSConfig struct {
 	Region          string
 	BucketName      string
 	KeyID           string
+	KeyVersion      int // Bumped whenever KeyID points at a new key, records wrapped under older versions are re-wrapped
+	DEKCacheTTLSecs int // How long unwrapped data keys stay in memory, defaults to 300
+
+	KMSProvider     string // "aws" (default), "vault" or "local" for the software KMS used in development and tests
+	LocalKMSKeyFile string // JSON keyfile of the local KMS, falls back to the VERUS_LOCAL_KMS_KEYS env var
+
+	// Vault Transit settings, used when KMSProvider is "vault". KeyID names the Transit key.
+	VaultAddress      string
+	VaultToken        string
+	VaultNamespace    string
+	VaultTransitMount string // Defaults to "transit"
+
+	StorageBackend  string // "s3" (default) or "local" for the filesystem backend used in development
+	S3Endpoint      string // Endpoint of an S3-compatible store such as MinIO, empty for AWS
+	S3UsePathStyle  bool   // Address buckets by path rather than subdomain, needed by most S3-compatible stores
+	LocalStorageDir string // Directory of the local storage backend
 }
@@ -1,8 +1,12 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -10,18 +14,51 @@ import (
 )
 
 type Document struct {
-	DocumentID   string         `bson:"document_id" json:"document_id"`     // Unique ID for the document
-	ApplicantID  string         `bson:"applicant_id" json:"applicant_id"`   // ID of the associated user
-	DocumentType DocumentType   `bson:"document_type" json:"document_type"` // Type of document (e.g., "passport", "utility bill")
-	Country      string         `bson:"country" json:"country"`             // Country of the document
-	FileURL      string         `bson:"file_url" json:"file_url"`           // URL of the uploaded file
-	FileSize     int64          `bson:"file_size" json:"file_size"`         // Size of the uploaded file
-	Status       DocumentStatus `bson:"status" json:"status"`               // Status of the document (e.g., "DocumentUploaded", "DocumentVerified", "DocumentRejected")
-	CreatedAt    time.Time      `bson:"created_at" json:"created_at"`       // Timestamp of when the document was created
-	UpdatedAt    time.Time      `bson:"updated_at" json:"updated_at"`       // Timestamp of when the document was last updated
-	Deleted      bool           `bson:"deleted" json:"deleted"`             // Soft delete flag
-	DeletedAt    *time.Time     `bson:"deleted_at" json:"deleted_at"`       // Timestamp of soft deletion
-	DeletedBy    *string        `bson:"deleted_by" json:"deleted_by"`       // User or system who deleted the document
+	DocumentID      string         `bson:"document_id" json:"document_id"`                               // Unique ID for the document
+	ApplicantID     string         `bson:"applicant_id" json:"applicant_id"`                             // ID of the associated user
+	ClientID        string         `bson:"client_id,omitempty" json:"client_id,omitempty"`               // ID of the client the applicant belongs to
+	DocumentType    DocumentType   `bson:"document_type" json:"document_type"`                           // Type of document (e.g., "passport", "utility bill")
+	Country         string         `bson:"country" json:"country"`                                       // Country of the document
+	ObjectKey       string         `bson:"object_key" json:"object_key"`                                 // Storage key of the uploaded, encrypted file
+	FileURL         string         `bson:"file_url" json:"file_url"`                                     // Deprecated: public-style URL stored by older uploads, use ObjectKey
+	FileSize        int64          `bson:"file_size" json:"file_size"`                                   // Size of the uploaded file
+	ContentHash     string         `bson:"content_hash,omitempty" json:"content_hash,omitempty"`         // Hex SHA-256 of the stored plaintext, after normalization for images, see utils.ContentHasher
+	OriginalHash    string         `bson:"original_hash,omitempty" json:"original_hash,omitempty"`       // Hex SHA-256 of the file as uploaded
+	PerceptualHash  string         `bson:"perceptual_hash,omitempty" json:"perceptual_hash,omitempty"`   // Hex dHash of image documents for near-duplicate search, see utils.PerceptualHash
+	Status          DocumentStatus `bson:"status" json:"status"`                                         // Status of the document (e.g., "DocumentUploaded", "DocumentVerified", "DocumentRejected")
+	RejectionReason string         `bson:"rejection_reason,omitempty" json:"rejection_reason,omitempty"` // Why the document was rejected, set while it is rejected
+	CreatedAt       time.Time      `bson:"created_at" json:"created_at"`                                 // Timestamp of when the document was created
+	UpdatedAt       time.Time      `bson:"updated_at" json:"updated_at"`                                 // Timestamp of when the document was last updated
+	Deleted         bool           `bson:"deleted" json:"deleted"`                                       // Soft delete flag
+	DeletedAt       *time.Time     `bson:"deleted_at" json:"deleted_at"`                                 // Timestamp of soft deletion
+	DeletedBy       *string        `bson:"deleted_by" json:"deleted_by"`                                 // User or system who deleted the document
+
+	EraseRequested bool        `bson:"erase_requested,omitempty" json:"erase_requested,omitempty"` // Purged with its file on the next purge run, regardless of retention
+	Scan           *ScanResult `bson:"scan,omitempty" json:"scan,omitempty"`                       // Result of the malware scan, nil while it is pending
+
+	IssuedAt  *time.Time     `bson:"issued_at,omitempty" json:"issued_at,omitempty"`   // Issue date printed on the document, if known
+	ExpiresAt *time.Time     `bson:"expires_at,omitempty" json:"expires_at,omitempty"` // Expiry date printed on the document, if known
+	Liveness  *LivenessCheck `bson:"liveness,omitempty" json:"liveness,omitempty"`     // Liveness and face match result of selfie documents
+}
+
+// StorageKey returns the object key of the document's file, deriving it from the legacy FileURL
+// for documents uploaded before ObjectKey was stored
+func (d Document) StorageKey() string {
+	if d.ObjectKey != "" || d.FileURL == "" {
+		return d.ObjectKey
+	}
+	parsed, err := url.Parse(d.FileURL)
+	if err != nil || parsed.Host == "" {
+		return d.FileURL
+	}
+	return strings.TrimPrefix(parsed.Path, "/")
+}
+
+// DocumentAccessGrant is a short-lived signed URL giving access to a document's decrypted content
+type DocumentAccessGrant struct {
+	DocumentID string    `json:"document_id"`
+	URL        string    `json:"url"`
+	ExpiresAt  time.Time `json:"expires_at"`
 }
 
 type DocumentStatus int
@@ -32,6 +69,7 @@ const (
 	DocumentVerified
 	DocumentRejected
 	DocumentUploadPending
+	DocumentQuarantined // The malware scan flagged the file, it is never served
 )
 
 // Map enum values to their string representations
@@ -40,6 +78,7 @@ var documentStatusToString = map[DocumentStatus]string{
 	DocumentVerified:      constants.DOCUMENT_STATUS_VERIFIED,
 	DocumentRejected:      constants.DOCUMENT_STATUS_REJECTED,
 	DocumentUploadPending: constants.DOCUMENT_STATUS_UPLOAD_PENDING,
+	DocumentQuarantined:   constants.DOCUMENT_STATUS_QUARANTINED,
 }
 
 // Map string representations back to enum values
@@ -48,6 +87,7 @@ var stringToDocumentStatus = map[string]DocumentStatus{
 	constants.DOCUMENT_STATUS_VERIFIED:       DocumentVerified,
 	constants.DOCUMENT_STATUS_REJECTED:       DocumentRejected,
 	constants.DOCUMENT_STATUS_UPLOAD_PENDING: DocumentUploadPending,
+	constants.DOCUMENT_STATUS_QUARANTINED:    DocumentQuarantined,
 }
 
 // String method for Status to get the name
@@ -63,12 +103,78 @@ func ParseDocumentStatus(s string) (DocumentStatus, error) {
 	val, ok := stringToDocumentStatus[strings.ToLower(s)]
 
 	if ok {
-		log.Printf("Parsing document status: %s", s)
 		return val, nil
 	}
 	return DocumentStatus(0), errors.New("invalid status")
 }
 
+// documentTransitions lists the statuses a document may move to from each status. Verified is
+// final, a rejected document is replaced by uploading the file again.
+var documentTransitions = map[DocumentStatus][]DocumentStatus{
+	DocumentUploadPending: {DocumentUploaded, DocumentQuarantined},
+	DocumentUploaded:      {DocumentVerified, DocumentRejected},
+	DocumentRejected:      {DocumentUploadPending},
+	DocumentQuarantined:   {DocumentRejected},
+}
+
+// ServableDocumentStatuses are the statuses of documents whose content may be served. A
+// document only leaves UploadPending once its malware scan finished clean.
+var ServableDocumentStatuses = []DocumentStatus{DocumentUploaded, DocumentVerified, DocumentRejected}
+
+// Servable reports whether the document's content may be served
+func (d Document) Servable() bool {
+	return !d.Deleted && slices.Contains(ServableDocumentStatuses, d.Status)
+}
+
+// ErrRejectionReasonRequired is returned when a document is rejected without a reason
+var ErrRejectionReasonRequired = errors.New("a reason is required to reject a document")
+
+// IllegalTransitionError is returned when a document cannot move between two statuses
+type IllegalTransitionError struct {
+	From DocumentStatus
+	To   DocumentStatus
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("document cannot move from %s to %s", e.From, e.To)
+}
+
+// CanTransitionTo reports whether a document may move from s to the given status
+func (s DocumentStatus) CanTransitionTo(to DocumentStatus) bool {
+	return slices.Contains(documentTransitions[s], to)
+}
+
+// DocumentTransition records a document moving between statuses
+type DocumentTransition struct {
+	DocumentID string
+	From       DocumentStatus
+	To         DocumentStatus
+	Actor      string
+	Reason     string
+	At         time.Time
+}
+
+// Transition moves the document to a new status, refusing moves the transition table does not
+// allow and rejections without a reason. It only changes the document in memory, use
+// common.TransitionDocument to persist and audit it.
+func (d *Document) Transition(to DocumentStatus, actor, reason string) (DocumentTransition, error) {
+	if !d.Status.CanTransitionTo(to) {
+		return DocumentTransition{}, &IllegalTransitionError{From: d.Status, To: to}
+	}
+	if to == DocumentRejected && strings.TrimSpace(reason) == "" {
+		return DocumentTransition{}, ErrRejectionReasonRequired
+	}
+
+	transition := DocumentTransition{DocumentID: d.DocumentID, From: d.Status, To: to, Actor: actor, Reason: reason, At: time.Now()}
+	d.Status = to
+	d.UpdatedAt = transition.At
+	d.RejectionReason = ""
+	if to == DocumentRejected {
+		d.RejectionReason = reason
+	}
+	return transition, nil
+}
+
 type DocumentType int
 
 const (
@@ -129,6 +235,49 @@ func (s DocumentType) String() string {
 	return "Unknown"
 }
 
+// documentTypeNames returns the names of every document type, in declaration order
+func documentTypeNames() string {
+	docTypes := slices.Sorted(maps.Keys(documentTypeToString))
+	names := make([]string, len(docTypes))
+	for i, docType := range docTypes {
+		names[i] = docType.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// MarshalJSON encodes a document type as its name, e.g. "PASSPORT". Values without a name are
+// kept as numbers so a stray value does not break the whole response.
+func (s DocumentType) MarshalJSON() ([]byte, error) {
+	name, ok := documentTypeToString[s]
+	if !ok {
+		return json.Marshal(int(s))
+	}
+	return json.Marshal(name)
+}
+
+// UnmarshalJSON decodes a document type from its name, case-insensitively. The numeric values
+// written before document types were encoded as names are accepted too.
+func (s *DocumentType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var value int
+		if json.Unmarshal(data, &value) != nil {
+			return fmt.Errorf("document type must be a string: %s", data)
+		}
+		if _, ok := documentTypeToString[DocumentType(value)]; !ok {
+			return fmt.Errorf("invalid document type %d", value)
+		}
+		*s = DocumentType(value)
+		return nil
+	}
+	docType, err := ParseDocumentType(strings.TrimSpace(name))
+	if err != nil {
+		return fmt.Errorf("invalid document type %q", name)
+	}
+	*s = docType
+	return nil
+}
+
 // Parse string to Status enum
 func ParseDocumentType(s string) (DocumentType, error) {
 	if val, ok := stringToDocumentType[strings.ToUpper(s)]; ok {
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -17,6 +18,7 @@ func TestParseDocumentStatus(t *testing.T) {
 		{"verified", DocumentVerified, false},
 		{"rejected", DocumentRejected, false},
 		{"uploadpending", DocumentUploadPending, false},
+		{"quarantined", DocumentQuarantined, false},
 		{"invalid", DocumentStatus(0), true},
 	}
 
@@ -73,6 +75,7 @@ func TestDocumentStatusString(t *testing.T) {
 		{DocumentVerified, "verified"},
 		{DocumentRejected, "rejected"},
 		{DocumentUploadPending, "uploadpending"},
+		{DocumentQuarantined, "quarantined"},
 		{DocumentStatus(999), "Unknown"},
 	}
 
@@ -135,3 +138,81 @@ func TestDocument(t *testing.T) {
 	assert.Equal(t, now, doc.UpdatedAt)
 	assert.False(t, doc.Deleted)
 }
+
+func TestDocumentStorageKey(t *testing.T) {
+	assert.Equal(t, "documents/passport.jpg", Document{ObjectKey: "documents/passport.jpg"}.StorageKey())
+	assert.Equal(t, "documents/passport.jpg", Document{FileURL: "https://bucket.s3.amazonaws.com/documents/passport.jpg"}.StorageKey())
+	assert.Equal(t, "", Document{}.StorageKey())
+}
+
+func TestDocumentTransition(t *testing.T) {
+	doc := Document{DocumentID: "doc-1", Status: DocumentUploadPending}
+
+	transition, err := doc.Transition(DocumentUploaded, "scanner:clamav", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DocumentUploadPending, transition.From)
+	assert.Equal(t, DocumentUploaded, transition.To)
+	assert.Equal(t, DocumentUploaded, doc.Status)
+	assert.Equal(t, transition.At, doc.UpdatedAt)
+
+	// Rejections need a reason, which is kept on the document
+	_, err = doc.Transition(DocumentRejected, "reviewer", " ")
+	assert.ErrorIs(t, err, ErrRejectionReasonRequired)
+	assert.Equal(t, DocumentUploaded, doc.Status)
+	_, err = doc.Transition(DocumentRejected, "reviewer", "photo is blurred")
+	assert.NoError(t, err)
+	assert.Equal(t, "photo is blurred", doc.RejectionReason)
+
+	// A rejected document is uploaded again, which clears the reason
+	_, err = doc.Transition(DocumentUploadPending, "applicant", "")
+	assert.NoError(t, err)
+	assert.Empty(t, doc.RejectionReason)
+}
+
+func TestDocumentServable(t *testing.T) {
+	assert.True(t, Document{Status: DocumentUploaded}.Servable())
+	assert.True(t, Document{Status: DocumentVerified}.Servable())
+	assert.True(t, Document{Status: DocumentRejected}.Servable())
+	assert.False(t, Document{Status: DocumentUploadPending}.Servable())
+	assert.False(t, Document{Status: DocumentQuarantined}.Servable())
+	assert.False(t, Document{Status: DocumentVerified, Deleted: true}.Servable())
+}
+
+func TestDocumentTransitionRefusesIllegalMoves(t *testing.T) {
+	tests := []struct {
+		from DocumentStatus
+		to   DocumentStatus
+	}{
+		{DocumentUploadPending, DocumentVerified},
+		{DocumentQuarantined, DocumentUploaded},
+		{DocumentVerified, DocumentRejected},
+		{DocumentVerified, DocumentUploadPending},
+		{DocumentRejected, DocumentVerified},
+		{DocumentUploaded, DocumentUploaded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			doc := Document{Status: tt.from}
+			_, err := doc.Transition(tt.to, "reviewer", "reason")
+			var illegal *IllegalTransitionError
+			assert.ErrorAs(t, err, &illegal)
+			assert.Equal(t, tt.from, illegal.From)
+			assert.Equal(t, tt.from, doc.Status)
+		})
+	}
+}
+
+func TestDocumentTypeJSON(t *testing.T) {
+	data, err := json.Marshal([]DocumentType{DocumentPassport, DocumentProofOfAddress})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["PASSPORT","PROOF_OF_ADDRESS"]`, string(data))
+
+	var docTypes []DocumentType
+	assert.NoError(t, json.Unmarshal([]byte(`["passport"," SELFIE ",0]`), &docTypes))
+	assert.Equal(t, []DocumentType{DocumentPassport, DocumentSelfie, DocumentPassport}, docTypes)
+
+	var docType DocumentType
+	assert.Error(t, json.Unmarshal([]byte(`"BIRTH_CERTIFICATE"`), &docType))
+	assert.Error(t, json.Unmarshal([]byte(`99`), &docType))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &docType))
+}
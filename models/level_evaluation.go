@@ -0,0 +1,127 @@
+package models
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Requirement is a requirement of a verification level that an applicant's documents satisfy:
+// a required document type, an optional group of which any one type will do, or a rule
+type Requirement struct {
+	DocumentTypes []DocumentType `json:"document_types"`        // The required type, or the types of the group or rule
+	Group         bool           `json:"group"`                 // Any one of several types satisfies the requirement
+	Rule          string         `json:"rule,omitempty"`        // Name of the LevelRule, empty for required docs and optional groups
+	DocumentID    string         `json:"document_id,omitempty"` // Document satisfying the requirement
+}
+
+// RuleViolation is a rule of a verification level no document satisfies
+type RuleViolation struct {
+	Rule          string         `json:"rule"`
+	DocumentTypes []DocumentType `json:"document_types"`
+	Reason        string         `json:"reason"` // Why no document satisfies the rule, e.g. "PROOF_OF_ADDRESS issued more than 3 months ago"
+}
+
+// LevelEvaluation is the result of evaluating an applicant's documents against a verification
+// level
+type LevelEvaluation struct {
+	LevelID           string           `json:"level_id"`
+	Country           string           `json:"country,omitempty"`  // Applicant country the rules were evaluated for
+	Satisfied         []Requirement    `json:"satisfied"`          // Requirements met by an uploaded or verified document
+	MissingRequired   []DocumentType   `json:"missing_required"`   // Required types without an uploaded or verified document
+	UnsatisfiedGroups [][]DocumentType `json:"unsatisfied_groups"` // Optional groups none of whose types were provided
+	UnsatisfiedRules  []RuleViolation  `json:"unsatisfied_rules"`  // Applicable rules no document satisfies
+	RejectedDocuments []string         `json:"rejected_documents"` // IDs of rejected documents, each using one attempt
+	AttemptsUsed      int              `json:"attempts_used"`
+	AttemptsRemaining int              `json:"attempts_remaining"` // -1 when the level allows unlimited attempts
+	AttemptsExhausted bool             `json:"attempts_exhausted"`
+	CanProceed        bool             `json:"can_proceed"` // Complete and attempts left, the applicant may be submitted for review
+}
+
+// Complete reports whether every requirement of the level is satisfied, regardless of attempts
+func (e LevelEvaluation) Complete() bool {
+	return len(e.MissingRequired) == 0 && len(e.UnsatisfiedGroups) == 0 && len(e.UnsatisfiedRules) == 0
+}
+
+// Evaluate checks documents against the level now, for the country of the applicant's identity
+// document, see EvaluateWith
+func (l VerificationLevel) Evaluate(documents []Document) LevelEvaluation {
+	return l.EvaluateWith(documents, EvaluationContext{Country: ApplicantCountry(documents), Now: time.Now()})
+}
+
+// EvaluateWith checks documents against the level. Required docs and optional groups are
+// satisfied by a live document of their type that was uploaded or verified, rules by such a
+// document that also meets their constraints; verified documents are preferred. Rules that do not
+// apply to the context's country are skipped, rules restricted to countries fail when the
+// country is unknown. Every live rejected document uses one of the
+// level's MaxAttempts, zero meaning unlimited.
+func (l VerificationLevel) EvaluateWith(documents []Document, ctx EvaluationContext) LevelEvaluation {
+	evaluation := LevelEvaluation{LevelID: l.LevelID, Country: normalizeCountry(ctx.Country), AttemptsRemaining: -1}
+
+	var candidates []Document
+	for _, document := range documents {
+		if document.Deleted {
+			continue
+		}
+		switch document.Status {
+		case DocumentRejected:
+			evaluation.RejectedDocuments = append(evaluation.RejectedDocuments, document.DocumentID)
+		case DocumentUploaded, DocumentVerified:
+			candidates = append(candidates, document)
+		}
+	}
+	// Verified documents first, in their original order
+	unverified := func(document Document) int {
+		if document.Status == DocumentVerified {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(candidates, func(a, b Document) int { return cmp.Compare(unverified(a), unverified(b)) })
+
+	for _, docType := range l.RequiredDocs {
+		if document, reason := (LevelRule{DocumentTypes: []DocumentType{docType}}).match(candidates, ctx.Now); reason == "" {
+			evaluation.Satisfied = append(evaluation.Satisfied, Requirement{DocumentTypes: []DocumentType{docType}, DocumentID: document.DocumentID})
+		} else {
+			evaluation.MissingRequired = append(evaluation.MissingRequired, docType)
+		}
+	}
+	for _, group := range l.OptionalGroups {
+		if len(group) == 0 {
+			continue
+		}
+		if document, reason := (LevelRule{DocumentTypes: group}).match(candidates, ctx.Now); reason == "" {
+			evaluation.Satisfied = append(evaluation.Satisfied, Requirement{DocumentTypes: group, Group: true, DocumentID: document.DocumentID})
+		} else {
+			evaluation.UnsatisfiedGroups = append(evaluation.UnsatisfiedGroups, group)
+		}
+	}
+	for _, rule := range l.Rules {
+		if evaluation.Country == "" && rule.CountryRestricted() {
+			// Without a country the rule might apply, so it cannot be considered satisfied
+			evaluation.UnsatisfiedRules = append(evaluation.UnsatisfiedRules, RuleViolation{Rule: rule.Name, DocumentTypes: rule.DocumentTypes, Reason: "applicant country is unknown"})
+			continue
+		}
+		if !rule.AppliesTo(evaluation.Country) {
+			continue
+		}
+		if document, reason := rule.match(candidates, ctx.Now); reason == "" {
+			evaluation.Satisfied = append(evaluation.Satisfied, Requirement{
+				DocumentTypes: rule.DocumentTypes,
+				Group:         len(rule.DocumentTypes) > 1,
+				Rule:          rule.Name,
+				DocumentID:    document.DocumentID,
+			})
+		} else {
+			evaluation.UnsatisfiedRules = append(evaluation.UnsatisfiedRules, RuleViolation{Rule: rule.Name, DocumentTypes: rule.DocumentTypes, Reason: reason})
+		}
+	}
+
+	evaluation.AttemptsUsed = len(evaluation.RejectedDocuments)
+	if l.MaxAttempts > 0 {
+		evaluation.AttemptsRemaining = max(l.MaxAttempts-evaluation.AttemptsUsed, 0)
+		evaluation.AttemptsExhausted = evaluation.AttemptsRemaining == 0
+	}
+	evaluation.CanProceed = evaluation.Complete() && !evaluation.AttemptsExhausted
+	return evaluation
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelEvaluate(t *testing.T) {
+	level := VerificationLevel{
+		LevelID:        "level-1",
+		RequiredDocs:   []DocumentType{DocumentSelfie, DocumentProofOfAddress},
+		OptionalGroups: [][]DocumentType{{DocumentPassport, DocumentNationalID}, {DocumentUtilityBill, DocumentBankStatement}},
+		MaxAttempts:    3,
+	}
+	documents := []Document{
+		{DocumentID: "selfie", DocumentType: DocumentSelfie, Status: DocumentUploaded},
+		{DocumentID: "passport-1", DocumentType: DocumentPassport, Status: DocumentRejected},
+		{DocumentID: "passport-2", DocumentType: DocumentPassport, Status: DocumentUploaded},
+		{DocumentID: "passport-3", DocumentType: DocumentPassport, Status: DocumentVerified},
+		{DocumentID: "bill", DocumentType: DocumentUtilityBill, Status: DocumentUploadPending},
+		{DocumentID: "address", DocumentType: DocumentProofOfAddress, Status: DocumentUploaded, Deleted: true},
+	}
+
+	evaluation := level.Evaluate(documents)
+	assert.Equal(t, "level-1", evaluation.LevelID)
+	assert.Equal(t, []Requirement{
+		{DocumentTypes: []DocumentType{DocumentSelfie}, DocumentID: "selfie"},
+		{DocumentTypes: []DocumentType{DocumentPassport, DocumentNationalID}, Group: true, DocumentID: "passport-3"},
+	}, evaluation.Satisfied)
+	assert.Equal(t, []DocumentType{DocumentProofOfAddress}, evaluation.MissingRequired)
+	assert.Equal(t, [][]DocumentType{{DocumentUtilityBill, DocumentBankStatement}}, evaluation.UnsatisfiedGroups)
+	assert.Equal(t, []string{"passport-1"}, evaluation.RejectedDocuments)
+	assert.Equal(t, 1, evaluation.AttemptsUsed)
+	assert.Equal(t, 2, evaluation.AttemptsRemaining)
+	assert.False(t, evaluation.AttemptsExhausted)
+	assert.False(t, evaluation.Complete())
+	assert.False(t, evaluation.CanProceed)
+
+	documents = append(documents,
+		Document{DocumentID: "address-2", DocumentType: DocumentProofOfAddress, Status: DocumentUploaded},
+		Document{DocumentID: "statement", DocumentType: DocumentBankStatement, Status: DocumentUploaded},
+	)
+	evaluation = level.Evaluate(documents)
+	assert.Empty(t, evaluation.MissingRequired)
+	assert.Empty(t, evaluation.UnsatisfiedGroups)
+	assert.Len(t, evaluation.Satisfied, 4)
+	assert.True(t, evaluation.CanProceed)
+}
+
+func TestLevelEvaluateAttempts(t *testing.T) {
+	documents := []Document{
+		{DocumentID: "passport-1", DocumentType: DocumentPassport, Status: DocumentRejected},
+		{DocumentID: "passport-2", DocumentType: DocumentPassport, Status: DocumentRejected},
+		{DocumentID: "passport-3", DocumentType: DocumentPassport, Status: DocumentUploaded},
+	}
+
+	// Complete, but the rejections used every attempt
+	evaluation := VerificationLevel{RequiredDocs: []DocumentType{DocumentPassport}, MaxAttempts: 2}.Evaluate(documents)
+	assert.True(t, evaluation.Complete())
+	assert.True(t, evaluation.AttemptsExhausted)
+	assert.Equal(t, 0, evaluation.AttemptsRemaining)
+	assert.False(t, evaluation.CanProceed)
+
+	// Zero allows unlimited attempts
+	evaluation = VerificationLevel{RequiredDocs: []DocumentType{DocumentPassport}}.Evaluate(documents)
+	assert.Equal(t, 2, evaluation.AttemptsUsed)
+	assert.Equal(t, -1, evaluation.AttemptsRemaining)
+	assert.True(t, evaluation.CanProceed)
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LivenessCheck is the result of the liveness check of a selfie, and of matching its face with
+// the applicant's identity document
+type LivenessCheck struct {
+	Passed            bool      `bson:"passed" json:"passed"`                                               // The selfie is of a live person and matches the identity document
+	Score             float64   `bson:"score" json:"score"`                                                 // Confidence of the provider, between 0 and 1
+	MatchedDocumentID string    `bson:"matched_document_id,omitempty" json:"matched_document_id,omitempty"` // Identity document the face was matched with
+	Provider          string    `bson:"provider" json:"provider"`
+	CheckedAt         time.Time `bson:"checked_at" json:"checked_at"`
+}
+
+// LevelRule is a requirement of a verification level with conditions. It is satisfied by one
+// live, uploaded or verified document of any of its types that meets every constraint of the
+// rule, and only applies to applicants of the countries it is restricted to.
+type LevelRule struct {
+	Name              string         `bson:"name" json:"name"`                                                 // Identifies the rule in evaluations
+	DocumentTypes     []DocumentType `bson:"document_types" json:"document_types"`                             // Any one of these types satisfies the rule
+	Countries         []string       `bson:"countries,omitempty" json:"countries,omitempty"`                   // Countries the rule applies to, all when empty
+	ExcludedCountries []string       `bson:"excluded_countries,omitempty" json:"excluded_countries,omitempty"` // Countries the rule does not apply to
+	MaxAgeMonths      int            `bson:"max_age_months,omitempty" json:"max_age_months,omitempty"`         // Document must have been issued within this many months, e.g. proof of address
+	NotExpired        bool           `bson:"not_expired,omitempty" json:"not_expired,omitempty"`               // Document must not be expired
+	RequireLiveness   bool           `bson:"require_liveness,omitempty" json:"require_liveness,omitempty"`     // Document must have passed a liveness check and face match
+}
+
+// EvaluationContext holds what a level is evaluated against besides the documents
+type EvaluationContext struct {
+	Country string    // Applicant's country, rules restricted to countries fail when empty
+	Now     time.Time // Reference time of document age and expiry constraints
+}
+
+// identityDocumentTypes are the document types an applicant's country is taken from
+var identityDocumentTypes = []DocumentType{DocumentPassport, DocumentNationalID, DocumentIDCard, DocumentDriverLicense}
+
+// ApplicantCountry returns the issuing country of the applicant's identity document, preferring
+// verified documents, or an empty string when no identity document gives one
+func ApplicantCountry(documents []Document) string {
+	country := ""
+	for _, document := range documents {
+		if document.Deleted || document.Country == "" || !slices.Contains(identityDocumentTypes, document.DocumentType) {
+			continue
+		}
+		if document.Status == DocumentVerified {
+			return normalizeCountry(document.Country)
+		}
+		if document.Status == DocumentUploaded && country == "" {
+			country = normalizeCountry(document.Country)
+		}
+	}
+	return country
+}
+
+func normalizeCountry(country string) string {
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+func containsCountry(countries []string, country string) bool {
+	return slices.ContainsFunc(countries, func(c string) bool { return normalizeCountry(c) == country })
+}
+
+// CountryRestricted reports whether the rule only applies to some countries, in which case the
+// applicant's country must be known to evaluate it
+func (r LevelRule) CountryRestricted() bool {
+	return len(r.Countries) > 0 || len(r.ExcludedCountries) > 0
+}
+
+// AppliesTo reports whether the rule applies to an applicant of country. Rules restricted to
+// countries do not apply when the country is unknown, EvaluateWith fails them instead.
+func (r LevelRule) AppliesTo(country string) bool {
+	country = normalizeCountry(country)
+	if len(r.Countries) > 0 && (country == "" || !containsCountry(r.Countries, country)) {
+		return false
+	}
+	return !(r.CountryRestricted() && country == "") && !containsCountry(r.ExcludedCountries, country)
+}
+
+// Check returns why document does not meet the constraints of the rule at now, or an empty
+// string when it does. The document type is not checked.
+func (r LevelRule) Check(document Document, now time.Time) string {
+	if r.MaxAgeMonths > 0 {
+		if document.IssuedAt == nil {
+			return "issue date is unknown"
+		}
+		if document.IssuedAt.Before(now.AddDate(0, -r.MaxAgeMonths, 0)) {
+			return fmt.Sprintf("issued more than %d months ago", r.MaxAgeMonths)
+		}
+	}
+	if r.NotExpired {
+		if document.ExpiresAt == nil {
+			return "expiry date is unknown"
+		}
+		if !document.ExpiresAt.After(now) {
+			return "expired on " + document.ExpiresAt.Format(time.DateOnly)
+		}
+	}
+	if r.RequireLiveness {
+		if document.Liveness == nil {
+			return "liveness check was not performed"
+		}
+		if !document.Liveness.Passed {
+			return "liveness check failed"
+		}
+	}
+	return ""
+}
+
+// match returns the first of candidates that satisfies the rule, or why none does
+func (r LevelRule) match(candidates []Document, now time.Time) (Document, string) {
+	reason := ""
+	for _, document := range candidates {
+		if !slices.Contains(r.DocumentTypes, document.DocumentType) {
+			continue
+		}
+		failure := r.Check(document, now)
+		if failure == "" {
+			return document, ""
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("%s %s", document.DocumentType, failure)
+		}
+	}
+	if reason == "" {
+		reason = "no document provided"
+	}
+	return Document{}, reason
+}
+
+// Validate checks that the rule can be evaluated
+func (r LevelRule) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("rule name is required")
+	}
+	if len(r.DocumentTypes) == 0 {
+		return fmt.Errorf("rule %q has no document types", r.Name)
+	}
+	for _, docType := range r.DocumentTypes {
+		if _, ok := documentTypeToString[docType]; !ok {
+			return fmt.Errorf("rule %q has an unknown document type, expected one of %s", r.Name, documentTypeNames())
+		}
+	}
+	if r.MaxAgeMonths < 0 {
+		return fmt.Errorf("rule %q has a negative max age", r.Name)
+	}
+	for _, country := range slices.Concat(r.Countries, r.ExcludedCountries) {
+		if strings.TrimSpace(country) == "" {
+			return fmt.Errorf("rule %q has an empty country", r.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateRules checks the rules of the level, whose names must be unique
+func (l VerificationLevel) ValidateRules() error {
+	names := map[string]bool{}
+	for _, rule := range l.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
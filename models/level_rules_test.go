@@ -0,0 +1,114 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelRuleAppliesTo(t *testing.T) {
+	rule := LevelRule{Countries: []string{"GBR", "irl"}, ExcludedCountries: []string{"IRL"}}
+	assert.True(t, rule.AppliesTo("gbr"))
+	assert.False(t, rule.AppliesTo("IRL"), "excluded countries win")
+	assert.False(t, rule.AppliesTo("USA"))
+	assert.False(t, rule.AppliesTo(""), "country restricted rules need a known country")
+
+	rule = LevelRule{ExcludedCountries: []string{"USA"}}
+	assert.False(t, rule.AppliesTo(""), "excluding rules need a known country too")
+	assert.True(t, rule.AppliesTo("DEU"))
+	assert.False(t, rule.AppliesTo("USA"))
+}
+
+func TestLevelRuleCheck(t *testing.T) {
+	now := time.Date(2026, 6, 15, 0, 0, 0, 0, time.UTC)
+	at := func(year int, month time.Month, day int) *time.Time {
+		date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		return &date
+	}
+
+	recent := LevelRule{MaxAgeMonths: 3}
+	assert.Empty(t, recent.Check(Document{IssuedAt: at(2026, 4, 1)}, now))
+	assert.Equal(t, "issued more than 3 months ago", recent.Check(Document{IssuedAt: at(2026, 3, 1)}, now))
+	assert.Equal(t, "issue date is unknown", recent.Check(Document{}, now))
+
+	valid := LevelRule{NotExpired: true}
+	assert.Empty(t, valid.Check(Document{ExpiresAt: at(2030, 1, 1)}, now))
+	assert.Equal(t, "expired on 2026-06-15", valid.Check(Document{ExpiresAt: at(2026, 6, 15)}, now))
+	assert.Equal(t, "expiry date is unknown", valid.Check(Document{}, now))
+
+	live := LevelRule{RequireLiveness: true}
+	assert.Empty(t, live.Check(Document{Liveness: &LivenessCheck{Passed: true}}, now))
+	assert.Equal(t, "liveness check failed", live.Check(Document{Liveness: &LivenessCheck{}}, now))
+	assert.Equal(t, "liveness check was not performed", live.Check(Document{}, now))
+}
+
+func TestLevelEvaluateWithRules(t *testing.T) {
+	now := time.Date(2026, 6, 15, 0, 0, 0, 0, time.UTC)
+	old := now.AddDate(0, -6, 0)
+	expiry := now.AddDate(2, 0, 0)
+	level := VerificationLevel{
+		RequiredDocs: []DocumentType{DocumentPassport},
+		Rules: []LevelRule{
+			{Name: "selfie", DocumentTypes: []DocumentType{DocumentSelfie}, RequireLiveness: true},
+			{Name: "uk-address", DocumentTypes: []DocumentType{DocumentUtilityBill, DocumentBankStatement}, Countries: []string{"GBR"}, MaxAgeMonths: 3},
+			{Name: "valid-passport", DocumentTypes: []DocumentType{DocumentPassport}, NotExpired: true},
+		},
+	}
+	documents := []Document{
+		{DocumentID: "passport", DocumentType: DocumentPassport, Country: "gbr", Status: DocumentVerified, ExpiresAt: &expiry},
+		{DocumentID: "selfie", DocumentType: DocumentSelfie, Status: DocumentUploaded, Liveness: &LivenessCheck{Passed: false}},
+		{DocumentID: "bill", DocumentType: DocumentUtilityBill, Status: DocumentUploaded, IssuedAt: &old},
+	}
+
+	assert.Equal(t, "GBR", ApplicantCountry(documents))
+	evaluation := level.EvaluateWith(documents, EvaluationContext{Country: ApplicantCountry(documents), Now: now})
+	assert.Equal(t, "GBR", evaluation.Country)
+	assert.Equal(t, []RuleViolation{
+		{Rule: "selfie", DocumentTypes: []DocumentType{DocumentSelfie}, Reason: "SELFIE liveness check failed"},
+		{Rule: "uk-address", DocumentTypes: []DocumentType{DocumentUtilityBill, DocumentBankStatement}, Reason: "UTILITY_BILL issued more than 3 months ago"},
+	}, evaluation.UnsatisfiedRules)
+	assert.Contains(t, evaluation.Satisfied, Requirement{DocumentTypes: []DocumentType{DocumentPassport}, Rule: "valid-passport", DocumentID: "passport"})
+	assert.False(t, evaluation.CanProceed)
+
+	// The address rule does not apply outside the UK
+	evaluation = level.EvaluateWith(documents, EvaluationContext{Country: "DEU", Now: now})
+	assert.Len(t, evaluation.UnsatisfiedRules, 1)
+
+	documents[1].Liveness.Passed = true
+	evaluation = level.EvaluateWith(documents, EvaluationContext{Country: "FRA", Now: now})
+	assert.Empty(t, evaluation.UnsatisfiedRules)
+	assert.True(t, evaluation.CanProceed)
+
+	// The address rule may apply when the country is unknown, so the applicant cannot proceed
+	evaluation = level.EvaluateWith(documents, EvaluationContext{Now: now})
+	assert.Equal(t, []RuleViolation{
+		{Rule: "uk-address", DocumentTypes: []DocumentType{DocumentUtilityBill, DocumentBankStatement}, Reason: "applicant country is unknown"},
+	}, evaluation.UnsatisfiedRules)
+	assert.False(t, evaluation.CanProceed)
+}
+
+func TestValidateRules(t *testing.T) {
+	valid := LevelRule{Name: "selfie", DocumentTypes: []DocumentType{DocumentSelfie}}
+	assert.NoError(t, VerificationLevel{Rules: []LevelRule{valid}}.ValidateRules())
+
+	tests := map[string]LevelRule{
+		"no name":         {DocumentTypes: []DocumentType{DocumentSelfie}},
+		"no types":        {Name: "empty"},
+		"invalid type":    {Name: "invalid", DocumentTypes: []DocumentType{DocumentType(99)}},
+		"negative age":    {Name: "age", DocumentTypes: []DocumentType{DocumentUtilityBill}, MaxAgeMonths: -1},
+		"empty country":   {Name: "country", DocumentTypes: []DocumentType{DocumentPassport}, Countries: []string{" "}},
+		"duplicate names": valid,
+	}
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, VerificationLevel{Rules: []LevelRule{valid, rule}}.ValidateRules())
+		})
+	}
+}
+
+func TestValidateRulesNamesDocumentTypes(t *testing.T) {
+	err := LevelRule{Name: "invalid", DocumentTypes: []DocumentType{DocumentType(99)}}.Validate()
+	assert.ErrorContains(t, err, "PASSPORT")
+	assert.NotContains(t, err.Error(), "99")
+}
@@ -0,0 +1,57 @@
+package models
+
+import "errors"
+
+// LevelState is the publication state of a verification level version
+type LevelState string
+
+const (
+	LevelStateDraft     LevelState = "draft"     // Being edited, not used for applicants
+	LevelStatePublished LevelState = "published" // Immutable, used by the applicants pinned to it
+)
+
+var (
+	// ErrLevelVersionImmutable is returned when a published verification level version is changed
+	ErrLevelVersionImmutable = errors.New("published verification level versions cannot be changed")
+	// ErrLevelVersionConflict is returned when another request published the level concurrently
+	ErrLevelVersionConflict = errors.New("verification level was published concurrently")
+)
+
+// Editable reports whether the level version may still be changed
+func (l VerificationLevel) Editable() bool {
+	return l.State == LevelStateDraft
+}
+
+// NewDraft returns a draft of the next version of the level, copying its requirements
+func (l VerificationLevel) NewDraft(version int) VerificationLevel {
+	draft := l
+	draft.RequiredDocs = append([]DocumentType(nil), l.RequiredDocs...)
+	draft.OptionalGroups = make([][]DocumentType, len(l.OptionalGroups))
+	for i, group := range l.OptionalGroups {
+		draft.OptionalGroups[i] = append([]DocumentType(nil), group...)
+	}
+	draft.Rules = append([]LevelRule(nil), l.Rules...)
+	draft.Version = version
+	draft.State = LevelStateDraft
+	draft.Current = false
+	draft.PublishedAt = nil
+	return draft
+}
+
+// LevelMigration selects the applicants of a verification level to move to another version
+type LevelMigration struct {
+	ToVersion    int               // Published version to move to, the current one when zero
+	FromVersions []int             // Only applicants pinned to these versions, all older ones when empty
+	Statuses     []ApplicantStatus // Only applicants in these statuses, pending ones when empty
+	ApplicantIDs []string          // Only these applicants, all matching ones when empty
+	DryRun       bool              // Report the applicants that would move without moving them
+	Actor        string            // Who ran the migration, recorded in the audit log
+}
+
+// LevelMigrationResult lists the applicants a migration moved, or would move in a dry run
+type LevelMigrationResult struct {
+	LevelID      string   `json:"level_id"`
+	ToVersion    int      `json:"to_version"`
+	ApplicantIDs []string `json:"applicant_ids"`
+	DryRun       bool     `json:"dry_run"`
+}
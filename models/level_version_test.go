@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelNewDraft(t *testing.T) {
+	publishedAt := time.Now()
+	published := VerificationLevel{
+		LevelID:        "level-1",
+		Name:           "basic",
+		RequiredDocs:   []DocumentType{DocumentPassport},
+		OptionalGroups: [][]DocumentType{{DocumentUtilityBill, DocumentBankStatement}},
+		Rules:          []LevelRule{{Name: "selfie", DocumentTypes: []DocumentType{DocumentSelfie}}},
+		MaxAttempts:    3,
+		Version:        2,
+		State:          LevelStatePublished,
+		Current:        true,
+		PublishedAt:    &publishedAt,
+	}
+	assert.False(t, published.Editable())
+
+	draft := published.NewDraft(3)
+	assert.True(t, draft.Editable())
+	assert.Equal(t, "level-1", draft.LevelID)
+	assert.Equal(t, 3, draft.Version)
+	assert.False(t, draft.Current)
+	assert.Nil(t, draft.PublishedAt)
+	assert.Equal(t, published.RequiredDocs, draft.RequiredDocs)
+
+	// Editing the draft leaves the published version untouched
+	draft.RequiredDocs[0] = DocumentNationalID
+	draft.OptionalGroups[0][0] = DocumentTaxDocument
+	draft.Rules[0].Name = "liveness"
+	assert.Equal(t, DocumentPassport, published.RequiredDocs[0])
+	assert.Equal(t, DocumentUtilityBill, published.OptionalGroups[0][0])
+	assert.Equal(t, "selfie", published.Rules[0].Name)
+}
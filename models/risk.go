@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Risk signal types recorded on applicants
+const (
+	RiskSignalDuplicateDocument = "duplicate_document" // A document's content was also uploaded for another applicant
+	RiskSignalSimilarDocument   = "similar_document"   // A document image is a near-duplicate of another applicant's
+)
+
+// RiskSignal is a fraud indicator detected for an applicant, for review by the client
+type RiskSignal struct {
+	Type                string    `bson:"type" json:"type"`
+	DocumentID          string    `bson:"document_id,omitempty" json:"document_id,omitempty"`                     // Document that raised the signal
+	RelatedApplicantIDs []string  `bson:"related_applicant_ids,omitempty" json:"related_applicant_ids,omitempty"` // Other applicants involved
+	Details             string    `bson:"details" json:"details"`
+	DetectedAt          time.Time `bson:"detected_at" json:"detected_at"`
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// ScanResult is the outcome of a malware scan of an uploaded file
+type ScanResult struct {
+	Clean     bool      `bson:"clean" json:"clean"`
+	Signature string    `bson:"signature,omitempty" json:"signature,omitempty"` // Name of the detected malware, empty when clean
+	Scanner   string    `bson:"scanner" json:"scanner"`                         // Scanner that produced the result, e.g. "clamav"
+	ScannedAt time.Time `bson:"scanned_at" json:"scanned_at"`
+}
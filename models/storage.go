@@ -0,0 +1,9 @@
+package models
+
+// ObjectInfo describes a stored object independently of the storage backend holding it
+type ObjectInfo struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`     // Stored (encrypted) size in bytes, -1 when unknown
+	Metadata    map[string]string `json:"metadata"` // Encryption metadata, e.g. the wrapped DEK
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+)
+
+// MaxVerificationAttempts is the highest MaxAttempts a verification level may allow
+const MaxVerificationAttempts = 5
+
+// VerificationLevelRequest is the body of a request creating a verification level
+type VerificationLevelRequest struct {
+	Name           string           `json:"name"`
+	RequiredDocs   []DocumentType   `json:"required_docs"`
+	OptionalGroups [][]DocumentType `json:"optional_groups"`
+	MaxAttempts    int              `json:"max_attempts"`
+	Rules          []LevelRule      `json:"rules"`
+}
+
+// Level returns the verification level the request describes
+func (r VerificationLevelRequest) Level() VerificationLevel {
+	return VerificationLevel{
+		Name:           strings.TrimSpace(r.Name),
+		RequiredDocs:   r.RequiredDocs,
+		OptionalGroups: r.OptionalGroups,
+		MaxAttempts:    r.MaxAttempts,
+		Rules:          r.Rules,
+	}
+}
+
+// VerificationLevelUpdate is the body of a request updating a verification level. Only the
+// fields it sets are changed; the level's identity, client and versioning cannot be updated.
+type VerificationLevelUpdate struct {
+	Name           *string           `json:"name"`
+	RequiredDocs   *[]DocumentType   `json:"required_docs"`
+	OptionalGroups *[][]DocumentType `json:"optional_groups"`
+	MaxAttempts    *int              `json:"max_attempts"`
+	Rules          *[]LevelRule      `json:"rules"`
+}
+
+// Empty reports whether the update changes nothing
+func (u VerificationLevelUpdate) Empty() bool {
+	return u.Name == nil && u.RequiredDocs == nil && u.OptionalGroups == nil && u.MaxAttempts == nil && u.Rules == nil
+}
+
+// Apply sets the fields of the update on level
+func (u VerificationLevelUpdate) Apply(level *VerificationLevel) {
+	if u.Name != nil {
+		level.Name = strings.TrimSpace(*u.Name)
+	}
+	if u.RequiredDocs != nil {
+		level.RequiredDocs = *u.RequiredDocs
+	}
+	if u.OptionalGroups != nil {
+		level.OptionalGroups = *u.OptionalGroups
+	}
+	if u.MaxAttempts != nil {
+		level.MaxAttempts = *u.MaxAttempts
+	}
+	if u.Rules != nil {
+		level.Rules = *u.Rules
+	}
+}
+
+// Fields returns the stored fields the update sets, keyed by their bson name
+func (u VerificationLevelUpdate) Fields() map[string]interface{} {
+	var level VerificationLevel
+	u.Apply(&level)
+	fields := map[string]interface{}{}
+	if u.Name != nil {
+		fields["name"] = level.Name
+	}
+	if u.RequiredDocs != nil {
+		fields["requiredDocs"] = level.RequiredDocs
+	}
+	if u.OptionalGroups != nil {
+		fields["optionalGroups"] = level.OptionalGroups
+	}
+	if u.MaxAttempts != nil {
+		fields["maxAttempts"] = level.MaxAttempts
+	}
+	if u.Rules != nil {
+		fields["rules"] = level.Rules
+	}
+	return fields
+}
+
+// Validate checks the requirements of the level. Rejections are returned as *errors.FieldError.
+func (l VerificationLevel) Validate() error {
+	if strings.TrimSpace(l.Name) == "" {
+		return apperrors.NewFieldError("name", "name is required")
+	}
+	if l.MaxAttempts < 1 || l.MaxAttempts > MaxVerificationAttempts {
+		return apperrors.NewFieldError("max_attempts", fmt.Sprintf("max_attempts must be between 1 and %d", MaxVerificationAttempts))
+	}
+	for _, docType := range l.RequiredDocs {
+		if _, ok := documentTypeToString[docType]; !ok {
+			return apperrors.NewFieldError("required_docs", "unknown document type, expected one of "+documentTypeNames())
+		}
+	}
+	for i, group := range l.OptionalGroups {
+		if len(group) == 0 {
+			return apperrors.NewFieldError("optional_groups", fmt.Sprintf("optional group %d is empty", i))
+		}
+		for _, docType := range group {
+			if _, ok := documentTypeToString[docType]; !ok {
+				return apperrors.NewFieldError("optional_groups", "unknown document type, expected one of "+documentTypeNames())
+			}
+		}
+	}
+	if err := l.ValidateRules(); err != nil {
+		return apperrors.NewFieldError("rules", err.Error())
+	}
+	return nil
+}
+
+// VerificationLevelResponse is how a verification level version is returned by the API
+type VerificationLevelResponse struct {
+	LevelID        string           `json:"level_id"`
+	Name           string           `json:"name"`
+	Version        int              `json:"version"`
+	State          LevelState       `json:"state"`
+	Current        bool             `json:"current"`
+	RequiredDocs   []DocumentType   `json:"required_docs"`
+	OptionalGroups [][]DocumentType `json:"optional_groups"`
+	MaxAttempts    int              `json:"max_attempts"`
+	Rules          []LevelRule      `json:"rules"`
+	PublishedAt    *time.Time       `json:"published_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	Deleted        bool             `json:"deleted,omitempty"`
+}
+
+// Response returns the API representation of the level. Empty lists are returned as [] rather
+// than null.
+func (l VerificationLevel) Response() VerificationLevelResponse {
+	response := VerificationLevelResponse{
+		LevelID:        l.LevelID,
+		Name:           l.Name,
+		Version:        l.Version,
+		State:          l.State,
+		Current:        l.Current,
+		RequiredDocs:   l.RequiredDocs,
+		OptionalGroups: l.OptionalGroups,
+		MaxAttempts:    l.MaxAttempts,
+		Rules:          l.Rules,
+		PublishedAt:    l.PublishedAt,
+		CreatedAt:      l.CreatedAt,
+		UpdatedAt:      l.UpdatedAt,
+		Deleted:        l.Deleted,
+	}
+	if response.RequiredDocs == nil {
+		response.RequiredDocs = []DocumentType{}
+	}
+	if response.OptionalGroups == nil {
+		response.OptionalGroups = [][]DocumentType{}
+	}
+	if response.Rules == nil {
+		response.Rules = []LevelRule{}
+	}
+	return response
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerificationLevelRequestDecodes(t *testing.T) {
+	var request VerificationLevelRequest
+	err := json.Unmarshal([]byte(`{
+		"name": " basic ",
+		"required_docs": ["SELFIE"],
+		"optional_groups": [["PASSPORT", "NATIONAL_ID"]],
+		"max_attempts": 3,
+		"rules": [{"name": "address", "document_types": ["UTILITY_BILL"], "max_age_months": 3}]
+	}`), &request)
+	assert.NoError(t, err)
+
+	level := request.Level()
+	assert.Equal(t, "basic", level.Name)
+	assert.Equal(t, []DocumentType{DocumentSelfie}, level.RequiredDocs)
+	assert.Equal(t, [][]DocumentType{{DocumentPassport, DocumentNationalID}}, level.OptionalGroups)
+	assert.Equal(t, []DocumentType{DocumentUtilityBill}, level.Rules[0].DocumentTypes)
+	assert.NoError(t, level.Validate())
+}
+
+func TestVerificationLevelValidate(t *testing.T) {
+	valid := VerificationLevel{Name: "basic", RequiredDocs: []DocumentType{DocumentPassport}, MaxAttempts: 3}
+	tests := map[string]struct {
+		change func(*VerificationLevel)
+		field  string
+	}{
+		"no name":            {func(l *VerificationLevel) { l.Name = " " }, "name"},
+		"no attempts":        {func(l *VerificationLevel) { l.MaxAttempts = 0 }, "max_attempts"},
+		"too many attempts":  {func(l *VerificationLevel) { l.MaxAttempts = MaxVerificationAttempts + 1 }, "max_attempts"},
+		"invalid required":   {func(l *VerificationLevel) { l.RequiredDocs = []DocumentType{DocumentType(99)} }, "required_docs"},
+		"empty group":        {func(l *VerificationLevel) { l.OptionalGroups = [][]DocumentType{{}} }, "optional_groups"},
+		"rule without types": {func(l *VerificationLevel) { l.Rules = []LevelRule{{Name: "empty"}} }, "rules"},
+	}
+	assert.NoError(t, valid.Validate())
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			level := valid
+			tt.change(&level)
+			var fieldErr *apperrors.FieldError
+			assert.ErrorAs(t, level.Validate(), &fieldErr)
+			assert.Equal(t, tt.field, fieldErr.Field)
+		})
+	}
+
+	// Document types are named, not numbered
+	level := valid
+	level.OptionalGroups = [][]DocumentType{{DocumentSelfie, DocumentType(99)}}
+	err := level.Validate()
+	assert.ErrorContains(t, err, "PASSPORT")
+	assert.NotContains(t, err.Error(), "99")
+}
+
+func TestVerificationLevelUpdate(t *testing.T) {
+	var update VerificationLevelUpdate
+	assert.NoError(t, json.Unmarshal([]byte(`{"required_docs": ["PASSPORT"], "max_attempts": 2}`), &update))
+	assert.False(t, update.Empty())
+	assert.Equal(t, map[string]interface{}{
+		"requiredDocs": []DocumentType{DocumentPassport},
+		"maxAttempts":  2,
+	}, update.Fields())
+
+	level := VerificationLevel{Name: "basic", RequiredDocs: []DocumentType{DocumentSelfie}, MaxAttempts: 5}
+	update.Apply(&level)
+	assert.Equal(t, "basic", level.Name)
+	assert.Equal(t, []DocumentType{DocumentPassport}, level.RequiredDocs)
+	assert.Equal(t, 2, level.MaxAttempts)
+
+	assert.True(t, VerificationLevelUpdate{}.Empty())
+}
+
+func TestVerificationLevelResponse(t *testing.T) {
+	data, err := json.Marshal(VerificationLevel{LevelID: "level-1", Name: "basic", Version: 1, State: LevelStatePublished}.Response())
+	assert.NoError(t, err)
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, []interface{}{}, decoded["required_docs"])
+	assert.Equal(t, []interface{}{}, decoded["optional_groups"])
+	assert.Equal(t, []interface{}{}, decoded["rules"])
+	assert.Equal(t, "published", decoded["state"])
+	assert.NotContains(t, decoded, "client_id")
+
+	data, err = json.Marshal(VerificationLevel{RequiredDocs: []DocumentType{DocumentPassport}, OptionalGroups: [][]DocumentType{{DocumentSelfie}}}.Response())
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"required_docs":["PASSPORT"]`)
+	assert.Contains(t, string(data), `"optional_groups":[["SELFIE"]]`)
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// WebhookEvent is the payload posted to a client's webhook when one of its applicants changes
+// status
+type WebhookEvent struct {
+	Type              EventType `json:"type"`
+	ApplicantID       string    `json:"applicant_id"`
+	ExternalUserID    string    `json:"external_user_id,omitempty"`
+	ClientID          string    `json:"client_id"`
+	VerificationLevel string    `json:"verification_level"`
+	LevelVersion      int       `json:"level_version,omitempty"` // Version of the level the applicant is pinned to
+	Status            string    `json:"status"`                  // Status the applicant moved to
+	PreviousStatus    string    `json:"previous_status"`         // Status the applicant moved from
+	Reason            string    `json:"reason,omitempty"`
+	Attempts          int       `json:"attempts"`
+	CreatedAt         time.Time `json:"created_at"`
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+const (
+	// ScannerClamAV is recorded as the scanner of results produced by ClamAVScanner
+	ScannerClamAV = "clamav"
+
+	defaultClamAVTimeout = 60 * time.Second
+	// clamAVChunkSize is the size of the INSTREAM chunks sent to clamd
+	clamAVChunkSize = 64 * 1024
+)
+
+// ClamAVError is returned when clamd answers a scan with an error, e.g. because the stream
+// exceeded its StreamMaxLength
+type ClamAVError struct {
+	Response string
+}
+
+func (e *ClamAVError) Error() string {
+	return fmt.Sprintf("clamd scan failed: %s", e.Response)
+}
+
+// ClamAVScanner scans content with a clamd daemon over its INSTREAM command. Address is
+// "host:port" for TCP or the path of clamd's unix socket.
+type ClamAVScanner struct {
+	Address string
+	Timeout time.Duration // Deadline of a whole scan, defaults to 60s
+	Dialer  net.Dialer
+}
+
+// NewClamAVScanner creates a scanner for the clamd daemon at address
+func NewClamAVScanner(address string) *ClamAVScanner {
+	return &ClamAVScanner{Address: address, Timeout: defaultClamAVTimeout}
+}
+
+// NewClamAVScannerFromConfig creates a scanner from the scanner config, or returns nil when no
+// clamd address is configured
+func NewClamAVScannerFromConfig(cfg models.ScannerConfig) *ClamAVScanner {
+	if cfg.ClamAVAddress == "" {
+		return nil
+	}
+	scanner := NewClamAVScanner(cfg.ClamAVAddress)
+	if cfg.TimeoutSecs > 0 {
+		scanner.Timeout = time.Duration(cfg.TimeoutSecs) * time.Second
+	}
+	return scanner
+}
+
+// Ping checks that clamd is reachable and responding
+func (s *ClamAVScanner) Ping(ctx context.Context) error {
+	response, err := s.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if response != "PONG" {
+		return &ClamAVError{Response: response}
+	}
+	return nil
+}
+
+// Scan streams content to clamd and returns its verdict
+func (s *ClamAVScanner) Scan(ctx context.Context, content io.Reader) (models.ScanResult, error) {
+	logger := zaplogger.GetLogger()
+	response, err := s.command(ctx, "INSTREAM", content)
+	if err != nil {
+		logger.Error("failed to scan content with clamd", zap.String("address", s.Address), zap.Error(err))
+		return models.ScanResult{}, err
+	}
+
+	// Responses are "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	result := models.ScanResult{Scanner: ScannerClamAV, ScannedAt: time.Now()}
+	verdict := strings.TrimPrefix(response, "stream: ")
+	switch {
+	case verdict == "OK":
+		result.Clean = true
+	case strings.HasSuffix(verdict, " FOUND"):
+		result.Signature = strings.TrimSuffix(verdict, " FOUND")
+	default:
+		return models.ScanResult{}, &ClamAVError{Response: response}
+	}
+	return result, nil
+}
+
+// command sends a null-terminated command to clamd, followed by body in INSTREAM chunks when
+// given, and returns the response
+func (s *ClamAVScanner) command(ctx context.Context, command string, body io.Reader) (string, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultClamAVTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network := "tcp"
+	if strings.HasPrefix(s.Address, "/") {
+		network = "unix"
+	}
+	conn, err := s.Dialer.DialContext(ctx, network, s.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	writer := bufio.NewWriterSize(conn, clamAVChunkSize+4)
+	if _, err := writer.WriteString("z" + command + "\x00"); err != nil {
+		return "", fmt.Errorf("failed to send clamd command: %w", err)
+	}
+	if body != nil {
+		if err := writeClamAVStream(writer, body); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send clamd command: %w", err)
+	}
+
+	response, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && response != "") {
+		return "", fmt.Errorf("failed to read clamd response: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(response, "\x00")), nil
+}
+
+// writeClamAVStream sends body as length-prefixed chunks terminated by an empty chunk
+func writeClamAVStream(writer io.Writer, body io.Reader) error {
+	chunk := make([]byte, clamAVChunkSize)
+	length := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			if _, writeErr := writer.Write(length); writeErr != nil {
+				return fmt.Errorf("failed to stream content to clamd: %w", writeErr)
+			}
+			if _, writeErr := writer.Write(chunk[:n]); writeErr != nil {
+				return fmt.Errorf("failed to stream content to clamd: %w", writeErr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read content to scan: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(length, 0)
+	if _, err := writer.Write(length); err != nil {
+		return fmt.Errorf("failed to stream content to clamd: %w", err)
+	}
+	return nil
+}
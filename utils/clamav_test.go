@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eicar is the standard antivirus test string
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers clamd's zPING and zINSTREAM commands, flagging streams containing eicar
+func fakeClamd(t *testing.T, maxStream int) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil {
+					return
+				}
+				switch command {
+				case "zPING\x00":
+					conn.Write([]byte("PONG\x00"))
+				case "zINSTREAM\x00":
+					var stream bytes.Buffer
+					length := make([]byte, 4)
+					for {
+						if _, err := io.ReadFull(reader, length); err != nil {
+							return
+						}
+						size := binary.BigEndian.Uint32(length)
+						if size == 0 {
+							break
+						}
+						if _, err := io.CopyN(&stream, reader, int64(size)); err != nil {
+							return
+						}
+					}
+					switch {
+					case stream.Len() > maxStream:
+						conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					case strings.Contains(stream.String(), eicar):
+						conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					default:
+						conn.Write([]byte("stream: OK\x00"))
+					}
+				default:
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamAVScanner(t *testing.T) {
+	scanner := NewClamAVScanner(fakeClamd(t, 1<<20))
+	ctx := context.Background()
+	assert.NoError(t, scanner.Ping(ctx))
+
+	// Spans several INSTREAM chunks
+	result, err := scanner.Scan(ctx, bytes.NewReader(bytes.Repeat([]byte("passport "), 20000)))
+	assert.NoError(t, err)
+	assert.True(t, result.Clean)
+	assert.Equal(t, ScannerClamAV, result.Scanner)
+	assert.False(t, result.ScannedAt.IsZero())
+
+	result, err = scanner.Scan(ctx, strings.NewReader(eicar))
+	assert.NoError(t, err)
+	assert.False(t, result.Clean)
+	assert.Equal(t, "Eicar-Signature", result.Signature)
+}
+
+func TestClamAVScannerErrors(t *testing.T) {
+	scanner := NewClamAVScanner(fakeClamd(t, 1024))
+	_, err := scanner.Scan(context.Background(), bytes.NewReader(make([]byte, 4096)))
+	var clamErr *ClamAVError
+	assert.ErrorAs(t, err, &clamErr)
+	assert.Contains(t, clamErr.Response, "size limit exceeded")
+
+	// An unreachable daemon is an error, never a clean result
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+	result, err := NewClamAVScanner(address).Scan(context.Background(), strings.NewReader("passport"))
+	assert.Error(t, err)
+	assert.False(t, result.Clean)
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// ContentHasher computes the SHA-256 of the plaintext read through it, so a file is hashed while
+// it is encrypted and uploaded rather than read twice
+type ContentHasher struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+// NewContentHasher returns a reader hashing everything read from r
+func NewContentHasher(r io.Reader) *ContentHasher {
+	return &ContentHasher{r: r, hash: sha256.New()}
+}
+
+func (h *ContentHasher) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Hash returns the hex SHA-256 of the content read so far, the content hash once r is drained
+func (h *ContentHasher) Hash() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// Size returns the number of bytes read so far
+func (h *ContentHasher) Size() int64 {
+	return h.size
+}
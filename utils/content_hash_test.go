@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHasherHashesUploadedPlaintext(t *testing.T) {
+	client, err := NewLocalKMSClient(map[string][]byte{"dev-key": []byte("0123456789abcdef0123456789abcdef")})
+	assert.NoError(t, err)
+	kmsUploader := &KMSUploader{Client: client, KeyID: "dev-key"}
+	uploader, err := NewLocalUploader(t.TempDir())
+	assert.NoError(t, err)
+
+	content := bytes.Repeat([]byte("passport "), 10000)
+	hasher := NewContentHasher(bytes.NewReader(content))
+	_, err = uploader.UploadFile(context.Background(), hasher, "passport.jpg", MimeTypeJPEG, kmsUploader)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	assert.Equal(t, hex.EncodeToString(sum[:]), hasher.Hash())
+	assert.Equal(t, int64(len(content)), hasher.Size())
+}
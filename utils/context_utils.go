@@ -23,3 +23,14 @@ func GetClientIDFromContext(c *gin.Context) (string, error) {
 	}
 	return clientIDStr, nil
 }
+
+// GetActorFromContext returns who is performing the request: the cockpit user when authenticated
+// with a JWT, otherwise the client owning the API key
+func GetActorFromContext(c *gin.Context) (string, error) {
+	if userID, ok := c.Get("cockpit_user_id"); ok {
+		if userIDStr, ok := userID.(string); ok && userIDStr != "" {
+			return userIDStr, nil
+		}
+	}
+	return GetClientIDFromContext(c)
+}
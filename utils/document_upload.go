@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+)
+
+// DocumentFile is a file uploaded by a client for a document
+type DocumentFile struct {
+	Content      io.Reader
+	Size         int64  // Size announced by the client, -1 if unknown
+	DeclaredType string // Content type announced by the client, may be empty
+	ObjectKey    string // Key to store the encrypted file under
+}
+
+// Upload validates a file uploaded for document against the rule of its document type, strips
+// the metadata of images and applies their orientation (see NormalizeImage), then encrypts and
+// stores it with uploader. It records the object key, size and hashes on document and sets its
+// status to DocumentUploadPending, the document is neither served nor counted until its malware
+// scan marks it uploaded. The caller still has to save it. Rejections are returned as
+// *errors.FieldError and nothing is stored.
+func (r UploadRules) Upload(ctx context.Context, uploader interfaces.Uploader, file DocumentFile, document *models.Document, kmsUploader interfaces.KMSUploader) error {
+	upload, err := r.Validate(file.Content, file.Size, document.DocumentType, file.DeclaredType)
+	if err != nil {
+		return err
+	}
+
+	content := upload.Reader
+	if upload.ContentType == MimeTypeJPEG || upload.ContentType == MimeTypePNG {
+		// Images are stored without their metadata, which may hold GPS coordinates, and upright
+		normalized, err := NormalizeImage(upload.Reader, upload.ContentType, NormalizeOptions{})
+		if err != nil {
+			var fieldErr *apperrors.FieldError
+			if errors.As(err, &fieldErr) {
+				return fieldErr
+			}
+			return apperrors.NewFieldError("file", "image is corrupted or truncated")
+		}
+		perceptualHash, err := ImagePerceptualHash(normalized.Data)
+		if err != nil {
+			return apperrors.NewFieldError("file", "image is corrupted or truncated")
+		}
+		content = bytes.NewReader(normalized.Data)
+		document.OriginalHash = normalized.OriginalHash
+		document.PerceptualHash = perceptualHash
+	}
+
+	// Hash the plaintext as it is encrypted, the content hash is what duplicate detection compares
+	hasher := NewContentHasher(content)
+	objectKey, err := uploader.UploadFile(ctx, hasher, file.ObjectKey, upload.ContentType, kmsUploader)
+	if err != nil {
+		return err
+	}
+	document.ObjectKey = objectKey
+	document.FileSize = hasher.Size()
+	document.ContentHash = hasher.Hash()
+	document.Status = models.DocumentUploadPending
+	return nil
+}
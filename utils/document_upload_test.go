@@ -0,0 +1,121 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestUploadRulesUpload(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	uploader, err := utils.NewLocalUploader(t.TempDir())
+	assert.NoError(t, err)
+
+	content := encodePNG(t, image.NewGray(image.Rect(0, 0, 800, 600)))
+	document := models.Document{DocumentID: "doc-1", DocumentType: models.DocumentPassport}
+	err = utils.DefaultUploadRules.Upload(context.Background(), uploader, utils.DocumentFile{
+		Content:      bytes.NewReader(content),
+		Size:         int64(len(content)),
+		DeclaredType: "image/png",
+		ObjectKey:    "applicant-1/doc-1",
+	}, &document, kmsUploader)
+	assert.NoError(t, err)
+	assert.Equal(t, "applicant-1/doc-1", document.ObjectKey)
+	assert.Equal(t, models.DocumentUploadPending, document.Status)
+
+	reader, err := uploader.DownloadDecrypted(context.Background(), document.ObjectKey, kmsUploader)
+	assert.NoError(t, err)
+	stored, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, stored)
+
+	// Images are normalized before they are stored
+	originalHash := sha256.Sum256(content)
+	storedHash := sha256.Sum256(stored)
+	assert.Equal(t, hex.EncodeToString(originalHash[:]), document.OriginalHash)
+	assert.Equal(t, hex.EncodeToString(storedHash[:]), document.ContentHash)
+	assert.Equal(t, int64(len(stored)), document.FileSize)
+
+	perceptualHash, err := utils.ImagePerceptualHash(stored)
+	assert.NoError(t, err)
+	assert.Equal(t, perceptualHash, document.PerceptualHash)
+}
+
+func TestUploadRulesUploadStripsImageMetadata(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	uploader, err := utils.NewLocalUploader(t.TempDir())
+	assert.NoError(t, err)
+
+	plain := encodePNG(t, image.NewGray(image.Rect(0, 0, 800, 600)))
+	content := withPNGTextChunk(plain, "Comment", "taken at 51.5007N 0.1246W")
+	document := models.Document{DocumentID: "doc-1", DocumentType: models.DocumentPassport}
+	err = utils.DefaultUploadRules.Upload(context.Background(), uploader, utils.DocumentFile{
+		Content:   bytes.NewReader(content),
+		Size:      int64(len(content)),
+		ObjectKey: "applicant-1/doc-1",
+	}, &document, kmsUploader)
+	assert.NoError(t, err)
+	assert.NotEqual(t, document.OriginalHash, document.ContentHash)
+
+	reader, err := uploader.DownloadDecrypted(context.Background(), document.ObjectKey, kmsUploader)
+	assert.NoError(t, err)
+	stored, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stored), "51.5007N")
+}
+
+// withPNGTextChunk inserts a tEXt chunk after the IHDR chunk of a PNG
+func withPNGTextChunk(data []byte, keyword, text string) []byte {
+	payload := append([]byte(keyword+"\x00"), text...)
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	ihdrEnd := 8 + 8 + 13 + 4
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestUploadRulesUploadRejectsInvalidFile(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	uploader, err := utils.NewLocalUploader(t.TempDir())
+	assert.NoError(t, err)
+
+	document := models.Document{DocumentID: "doc-1", DocumentType: models.DocumentPassport}
+	err = utils.DefaultUploadRules.Upload(context.Background(), uploader, utils.DocumentFile{
+		Content:   bytes.NewReader([]byte("#!/bin/sh\nrm -rf /\n")),
+		Size:      -1,
+		ObjectKey: "applicant-1/doc-1",
+	}, &document, kmsUploader)
+	var fieldErr *apperrors.FieldError
+	assert.ErrorAs(t, err, &fieldErr)
+	assert.Empty(t, document.ObjectKey)
+	assert.Empty(t, document.ContentHash)
+
+	// Nothing was stored
+	_, _, err = uploader.DownloadFile(context.Background(), "applicant-1/doc-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+// MissingMetadataError is returned when an object lacks the metadata needed to decrypt it, e.g.
+// because it was not uploaded through UploadFile or its metadata was stripped
+type MissingMetadataError struct {
+	ObjectKey string
+	Field     string
+}
+
+func (e *MissingMetadataError) Error() string {
+	return fmt.Sprintf("object %s has no usable %q metadata", e.ObjectKey, e.Field)
+}
+
+// TamperedObjectError is returned when an object fails authentication: its content, metadata or
+// key were modified, it was truncated, or it was copied from another object key
+type TamperedObjectError struct {
+	ObjectKey string
+	Err       error
+}
+
+func (e *TamperedObjectError) Error() string {
+	return fmt.Sprintf("object %s failed authentication: %v", e.ObjectKey, e.Err)
+}
+
+func (e *TamperedObjectError) Unwrap() error {
+	return e.Err
+}
+
+// decryptObject unwraps the DEK recorded in an object's metadata and returns a reader of the
+// plaintext body. Streamed objects are decrypted as they are read, each segment being
+// authenticated before it is returned, so a tampered stream fails part way with a
+// TamperedObjectError. Objects sealed whole are authenticated before anything is returned.
+func decryptObject(ctx context.Context, objectKey string, metadata map[string]string, body io.ReadCloser, kmsUploader interfaces.KMSUploader) (io.ReadCloser, error) {
+	logger := zaplogger.GetLogger()
+
+	format := 0
+	if value, ok := metadata["format-version"]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, &MissingMetadataError{ObjectKey: objectKey, Field: "format-version"}
+		}
+		format = parsed
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(metadata["encrypted-key"])
+	if err != nil || len(encryptedKey) == 0 {
+		return nil, &MissingMetadataError{ObjectKey: objectKey, Field: "encrypted-key"}
+	}
+	plaintextKey, err := kmsUploader.DecryptData(ctx, encryptedKey)
+	if err != nil {
+		logger.Error("failed to decrypt data key of object", zap.String("objectKey", objectKey), zap.Error(err))
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	additionalData := FileContext(objectKey).AssociatedData()
+	switch format {
+	case FileFormatStream:
+		reader, err := NewDecryptingReader(body, plaintextKey, additionalData)
+		if err != nil {
+			return nil, &TamperedObjectError{ObjectKey: objectKey, Err: err}
+		}
+		return &decryptedObject{Reader: reader, body: body, objectKey: objectKey}, nil
+	case 0, FileFormatSealed:
+		if format == 0 {
+			// Objects uploaded before ciphertexts were bound to their object key
+			additionalData = nil
+		}
+		nonce, err := base64.StdEncoding.DecodeString(metadata["nonce"])
+		if err != nil || len(nonce) != gcmNonceSize {
+			return nil, &MissingMetadataError{ObjectKey: objectKey, Field: "nonce"}
+		}
+		ciphertext, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object body: %w", err)
+		}
+		plaintext, err := openGCM(plaintextKey, nonce, ciphertext, additionalData)
+		if err != nil {
+			return nil, &TamperedObjectError{ObjectKey: objectKey, Err: err}
+		}
+		return &decryptedObject{Reader: bytes.NewReader(plaintext), body: body, objectKey: objectKey}, nil
+	default:
+		return nil, fmt.Errorf("object %s has unsupported format version %d", objectKey, format)
+	}
+}
+
+// decryptedObject reads plaintext and closes the underlying object body
+type decryptedObject struct {
+	io.Reader
+	body      io.Closer
+	objectKey string
+}
+
+func (o *decryptedObject) Read(p []byte) (int, error) {
+	n, err := o.Reader.Read(p)
+	if errors.Is(err, ErrStreamCorrupted) || errors.Is(err, ErrStreamTruncated) {
+		return n, &TamperedObjectError{ObjectKey: o.objectKey, Err: err}
+	}
+	return n, err
+}
+
+func (o *decryptedObject) Close() error {
+	return o.body.Close()
+}
@@ -4,63 +4,148 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/json"
+	"fmt"
 	"io"
 
 	"github.com/rachel-lawrie/verus_backend_core/models"
 )
 
-// EncryptField encrypts a given plaintext using AES-GCM
-func EncryptField(plaintext string, key []byte) (models.EncryptedField, error) {
+// gcmNonceSize is the standard AES-GCM nonce size in bytes
+const gcmNonceSize = 12
+
+// EncryptionContext identifies what a ciphertext belongs to (e.g. client_id, applicant_id and field).
+// It is bound to the ciphertext as AEAD associated data, so a value copied onto another record or
+// field fails to decrypt.
+type EncryptionContext map[string]string
+
+// ApplicantFieldContext returns the encryption context of a field of an applicant record
+func ApplicantFieldContext(clientID, applicantID, field string) EncryptionContext {
+	return EncryptionContext{"client_id": clientID, "applicant_id": applicantID, "field": field}
+}
+
+// FileContext returns the encryption context of an uploaded file, bound to its object key.
+// Files uploaded in FileFormatSealed or FileFormatStream use it as associated data.
+func FileContext(objectKey string) EncryptionContext {
+	return EncryptionContext{"object_key": objectKey}
+}
+
+// WithField returns a copy of the context bound to another field of the same record
+func (ec EncryptionContext) WithField(field string) EncryptionContext {
+	copied := make(EncryptionContext, len(ec)+1)
+	for k, v := range ec {
+		copied[k] = v
+	}
+	copied["field"] = field
+	return copied
+}
+
+// AssociatedData returns the canonical encoding of the context used as AEAD associated data
+func (ec EncryptionContext) AssociatedData() []byte {
+	// encoding/json sorts map keys, which makes the encoding canonical
+	aad, _ := json.Marshal(map[string]interface{}{"v": models.EncryptedFieldVersionBound, "ctx": map[string]string(ec)})
+	return aad
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return models.EncryptedField{}, err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	aesGCM, err := cipher.NewGCM(block)
+func sealGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, []byte, error) {
+	aesGCM, err := newGCM(key)
 	if err != nil {
-		return models.EncryptedField{}, err
+		return nil, nil, err
 	}
 
 	nonce := make([]byte, aesGCM.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return aesGCM.Seal(nil, nonce, plaintext, additionalData), nonce, nil
+}
+
+func openGCM(key []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCM.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// EncryptField encrypts a given plaintext using AES-GCM without associated data.
+//
+// Deprecated: use EncryptFieldWithContext so the ciphertext is bound to the record it belongs to.
+func EncryptField(plaintext string, key []byte) (models.EncryptedField, error) {
+	ciphertext, nonce, err := sealGCM(key, []byte(plaintext), nil)
+	if err != nil {
 		return models.EncryptedField{}, err
 	}
+	return models.EncryptedField{
+		Ciphertext: ciphertext,
+		Nonce:      nonce,
+	}, nil
+}
 
-	ciphertext := aesGCM.Seal(nil, nonce, []byte(plaintext), nil)
+// EncryptFieldWithContext encrypts a given plaintext using AES-GCM, binding it to ec
+func EncryptFieldWithContext(plaintext string, key []byte, ec EncryptionContext) (models.EncryptedField, error) {
+	ciphertext, nonce, err := sealGCM(key, []byte(plaintext), ec.AssociatedData())
+	if err != nil {
+		return models.EncryptedField{}, err
+	}
 	return models.EncryptedField{
 		Ciphertext: ciphertext,
 		Nonce:      nonce,
+		Version:    models.EncryptedFieldVersionBound,
 	}, nil
 }
 
-// EncryptAddress encrypts the address fields
+// EncryptAddress encrypts the address fields without associated data.
+//
+// Deprecated: use EncryptAddressWithContext.
 func EncryptAddress(address models.RawAddress, key []byte) (models.EncryptedAddress, error) {
-	line1, err := EncryptField(address.Line1, key)
+	return encryptAddress(address, func(value string, _ string) (models.EncryptedField, error) {
+		return EncryptField(value, key)
+	})
+}
+
+// EncryptAddressWithContext encrypts the address fields, binding each to ec and its own field name
+func EncryptAddressWithContext(address models.RawAddress, key []byte, ec EncryptionContext) (models.EncryptedAddress, error) {
+	return encryptAddress(address, func(value string, field string) (models.EncryptedField, error) {
+		return EncryptFieldWithContext(value, key, ec.WithField(field))
+	})
+}
+
+func encryptAddress(address models.RawAddress, encrypt func(value string, field string) (models.EncryptedField, error)) (models.EncryptedAddress, error) {
+	line1, err := encrypt(address.Line1, "address.line1")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
 
-	line2, err := EncryptField(address.Line2, key)
+	line2, err := encrypt(address.Line2, "address.line2")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
 
-	city, err := EncryptField(address.City, key)
+	city, err := encrypt(address.City, "address.city")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
 
-	region, err := EncryptField(address.Region, key)
+	region, err := encrypt(address.Region, "address.region")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
 
-	postalCode, err := EncryptField(address.PostalCode, key)
+	postalCode, err := encrypt(address.PostalCode, "address.postal_code")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
 
-	country, err := EncryptField(address.Country, key)
+	country, err := encrypt(address.Country, "address.country")
 	if err != nil {
 		return models.EncryptedAddress{}, err
 	}
@@ -75,19 +160,34 @@ func EncryptAddress(address models.RawAddress, key []byte) (models.EncryptedAddr
 	}, nil
 }
 
-// DecryptField decrypts a given ciphertext using AES-GCM
+// DecryptField decrypts a given ciphertext using AES-GCM. Only unbound (legacy) ciphertexts can be
+// decrypted this way, bound ones need DecryptFieldWithContext.
 func DecryptField(encryptedField models.EncryptedField, key []byte) (string, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
+	if encryptedField.Version != models.EncryptedFieldVersionUnbound {
+		return "", fmt.Errorf("ciphertext version %d requires an encryption context", encryptedField.Version)
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	plaintext, err := openGCM(key, encryptedField.Nonce, encryptedField.Ciphertext, nil)
 	if err != nil {
 		return "", err
 	}
 
-	plaintext, err := aesGCM.Open(nil, encryptedField.Nonce, encryptedField.Ciphertext, nil)
+	return string(plaintext), nil
+}
+
+// DecryptFieldWithContext decrypts a given ciphertext using AES-GCM, verifying it is bound to ec.
+// Legacy unbound ciphertexts are still decrypted, see UpgradeField to bind them.
+func DecryptFieldWithContext(encryptedField models.EncryptedField, key []byte, ec EncryptionContext) (string, error) {
+	var additionalData []byte
+	switch encryptedField.Version {
+	case models.EncryptedFieldVersionUnbound:
+	case models.EncryptedFieldVersionBound:
+		additionalData = ec.AssociatedData()
+	default:
+		return "", fmt.Errorf("unsupported ciphertext version %d", encryptedField.Version)
+	}
+
+	plaintext, err := openGCM(key, encryptedField.Nonce, encryptedField.Ciphertext, additionalData)
 	if err != nil {
 		return "", err
 	}
@@ -95,34 +195,65 @@ func DecryptField(encryptedField models.EncryptedField, key []byte) (string, err
 	return string(plaintext), nil
 }
 
-// DecryptAddress decrypts the address fields
+// UpgradeField re-encrypts a legacy unbound ciphertext so it is bound to ec. It reports whether the
+// field changed, bound ciphertexts are returned as they are.
+func UpgradeField(encryptedField models.EncryptedField, key []byte, ec EncryptionContext) (models.EncryptedField, bool, error) {
+	if encryptedField.Version != models.EncryptedFieldVersionUnbound || len(encryptedField.Ciphertext) == 0 {
+		return encryptedField, false, nil
+	}
+
+	plaintext, err := DecryptField(encryptedField, key)
+	if err != nil {
+		return encryptedField, false, err
+	}
+	upgraded, err := EncryptFieldWithContext(plaintext, key, ec)
+	if err != nil {
+		return encryptedField, false, err
+	}
+	return upgraded, true, nil
+}
+
+// DecryptAddress decrypts unbound (legacy) address fields
 func DecryptAddress(encryptedAddress models.EncryptedAddress, key []byte) (models.RawAddress, error) {
-	line1, err := DecryptField(encryptedAddress.Line1, key)
+	return decryptAddress(encryptedAddress, func(field models.EncryptedField, _ string) (string, error) {
+		return DecryptField(field, key)
+	})
+}
+
+// DecryptAddressWithContext decrypts the address fields, verifying each is bound to ec and its field name
+func DecryptAddressWithContext(encryptedAddress models.EncryptedAddress, key []byte, ec EncryptionContext) (models.RawAddress, error) {
+	return decryptAddress(encryptedAddress, func(field models.EncryptedField, name string) (string, error) {
+		return DecryptFieldWithContext(field, key, ec.WithField(name))
+	})
+}
+
+func decryptAddress(encryptedAddress models.EncryptedAddress, decrypt func(field models.EncryptedField, name string) (string, error)) (models.RawAddress, error) {
+	line1, err := decrypt(encryptedAddress.Line1, "address.line1")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
 
-	line2, err := DecryptField(encryptedAddress.Line2, key)
+	line2, err := decrypt(encryptedAddress.Line2, "address.line2")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
 
-	city, err := DecryptField(encryptedAddress.City, key)
+	city, err := decrypt(encryptedAddress.City, "address.city")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
 
-	region, err := DecryptField(encryptedAddress.Region, key)
+	region, err := decrypt(encryptedAddress.Region, "address.region")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
 
-	postalCode, err := DecryptField(encryptedAddress.PostalCode, key)
+	postalCode, err := decrypt(encryptedAddress.PostalCode, "address.postal_code")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
 
-	country, err := DecryptField(encryptedAddress.Country, key)
+	country, err := decrypt(encryptedAddress.Country, "address.country")
 	if err != nil {
 		return models.RawAddress{}, err
 	}
@@ -136,3 +267,39 @@ func DecryptAddress(encryptedAddress models.EncryptedAddress, key []byte) (model
 		Country:    country,
 	}, nil
 }
+
+// UpgradeEncryptedData binds the legacy unbound DOB and address ciphertexts of a record to ec,
+// reporting whether anything changed. The DEK and already bound fields are left untouched.
+func UpgradeEncryptedData(data *models.EncryptedData, key []byte, ec EncryptionContext) (bool, error) {
+	changed := false
+	upgrade := func(field *models.EncryptedField, name string) error {
+		upgraded, ok, err := UpgradeField(*field, key, ec.WithField(name))
+		if err != nil {
+			return fmt.Errorf("failed to upgrade %s: %w", name, err)
+		}
+		if ok {
+			*field = upgraded
+			changed = true
+		}
+		return nil
+	}
+
+	fields := []struct {
+		field *models.EncryptedField
+		name  string
+	}{
+		{&data.DOB, "dob"},
+		{&data.Address.Line1, "address.line1"},
+		{&data.Address.Line2, "address.line2"},
+		{&data.Address.City, "address.city"},
+		{&data.Address.Region, "address.region"},
+		{&data.Address.PostalCode, "address.postal_code"},
+		{&data.Address.Country, "address.country"},
+	}
+	for _, f := range fields {
+		if err := upgrade(f.field, f.name); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
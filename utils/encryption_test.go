@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFieldKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptFieldWithContextRoundTrip(t *testing.T) {
+	ec := ApplicantFieldContext("client123", "applicant123", "dob")
+
+	encrypted, err := EncryptFieldWithContext("1990-01-01", testFieldKey, ec)
+	assert.NoError(t, err)
+	assert.Equal(t, models.EncryptedFieldVersionBound, encrypted.Version)
+
+	plaintext, err := DecryptFieldWithContext(encrypted, testFieldKey, ec)
+	assert.NoError(t, err)
+	assert.Equal(t, "1990-01-01", plaintext)
+
+	// Bound ciphertexts cannot be decrypted without their context
+	_, err = DecryptField(encrypted, testFieldKey)
+	assert.Error(t, err)
+}
+
+func TestDecryptFieldWithContextRejectsOtherContext(t *testing.T) {
+	ec := ApplicantFieldContext("client123", "applicant123", "dob")
+	encrypted, err := EncryptFieldWithContext("1990-01-01", testFieldKey, ec)
+	assert.NoError(t, err)
+
+	_, err = DecryptFieldWithContext(encrypted, testFieldKey, ApplicantFieldContext("client123", "applicant456", "dob"))
+	assert.Error(t, err)
+	_, err = DecryptFieldWithContext(encrypted, testFieldKey, ec.WithField("address.line1"))
+	assert.Error(t, err)
+	_, err = DecryptFieldWithContext(encrypted, testFieldKey, ApplicantFieldContext("client456", "applicant123", "dob"))
+	assert.Error(t, err)
+}
+
+func TestDecryptFieldWithContextReadsUnboundFields(t *testing.T) {
+	legacy, err := EncryptField("1990-01-01", testFieldKey)
+	assert.NoError(t, err)
+	assert.Equal(t, models.EncryptedFieldVersionUnbound, legacy.Version)
+
+	plaintext, err := DecryptFieldWithContext(legacy, testFieldKey, ApplicantFieldContext("client123", "applicant123", "dob"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1990-01-01", plaintext)
+}
+
+func TestUpgradeEncryptedData(t *testing.T) {
+	ec := ApplicantFieldContext("client123", "applicant123", "")
+	dob, err := EncryptField("1990-01-01", testFieldKey)
+	assert.NoError(t, err)
+	address, err := EncryptAddress(models.RawAddress{Line1: "1 Main St", City: "London", Country: "GB"}, testFieldKey)
+	assert.NoError(t, err)
+	data := models.EncryptedData{DOB: dob, Address: address}
+
+	changed, err := UpgradeEncryptedData(&data, testFieldKey, ec)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, models.EncryptedFieldVersionBound, data.DOB.Version)
+
+	plaintext, err := DecryptFieldWithContext(data.DOB, testFieldKey, ec.WithField("dob"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1990-01-01", plaintext)
+	raw, err := DecryptAddressWithContext(data.Address, testFieldKey, ec)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 Main St", raw.Line1)
+	assert.Equal(t, "London", raw.City)
+
+	// Upgrading again is a no-op
+	changed, err = UpgradeEncryptedData(&data, testFieldKey, ec)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+}
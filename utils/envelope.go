@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+// defaultDEKCacheTTL is how long unwrapped data keys stay in memory when no TTL is configured
+const defaultDEKCacheTTL = 5 * time.Minute
+
+// ErrDataKeyDestroyed matches a DataKeyDestroyedError with errors.Is
+var ErrDataKeyDestroyed = errors.New("data key destroyed")
+
+// ErrKeyVersionBehind is returned by Rewrap when the KMS wrapped the key with an older version than
+// the configured KeyVersion, e.g. because the Vault Transit key was not rotated yet
+var ErrKeyVersionBehind = errors.New("kms key version is older than the configured key version")
+
+// DataKeyDestroyedError is returned when data is decrypted after its data key was destroyed by an
+// erasure request. The data is unrecoverable, callers should treat the record as erased.
+type DataKeyDestroyedError struct {
+	DestroyedAt time.Time
+}
+
+func (e *DataKeyDestroyedError) Error() string {
+	return fmt.Sprintf("data key destroyed at %s, record was erased", e.DestroyedAt.UTC().Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrDataKeyDestroyed
+func (e *DataKeyDestroyedError) Is(target error) bool {
+	return target == ErrDataKeyDestroyed
+}
+
+// EnvelopeService wraps data keys under a KMS key, records which key and version wrapped them and
+// keeps unwrapped keys in memory for a bounded time so hot records do not hit KMS on every read.
+// It implements interfaces.KMSUploader, so it can be used anywhere a KMSUploader is expected.
+type EnvelopeService struct {
+	KMS        interfaces.KMSUploader
+	KeyID      string // KMS key new data keys are wrapped with
+	KeyVersion int    // Version of KeyID, records with an older version are re-wrapped
+
+	dekCache *cache.Cache // sha256(wrapped key) -> plaintext key
+}
+
+// NewEnvelopeService creates an envelope service caching unwrapped data keys for ttl
+func NewEnvelopeService(kmsUploader interfaces.KMSUploader, keyID string, keyVersion int, ttl time.Duration) *EnvelopeService {
+	if ttl <= 0 {
+		ttl = defaultDEKCacheTTL
+	}
+	dekCache := cache.New(ttl, ttl)
+	// Wipe plaintext keys as soon as they leave the cache
+	dekCache.OnEvicted(func(_ string, value interface{}) {
+		if key, ok := value.([]byte); ok {
+			for i := range key {
+				key[i] = 0
+			}
+		}
+	})
+	return &EnvelopeService{
+		KMS:        kmsUploader,
+		KeyID:      keyID,
+		KeyVersion: keyVersion,
+		dekCache:   dekCache,
+	}
+}
+
+// NewEnvelopeServiceFromConfig creates an envelope service for the key configured in AWSConfig
+func NewEnvelopeServiceFromConfig(kmsUploader interfaces.KMSUploader, cfg models.AWSConfig) *EnvelopeService {
+	return NewEnvelopeService(kmsUploader, cfg.KeyID, cfg.KeyVersion, time.Duration(cfg.DEKCacheTTLSecs)*time.Second)
+}
+
+// CurrentKey returns the KMS key new data keys are wrapped with
+func (s *EnvelopeService) CurrentKey() (string, int) {
+	return s.KeyID, s.KeyVersion
+}
+
+// NewDataKey generates a data key and returns it in plaintext together with its wrapped form
+func (s *EnvelopeService) NewDataKey(ctx context.Context) ([]byte, models.WrappedKey, error) {
+	plaintext, encrypted, err := s.KMS.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, models.WrappedKey{}, err
+	}
+	s.cacheKey(encrypted, plaintext)
+	return plaintext, s.wrappedKey(encrypted), nil
+}
+
+// wrappedKey describes a data key wrapped by the service's KMS. Vault Transit ciphertexts carry the
+// version of the key that produced them, which is recorded instead of the configured KeyVersion so
+// a key only counts as rewrapped once Vault really rotated it.
+func (s *EnvelopeService) wrappedKey(encrypted []byte) models.WrappedKey {
+	keyVersion := s.KeyVersion
+	if version, err := VaultCiphertextKeyVersion(encrypted); err == nil {
+		if version < s.KeyVersion {
+			zaplogger.GetLogger().Warn("Vault transit key is older than the configured key version, rotate it in Vault",
+				zap.String("keyID", s.KeyID), zap.Int("vaultVersion", version), zap.Int("keyVersion", s.KeyVersion))
+		}
+		keyVersion = version
+	}
+	return models.WrappedKey{EncryptedKey: encrypted, KeyID: s.KeyID, KeyVersion: keyVersion}
+}
+
+// UnwrapDataKey returns the plaintext of a wrapped data key, from the cache when possible
+func (s *EnvelopeService) UnwrapDataKey(ctx context.Context, wrapped models.WrappedKey) ([]byte, error) {
+	if wrapped.DestroyedAt != nil {
+		return nil, &DataKeyDestroyedError{DestroyedAt: *wrapped.DestroyedAt}
+	}
+	return s.DecryptData(ctx, wrapped.EncryptedKey)
+}
+
+// NeedsRewrap reports whether a wrapped key was produced by a different or older KMS key
+func (s *EnvelopeService) NeedsRewrap(wrapped models.WrappedKey) bool {
+	return wrapped.KeyID != s.KeyID || wrapped.KeyVersion < s.KeyVersion
+}
+
+// Rewrap re-encrypts a data key under the current KMS key. from unwraps the old key and defaults
+// to the service's own KMS uploader. Data encrypted with the key is not touched. Returns an error
+// wrapping ErrKeyVersionBehind when the KMS key is older than the configured KeyVersion.
+func (s *EnvelopeService) Rewrap(ctx context.Context, wrapped models.WrappedKey, from interfaces.KMSUploader) (models.WrappedKey, error) {
+	logger := zaplogger.GetLogger()
+	if wrapped.DestroyedAt != nil {
+		return models.WrappedKey{}, &DataKeyDestroyedError{DestroyedAt: *wrapped.DestroyedAt}
+	}
+	if from == nil {
+		from = s.KMS
+		// Prefer re-encrypting inside the KMS so the plaintext key never reaches this process. Only
+		// done within a key, Vault Transit cannot rewrap across keys.
+		if rewrapper, ok := s.KMS.(interfaces.KeyRewrapper); ok && wrapped.KeyID == s.KeyID {
+			encrypted, err := rewrapper.RewrapData(ctx, wrapped.EncryptedKey)
+			if err == nil {
+				return s.rewrapped(wrapped, encrypted)
+			}
+			if !errors.Is(err, ErrRewrapUnsupported) {
+				logger.Error("failed to rewrap data key in KMS", zap.String("keyID", wrapped.KeyID), zap.Error(err))
+				return models.WrappedKey{}, fmt.Errorf("failed to rewrap data key: %w", err)
+			}
+		}
+	}
+	plaintext, err := from.DecryptData(ctx, wrapped.EncryptedKey)
+	if err != nil {
+		logger.Error("failed to unwrap data key for rewrap", zap.String("keyID", wrapped.KeyID), zap.Error(err))
+		return models.WrappedKey{}, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	defer func() {
+		for i := range plaintext {
+			plaintext[i] = 0
+		}
+	}()
+
+	encrypted, err := s.KMS.EncryptData(ctx, plaintext)
+	if err != nil {
+		logger.Error("failed to wrap data key under new key", zap.String("keyID", s.KeyID), zap.Error(err))
+		return models.WrappedKey{}, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return s.rewrapped(wrapped, encrypted)
+}
+
+// rewrapped returns the rewrapped form of a data key, refusing it when it is still not wrapped with
+// the configured key version: storing it would have it rewrapped again on every run
+func (s *EnvelopeService) rewrapped(old models.WrappedKey, encrypted []byte) (models.WrappedKey, error) {
+	wrapped := s.wrappedKey(encrypted)
+	if s.NeedsRewrap(wrapped) {
+		return models.WrappedKey{}, fmt.Errorf("%w: key %s was wrapped with version %d, configured version is %d",
+			ErrKeyVersionBehind, wrapped.KeyID, wrapped.KeyVersion, s.KeyVersion)
+	}
+	s.dekCache.Delete(cacheKeyFor(old.EncryptedKey))
+	return wrapped, nil
+}
+
+// GenerateDataKey implements interfaces.KMSUploader
+func (s *EnvelopeService) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	plaintext, wrapped, err := s.NewDataKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, wrapped.EncryptedKey, nil
+}
+
+// EncryptData implements interfaces.KMSUploader
+func (s *EnvelopeService) EncryptData(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return s.KMS.EncryptData(ctx, plaintext)
+}
+
+// DecryptData implements interfaces.KMSUploader, serving data keys from the cache when possible
+func (s *EnvelopeService) DecryptData(ctx context.Context, encrypted []byte) ([]byte, error) {
+	if cached, found := s.dekCache.Get(cacheKeyFor(encrypted)); found {
+		return append([]byte(nil), cached.([]byte)...), nil
+	}
+	plaintext, err := s.KMS.DecryptData(ctx, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheKey(encrypted, plaintext)
+	return plaintext, nil
+}
+
+// ForgetDataKey drops a data key from the cache, e.g. after the record it protects was erased
+func (s *EnvelopeService) ForgetDataKey(encrypted []byte) {
+	s.dekCache.Delete(cacheKeyFor(encrypted))
+}
+
+func (s *EnvelopeService) cacheKey(encrypted []byte, plaintext []byte) {
+	// Store a copy so callers zeroing their key do not corrupt the cache
+	s.dekCache.Set(cacheKeyFor(encrypted), append([]byte(nil), plaintext...), cache.DefaultExpiration)
+}
+
+func cacheKeyFor(encrypted []byte) string {
+	sum := sha256.Sum256(encrypted)
+	return hex.EncodeToString(sum[:])
+}
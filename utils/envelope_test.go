@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rachel-lawrie/verus_backend_core/mocks"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEnvelopeServiceCachesUnwrappedKeys(t *testing.T) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	wrapped := []byte("wrapped-key")
+	plaintext := []byte("0123456789abcdef0123456789abcdef")
+
+	mockKmsClient.On("Decrypt", mock.Anything, &kms.DecryptInput{CiphertextBlob: wrapped}).Return(&kms.DecryptOutput{
+		Plaintext: plaintext,
+	}, nil).Once()
+
+	envelope := NewEnvelopeService(&KMSUploader{Client: mockKmsClient, KeyID: "key-1"}, "key-1", 1, time.Minute)
+
+	first, err := envelope.UnwrapDataKey(context.TODO(), models.WrappedKey{EncryptedKey: wrapped})
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, first)
+
+	// Zeroing the returned key must not affect the cached copy
+	for i := range first {
+		first[i] = 0
+	}
+
+	second, err := envelope.UnwrapDataKey(context.TODO(), models.WrappedKey{EncryptedKey: wrapped})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), second)
+	mockKmsClient.AssertNumberOfCalls(t, "Decrypt", 1)
+}
+
+func TestEnvelopeServiceNewDataKeyRecordsKey(t *testing.T) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      []byte("plain-key"),
+		CiphertextBlob: []byte("cipher-key"),
+	}, nil)
+
+	envelope := NewEnvelopeService(&KMSUploader{Client: mockKmsClient, KeyID: "key-2"}, "key-2", 3, time.Minute)
+	_, wrapped, err := envelope.NewDataKey(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, models.WrappedKey{EncryptedKey: []byte("cipher-key"), KeyID: "key-2", KeyVersion: 3}, wrapped)
+	assert.False(t, envelope.NeedsRewrap(wrapped))
+	assert.True(t, envelope.NeedsRewrap(models.WrappedKey{KeyID: "key-1", KeyVersion: 3}))
+	assert.True(t, envelope.NeedsRewrap(models.WrappedKey{KeyID: "key-2", KeyVersion: 2}))
+}
+
+func TestEnvelopeServiceRewrap(t *testing.T) {
+	oldKmsClient := new(mocks.MockKMSClient)
+	newKmsClient := new(mocks.MockKMSClient)
+	plaintext := []byte("0123456789abcdef0123456789abcdef")
+	newKeyID := "key-2"
+
+	oldKmsClient.On("Decrypt", mock.Anything, &kms.DecryptInput{CiphertextBlob: []byte("old-wrapped")}).Return(&kms.DecryptOutput{
+		Plaintext: append([]byte(nil), plaintext...),
+	}, nil)
+	newKmsClient.On("Encrypt", mock.Anything, &kms.EncryptInput{KeyId: &newKeyID, Plaintext: plaintext}).Return(&kms.EncryptOutput{
+		CiphertextBlob: []byte("new-wrapped"),
+	}, nil)
+
+	envelope := NewEnvelopeService(&KMSUploader{Client: newKmsClient, KeyID: newKeyID}, newKeyID, 1, time.Minute)
+	rewrapped, err := envelope.Rewrap(context.TODO(),
+		models.WrappedKey{EncryptedKey: []byte("old-wrapped"), KeyID: "key-1"},
+		&KMSUploader{Client: oldKmsClient, KeyID: "key-1"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, models.WrappedKey{EncryptedKey: []byte("new-wrapped"), KeyID: newKeyID, KeyVersion: 1}, rewrapped)
+	oldKmsClient.AssertExpectations(t)
+	newKmsClient.AssertExpectations(t)
+}
+
+func TestEnvelopeServiceRefusesDestroyedKeys(t *testing.T) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	envelope := NewEnvelopeService(&KMSUploader{Client: mockKmsClient, KeyID: "key-1"}, "key-1", 1, time.Minute)
+	destroyedAt := time.Now()
+
+	_, err := envelope.UnwrapDataKey(context.TODO(), models.WrappedKey{DestroyedAt: &destroyedAt})
+	var destroyed *DataKeyDestroyedError
+	assert.True(t, errors.As(err, &destroyed))
+	assert.ErrorIs(t, err, ErrDataKeyDestroyed)
+	mockKmsClient.AssertNotCalled(t, "Decrypt", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,352 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+const (
+	// FieldTagName is the struct tag honored by FieldEncryptor
+	FieldTagName = "verus"
+	// FieldTagEncrypt marks a string field holding PII that is encrypted at rest
+	FieldTagEncrypt = "encrypt"
+	// FieldTagDEK marks the []byte field holding the record's KMS-wrapped data encryption key
+	FieldTagDEK = "dek"
+	// FieldTagAAD marks string fields identifying the record (e.g. applicant_id, client_id) whose
+	// values are bound to every encrypted field as associated data
+	FieldTagAAD = "aad"
+	// FieldTagDEKKeyID and FieldTagDEKKeyVersion mark the optional string and int fields recording
+	// which KMS key wrapped the DEK
+	FieldTagDEKKeyID      = "dek_key_id"
+	FieldTagDEKKeyVersion = "dek_key_version"
+	// FieldTagDEKDestroyedAt marks the optional *time.Time field set when the DEK was crypto-shredded
+	FieldTagDEKDestroyedAt = "dek_destroyed_at"
+
+	// Prefixes marking a string value as ciphertext produced by FieldEncryptor. v1 values carry no
+	// associated data and are re-encrypted as v2, bound to the record and field, on the next write.
+	encryptedValuePrefixV1 = "enc:v1:"
+	encryptedValuePrefixV2 = "enc:v2:"
+)
+
+// FieldEncryptor encrypts and decrypts the `verus:"encrypt"` string fields of a record in place,
+// using a per-record DEK stored (wrapped by KMS) in the record's `verus:"dek"` field.
+// Encrypted values are stored as "enc:v2:<base64 nonce+ciphertext>", bound to the record's
+// `verus:"aad"` fields and the field's bson name, so plaintext values written before a field was
+// tagged still read back unchanged and are encrypted on the next write.
+type FieldEncryptor struct {
+	KMS interfaces.KMSUploader
+}
+
+// NewFieldEncryptor creates a FieldEncryptor using the given KMS uploader to wrap DEKs
+func NewFieldEncryptor(kmsUploader interfaces.KMSUploader) *FieldEncryptor {
+	return &FieldEncryptor{KMS: kmsUploader}
+}
+
+// taggedFields holds the settable fields of a record found by walking its struct tags
+type taggedFields struct {
+	encrypt       []taggedField
+	aad           EncryptionContext
+	dek           *reflect.Value
+	dekKeyID      *reflect.Value
+	dekKeyVersion *reflect.Value
+	dekDestroyed  *reflect.Value
+}
+
+// taggedField is a `verus:"encrypt"` field and the name it is bound to
+type taggedField struct {
+	value reflect.Value
+	name  string
+}
+
+// context returns the encryption context of a tagged field
+func (fields taggedFields) context(field taggedField) EncryptionContext {
+	return fields.aad.WithField(field.name)
+}
+
+// IsEncryptedValue reports whether a string field value is ciphertext
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefixV1) || strings.HasPrefix(value, encryptedValuePrefixV2)
+}
+
+// Encrypt encrypts every tagged field of record, which must be a pointer to a struct. A DEK is
+// generated and stored in the dek field when the record does not have one yet. Fields already
+// holding ciphertext of the record are left unchanged.
+func (e *FieldEncryptor) Encrypt(ctx context.Context, record interface{}) error {
+	logger := zaplogger.GetLogger()
+	fields, err := collectTaggedFields(record)
+	if err != nil {
+		return err
+	}
+	if len(fields.encrypt) == 0 {
+		return nil
+	}
+
+	key, err := e.recordKey(ctx, fields, true)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields.encrypt {
+		value := field.value.String()
+		if value == "" {
+			continue
+		}
+		// A prefixed value is only ciphertext when it authenticates under the record's key, any
+		// other value is user input that happens to start with the prefix and is encrypted as is
+		if IsEncryptedValue(value) {
+			if plaintext, err := decryptValue(value, key, fields.context(field)); err == nil {
+				if strings.HasPrefix(value, encryptedValuePrefixV2) {
+					continue
+				}
+				// Upgrade unbound values so they are bound to the record from now on
+				value = plaintext
+			}
+		}
+		encrypted, err := EncryptFieldWithContext(value, key, fields.context(field))
+		if err != nil {
+			logger.Error("failed to encrypt field", zap.String("field", field.name), zap.Error(err))
+			return fmt.Errorf("failed to encrypt field %s: %w", field.name, err)
+		}
+		packed := append(append([]byte{}, encrypted.Nonce...), encrypted.Ciphertext...)
+		field.value.SetString(encryptedValuePrefixV2 + base64.StdEncoding.EncodeToString(packed))
+	}
+	return nil
+}
+
+// Decrypt decrypts every tagged field of record, which must be a pointer to a struct
+func (e *FieldEncryptor) Decrypt(ctx context.Context, record interface{}) error {
+	logger := zaplogger.GetLogger()
+	fields, err := collectTaggedFields(record)
+	if err != nil {
+		return err
+	}
+
+	hasCiphertext := false
+	for _, field := range fields.encrypt {
+		if IsEncryptedValue(field.value.String()) {
+			hasCiphertext = true
+			break
+		}
+	}
+	if !hasCiphertext {
+		return nil
+	}
+
+	key, err := e.recordKey(ctx, fields, false)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields.encrypt {
+		value := field.value.String()
+		if !IsEncryptedValue(value) {
+			continue
+		}
+		plaintext, err := decryptValue(value, key, fields.context(field))
+		if err != nil {
+			logger.Error("failed to decrypt field", zap.String("field", field.name), zap.Error(err))
+			return fmt.Errorf("failed to decrypt field %s: %w", field.name, err)
+		}
+		field.value.SetString(plaintext)
+	}
+	return nil
+}
+
+// decryptValue decrypts a prefixed string value, binding v2 values to ec
+func decryptValue(value string, key []byte, ec EncryptionContext) (string, error) {
+	version := models.EncryptedFieldVersionBound
+	encoded := strings.TrimPrefix(value, encryptedValuePrefixV2)
+	if strings.HasPrefix(value, encryptedValuePrefixV1) {
+		version = models.EncryptedFieldVersionUnbound
+		encoded = strings.TrimPrefix(value, encryptedValuePrefixV1)
+	}
+
+	packed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(packed) < gcmNonceSize {
+		return "", fmt.Errorf("malformed encrypted field value")
+	}
+	return DecryptFieldWithContext(models.EncryptedField{
+		Nonce:      packed[:gcmNonceSize],
+		Ciphertext: packed[gcmNonceSize:],
+		Version:    version,
+	}, key, ec)
+}
+
+// recordKey unwraps the record's DEK, generating one when allowed and the record has none
+func (e *FieldEncryptor) recordKey(ctx context.Context, fields taggedFields, generate bool) ([]byte, error) {
+	if fields.dek == nil {
+		return nil, fmt.Errorf("record has no field tagged %s:%q", FieldTagName, FieldTagDEK)
+	}
+	// An erased record must never be given a new key, nor have its old one unwrapped
+	if fields.dekDestroyed != nil && !fields.dekDestroyed.IsNil() {
+		return nil, &DataKeyDestroyedError{DestroyedAt: fields.dekDestroyed.Interface().(*time.Time).UTC()}
+	}
+
+	wrapped := fields.dek.Bytes()
+	if len(wrapped) > 0 {
+		key, err := e.KMS.DecryptData(ctx, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+		}
+		return key, nil
+	}
+	if !generate {
+		return nil, fmt.Errorf("record has encrypted fields but no data key")
+	}
+
+	// The envelope service knows the key version that really wrapped the key, e.g. from Vault
+	if envelope, ok := e.KMS.(*EnvelopeService); ok {
+		key, wrappedKey, err := envelope.NewDataKey(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		fields.setDataKey(wrappedKey.EncryptedKey, wrappedKey.KeyID, wrappedKey.KeyVersion)
+		return key, nil
+	}
+
+	key, wrapped, err := e.KMS.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	keyID, keyVersion := "", 0
+	if reporter, ok := e.KMS.(interfaces.KeyReporter); ok {
+		keyID, keyVersion = reporter.CurrentKey()
+	}
+	fields.setDataKey(wrapped, keyID, keyVersion)
+	return key, nil
+}
+
+// setDataKey stores a new wrapped DEK on the record together with the KMS key that wrapped it
+func (f taggedFields) setDataKey(wrapped []byte, keyID string, keyVersion int) {
+	f.dek.SetBytes(wrapped)
+	if keyID == "" {
+		return
+	}
+	if f.dekKeyID != nil {
+		f.dekKeyID.SetString(keyID)
+	}
+	if f.dekKeyVersion != nil {
+		f.dekKeyVersion.SetInt(int64(keyVersion))
+	}
+}
+
+// CopyDataKey copies the wrapped DEK of one record into another record of the same kind, e.g. from
+// an encrypted copy back to the caller's plaintext record
+func CopyDataKey(from interface{}, to interface{}) error {
+	fromFields, err := collectTaggedFields(from)
+	if err != nil {
+		return err
+	}
+	toFields, err := collectTaggedFields(to)
+	if err != nil {
+		return err
+	}
+	if fromFields.dek == nil || toFields.dek == nil {
+		return nil
+	}
+	toFields.dek.SetBytes(fromFields.dek.Bytes())
+	if fromFields.dekKeyID != nil && toFields.dekKeyID != nil {
+		toFields.dekKeyID.SetString(fromFields.dekKeyID.String())
+	}
+	if fromFields.dekKeyVersion != nil && toFields.dekKeyVersion != nil {
+		toFields.dekKeyVersion.SetInt(fromFields.dekKeyVersion.Int())
+	}
+	return nil
+}
+
+func collectTaggedFields(record interface{}) (taggedFields, error) {
+	fields := taggedFields{aad: EncryptionContext{}}
+	v := reflect.ValueOf(record)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fields, fmt.Errorf("record must be a non-nil pointer to a struct, got %T", record)
+	}
+	if err := walkTaggedFields(v.Elem(), &fields); err != nil {
+		return fields, err
+	}
+	return fields, nil
+}
+
+// walkTaggedFields collects tagged fields, descending into nested structs and struct pointers
+func walkTaggedFields(v reflect.Value, fields *taggedFields) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		field := v.Field(i)
+
+		switch structField.Tag.Get(FieldTagName) {
+		case FieldTagEncrypt:
+			if field.Kind() != reflect.String {
+				return fmt.Errorf("field %s tagged %s:%q must be a string", structField.Name, FieldTagName, FieldTagEncrypt)
+			}
+			fields.encrypt = append(fields.encrypt, taggedField{value: field, name: fieldName(structField)})
+			continue
+		case FieldTagAAD:
+			if field.Kind() != reflect.String {
+				return fmt.Errorf("field %s tagged %s:%q must be a string", structField.Name, FieldTagName, FieldTagAAD)
+			}
+			fields.aad[fieldName(structField)] = field.String()
+			continue
+		case FieldTagDEK:
+			if field.Kind() != reflect.Slice || field.Type().Elem().Kind() != reflect.Uint8 {
+				return fmt.Errorf("field %s tagged %s:%q must be a []byte", structField.Name, FieldTagName, FieldTagDEK)
+			}
+			if fields.dek != nil {
+				return fmt.Errorf("record has more than one field tagged %s:%q", FieldTagName, FieldTagDEK)
+			}
+			fields.dek = &field
+			continue
+		case FieldTagDEKKeyID:
+			if field.Kind() != reflect.String {
+				return fmt.Errorf("field %s tagged %s:%q must be a string", structField.Name, FieldTagName, FieldTagDEKKeyID)
+			}
+			fields.dekKeyID = &field
+			continue
+		case FieldTagDEKKeyVersion:
+			if field.Kind() != reflect.Int {
+				return fmt.Errorf("field %s tagged %s:%q must be an int", structField.Name, FieldTagName, FieldTagDEKKeyVersion)
+			}
+			fields.dekKeyVersion = &field
+			continue
+		case FieldTagDEKDestroyedAt:
+			if field.Type() != reflect.TypeOf(&time.Time{}) {
+				return fmt.Errorf("field %s tagged %s:%q must be a *time.Time", structField.Name, FieldTagName, FieldTagDEKDestroyedAt)
+			}
+			fields.dekDestroyed = &field
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			if err := walkTaggedFields(field, fields); err != nil {
+				return err
+			}
+		case reflect.Ptr:
+			if !field.IsNil() && field.Elem().Kind() == reflect.Struct {
+				if err := walkTaggedFields(field.Elem(), fields); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName returns the bson name of a struct field, falling back to the Go name
+func fieldName(structField reflect.StructField) string {
+	if name := strings.Split(structField.Tag.Get("bson"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return structField.Name
+}
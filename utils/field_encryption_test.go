@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rachel-lawrie/verus_backend_core/mocks"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newFieldEncryptorWithMockKMS() (*FieldEncryptor, *mocks.MockKMSClient) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	plaintextKey := []byte("0123456789abcdef0123456789abcdef")
+	wrappedKey := []byte("wrapped-key")
+
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      plaintextKey,
+		CiphertextBlob: wrappedKey,
+	}, nil)
+	mockKmsClient.On("Decrypt", mock.Anything, &kms.DecryptInput{CiphertextBlob: wrappedKey}).Return(&kms.DecryptOutput{
+		Plaintext: plaintextKey,
+	}, nil)
+
+	return NewFieldEncryptor(&KMSUploader{Client: mockKmsClient, KeyID: "test-key-id"}), mockKmsClient
+}
+
+func TestFieldEncryptorRoundTrip(t *testing.T) {
+	encryptor, _ := newFieldEncryptorWithMockKMS()
+	applicant := models.Applicant{
+		ApplicantID: "applicant123",
+		FirstName:   "Ada",
+		LastName:    "Lovelace",
+		Email:       "ada@example.com",
+		Phone:       "",
+	}
+
+	err := encryptor.Encrypt(context.TODO(), &applicant)
+	assert.NoError(t, err)
+	assert.True(t, IsEncryptedValue(applicant.FirstName))
+	assert.True(t, IsEncryptedValue(applicant.Email))
+	assert.Equal(t, "", applicant.Phone)
+	assert.Equal(t, "applicant123", applicant.ApplicantID)
+	assert.Equal(t, []byte("wrapped-key"), applicant.EncryptedData.EncryptedKey)
+
+	// Encrypting twice must not double encrypt
+	firstName := applicant.FirstName
+	assert.NoError(t, encryptor.Encrypt(context.TODO(), &applicant))
+	assert.Equal(t, firstName, applicant.FirstName)
+
+	err = encryptor.Decrypt(context.TODO(), &applicant)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", applicant.FirstName)
+	assert.Equal(t, "Lovelace", applicant.LastName)
+	assert.Equal(t, "ada@example.com", applicant.Email)
+}
+
+func TestFieldEncryptorLeavesLegacyPlaintext(t *testing.T) {
+	encryptor, mockKmsClient := newFieldEncryptorWithMockKMS()
+	applicant := models.Applicant{FirstName: "Ada"}
+
+	err := encryptor.Decrypt(context.TODO(), &applicant)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ada", applicant.FirstName)
+	mockKmsClient.AssertNotCalled(t, "Decrypt", mock.Anything, mock.Anything)
+}
+
+func TestFieldEncryptorRejectsInvalidTags(t *testing.T) {
+	encryptor, _ := newFieldEncryptorWithMockKMS()
+
+	var wrongKind struct {
+		Age int `verus:"encrypt"`
+	}
+	assert.Error(t, encryptor.Encrypt(context.TODO(), &wrongKind))
+
+	var noDEK struct {
+		Name string `verus:"encrypt"`
+	}
+	noDEK.Name = "Ada"
+	assert.Error(t, encryptor.Encrypt(context.TODO(), &noDEK))
+
+	assert.Error(t, encryptor.Encrypt(context.TODO(), models.Applicant{}))
+}
+
+func TestFieldEncryptorBindsValuesToRecord(t *testing.T) {
+	encryptor, _ := newFieldEncryptorWithMockKMS()
+	applicant := models.Applicant{ApplicantID: "applicant123", ClientID: "client123", FirstName: "Ada", LastName: "Lovelace"}
+	assert.NoError(t, encryptor.Encrypt(context.TODO(), &applicant))
+
+	// A value copied onto another field of the same record does not decrypt
+	swapped := applicant
+	swapped.LastName = applicant.FirstName
+	assert.Error(t, encryptor.Decrypt(context.TODO(), &swapped))
+
+	// Nor does the record once moved to another applicant
+	moved := applicant
+	moved.ApplicantID = "applicant456"
+	assert.Error(t, encryptor.Decrypt(context.TODO(), &moved))
+}
+
+func TestFieldEncryptorUpgradesUnboundValues(t *testing.T) {
+	encryptor, _ := newFieldEncryptorWithMockKMS()
+	legacy, err := EncryptField("Ada", []byte("0123456789abcdef0123456789abcdef"))
+	assert.NoError(t, err)
+	packed := append(append([]byte{}, legacy.Nonce...), legacy.Ciphertext...)
+
+	applicant := models.Applicant{ApplicantID: "applicant123", ClientID: "client123"}
+	applicant.FirstName = encryptedValuePrefixV1 + base64.StdEncoding.EncodeToString(packed)
+	applicant.EncryptedData.EncryptedKey = []byte("wrapped-key")
+
+	decrypted := applicant
+	assert.NoError(t, encryptor.Decrypt(context.TODO(), &decrypted))
+	assert.Equal(t, "Ada", decrypted.FirstName)
+
+	assert.NoError(t, encryptor.Encrypt(context.TODO(), &applicant))
+	assert.True(t, strings.HasPrefix(applicant.FirstName, encryptedValuePrefixV2))
+	assert.NoError(t, encryptor.Decrypt(context.TODO(), &applicant))
+	assert.Equal(t, "Ada", applicant.FirstName)
+}
+
+func TestFieldEncryptorEncryptsPrefixedPlaintext(t *testing.T) {
+	encryptor, _ := newFieldEncryptorWithMockKMS()
+	applicant := models.Applicant{ApplicantID: "applicant123", FirstName: "enc:v2:Ada", LastName: "enc:v1:Lovelace"}
+
+	assert.NoError(t, encryptor.Encrypt(context.TODO(), &applicant))
+	assert.NotEqual(t, "enc:v2:Ada", applicant.FirstName)
+	assert.NotEqual(t, "enc:v1:Lovelace", applicant.LastName)
+
+	assert.NoError(t, encryptor.Decrypt(context.TODO(), &applicant))
+	assert.Equal(t, "enc:v2:Ada", applicant.FirstName)
+	assert.Equal(t, "enc:v1:Lovelace", applicant.LastName)
+}
+
+func TestFieldEncryptorRefusesErasedRecords(t *testing.T) {
+	encryptor, mockKmsClient := newFieldEncryptorWithMockKMS()
+	destroyedAt := time.Now()
+	applicant := models.Applicant{ApplicantID: "applicant123", FirstName: "enc:v2:AAAAAAAAAAAAAAAAAAAAAAAA"}
+	applicant.EncryptedData.KeyDestroyedAt = &destroyedAt
+
+	assert.ErrorIs(t, encryptor.Decrypt(context.TODO(), &applicant), ErrDataKeyDestroyed)
+
+	// No new key may be generated for an erased record
+	applicant.FirstName = "Ada"
+	assert.ErrorIs(t, encryptor.Encrypt(context.TODO(), &applicant), ErrDataKeyDestroyed)
+	mockKmsClient.AssertNotCalled(t, "GenerateDataKey", mock.Anything, mock.Anything)
+}
+
+func TestFieldEncryptorRecordsWrappingKeyVersion(t *testing.T) {
+	mockKmsClient := new(mocks.MockKMSClient)
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		CiphertextBlob: []byte("transit:test-key-id:vault:v1:d3JhcHBlZC1rZXk="),
+	}, nil)
+	envelope := NewEnvelopeService(&KMSUploader{Client: mockKmsClient, KeyID: "test-key-id"}, "test-key-id", 2, time.Minute)
+
+	// Vault has not been rotated to the configured version yet, the record says so
+	applicant := models.Applicant{ApplicantID: "applicant123", FirstName: "Ada"}
+	assert.NoError(t, NewFieldEncryptor(envelope).Encrypt(context.TODO(), &applicant))
+	assert.Equal(t, "test-key-id", applicant.EncryptedData.KeyID)
+	assert.Equal(t, 1, applicant.EncryptedData.KeyVersion)
+	assert.True(t, envelope.NeedsRewrap(models.WrappedKey{
+		EncryptedKey: applicant.EncryptedData.EncryptedKey,
+		KeyID:        applicant.EncryptedData.KeyID,
+		KeyVersion:   applicant.EncryptedData.KeyVersion,
+	}))
+}
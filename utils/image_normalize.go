@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// ErrUnsupportedImageFormat is returned by NormalizeImage for content it cannot process. Only JPEG
+// and PNG are supported; HEIC has no decoder here and is rejected by upload validation.
+var ErrUnsupportedImageFormat = errors.New("unsupported image format")
+
+const defaultJPEGQuality = 92
+
+// NormalizeOptions controls how NormalizeImage rewrites an image
+type NormalizeOptions struct {
+	Format      string // Content type to re-encode to, MimeTypeJPEG or MimeTypePNG; empty keeps the format
+	JPEGQuality int    // Quality of re-encoded JPEGs, defaults to 92
+}
+
+// NormalizedImage is an image stripped of metadata and upright, ready to be uploaded
+type NormalizedImage struct {
+	Data           []byte
+	ContentType    string
+	Width          int
+	Height         int
+	Reencoded      bool   // The pixels were decoded and encoded again rather than copied
+	OriginalHash   string // Hex SHA-256 of the image as uploaded
+	NormalizedHash string // Hex SHA-256 of Data, what Document.ContentHash records once it is stored
+}
+
+// NormalizeImage strips EXIF, XMP, IPTC, comments and text chunks, which may hold GPS coordinates
+// and device details, from a JPEG or PNG image and applies its EXIF orientation so it is stored
+// upright. Images that are already upright and keep their format are stripped losslessly;
+// otherwise they are decoded and re-encoded, which drops all metadata.
+func NormalizeImage(content io.Reader, contentType string, opts NormalizeOptions) (NormalizedImage, error) {
+	contentType = normalizeMimeType(contentType)
+	if contentType != MimeTypeJPEG && contentType != MimeTypePNG {
+		return NormalizedImage{}, ErrUnsupportedImageFormat
+	}
+	format := contentType
+	if opts.Format != "" {
+		format = normalizeMimeType(opts.Format)
+		if format != MimeTypeJPEG && format != MimeTypePNG {
+			return NormalizedImage{}, fmt.Errorf("%w: cannot encode %s", ErrUnsupportedImageFormat, opts.Format)
+		}
+	}
+
+	original, err := io.ReadAll(content)
+	if err != nil {
+		return NormalizedImage{}, fmt.Errorf("failed to read image: %w", err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return NormalizedImage{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	orientation := 1
+	if contentType == MimeTypeJPEG {
+		orientation = jpegOrientation(original)
+	}
+
+	normalized := NormalizedImage{ContentType: format, Width: config.Width, Height: config.Height, OriginalHash: sha256Hex(original)}
+	if orientation == 1 && format == contentType {
+		if contentType == MimeTypeJPEG {
+			normalized.Data, err = stripJPEGMetadata(original)
+		} else {
+			normalized.Data, err = stripPNGMetadata(original)
+		}
+		if err != nil {
+			return NormalizedImage{}, err
+		}
+	} else {
+		img, _, err := image.Decode(bytes.NewReader(original))
+		if err != nil {
+			return NormalizedImage{}, fmt.Errorf("failed to decode image: %w", err)
+		}
+		img = applyOrientation(img, orientation)
+		var buf bytes.Buffer
+		if format == MimeTypeJPEG {
+			quality := opts.JPEGQuality
+			if quality <= 0 {
+				quality = defaultJPEGQuality
+			}
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			return NormalizedImage{}, fmt.Errorf("failed to encode image: %w", err)
+		}
+		normalized.Data = buf.Bytes()
+		normalized.Width, normalized.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		normalized.Reencoded = true
+	}
+	normalized.NormalizedHash = sha256Hex(normalized.Data)
+	return normalized, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// JPEG markers relevant to metadata stripping
+const (
+	jpegSOI    = 0xD8
+	jpegSOS    = 0xDA
+	jpegAPP0   = 0xE0 // JFIF header
+	jpegAPP1   = 0xE1 // EXIF and XMP
+	jpegAPP2   = 0xE2 // ICC color profile
+	jpegAPP14  = 0xEE // Adobe color transform
+	jpegAPP15  = 0xEF
+	jpegCOM    = 0xFE
+	jpegTEM    = 0x01
+	jpegRST0   = 0xD0
+	jpegRST7   = 0xD7
+	exifHeader = "Exif\x00\x00"
+)
+
+var errMalformedJPEG = errors.New("malformed jpeg")
+
+// jpegSegments calls fn with each marker and segment (marker included) before the scan data, and
+// returns the offset the scan starts at
+func jpegSegments(data []byte, fn func(marker byte, segment []byte)) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return 0, errMalformedJPEG
+	}
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 0, errMalformedJPEG
+		}
+		marker := data[offset+1]
+		if marker == 0xFF {
+			// Fill byte
+			offset++
+			continue
+		}
+		if marker == jpegTEM || (marker >= jpegRST0 && marker <= jpegRST7) {
+			fn(marker, data[offset:offset+2])
+			offset += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return 0, errMalformedJPEG
+		}
+		if marker == jpegSOS {
+			return offset, nil
+		}
+		fn(marker, data[offset:offset+2+length])
+		offset += 2 + length
+	}
+	return 0, errMalformedJPEG
+}
+
+// stripJPEGMetadata copies a JPEG without its metadata segments, keeping the JFIF header and the
+// segments needed to render colors correctly
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, 0xFF, jpegSOI)
+	scan, err := jpegSegments(data, func(marker byte, segment []byte) {
+		isMetadata := marker == jpegCOM || (marker >= jpegAPP0 && marker <= jpegAPP15 && marker != jpegAPP0 && marker != jpegAPP2 && marker != jpegAPP14)
+		if !isMetadata {
+			stripped = append(stripped, segment...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(stripped, data[scan:]...), nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 (upright) when it has none
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	_, _ = jpegSegments(data, func(marker byte, segment []byte) {
+		if marker == jpegAPP1 && len(segment) > 4 && bytes.HasPrefix(segment[4:], []byte(exifHeader)) {
+			if value := exifOrientation(segment[4+len(exifHeader):]); value != 0 {
+				orientation = value
+			}
+		}
+	})
+	return orientation
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF structure, 0 if absent
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation is a single SHORT stored in the entry's value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// applyOrientation returns img transformed so that an image with the given EXIF orientation is
+// upright
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // Turned 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // Turned 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // Turned 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngMetadataChunks are the ancillary chunks that may hold metadata
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPNGMetadata copies a PNG without its text, EXIF and timestamp chunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, errors.New("malformed png")
+	}
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, pngSignature...)
+	for offset := len(pngSignature); offset < len(data); {
+		if offset+12 > len(data) {
+			return nil, errors.New("malformed png")
+		}
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("malformed png")
+		}
+		if !pngMetadataChunks[string(data[offset+4:offset+8])] {
+			stripped = append(stripped, data[offset:end]...)
+		}
+		offset = end
+	}
+	return stripped, nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exifSegment returns an APP1 segment with an orientation tag and a GPS-like string
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)      // One IFD entry
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112) // Orientation
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, "GPS 51.5007N 0.1246W iPhone"...)
+
+	payload := append([]byte(exifHeader), tiff...)
+	segment := []byte{0xFF, jpegAPP1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJPEG encodes a width x height JPEG, red on the left half, with the EXIF segment inserted
+func testJPEG(t *testing.T, width, height int, exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, nil))
+	encoded := buf.Bytes()
+	return append(append(append([]byte{}, encoded[:2]...), exif...), encoded[2:]...)
+}
+
+func TestNormalizeImageStripsJPEGMetadata(t *testing.T) {
+	original := testJPEG(t, 64, 32, exifSegment(1))
+	assert.Contains(t, string(original), "GPS")
+
+	normalized, err := NormalizeImage(bytes.NewReader(original), "image/jpeg", NormalizeOptions{})
+	assert.NoError(t, err)
+	assert.False(t, normalized.Reencoded)
+	assert.NotContains(t, string(normalized.Data), "GPS")
+	assert.NotContains(t, string(normalized.Data), exifHeader)
+	assert.Equal(t, sha256Hex(original), normalized.OriginalHash)
+	assert.Equal(t, sha256Hex(normalized.Data), normalized.NormalizedHash)
+	assert.NotEqual(t, normalized.OriginalHash, normalized.NormalizedHash)
+
+	// Stripping is lossless, the image data is unchanged
+	img, err := jpeg.Decode(bytes.NewReader(normalized.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 64, 32), img.Bounds())
+}
+
+func TestNormalizeImageAppliesOrientation(t *testing.T) {
+	// Orientation 6: the stored image must be turned 90° clockwise to be upright
+	original := testJPEG(t, 64, 32, exifSegment(6))
+	normalized, err := NormalizeImage(bytes.NewReader(original), "image/jpeg", NormalizeOptions{})
+	assert.NoError(t, err)
+	assert.True(t, normalized.Reencoded)
+	assert.NotContains(t, string(normalized.Data), "GPS")
+	assert.Equal(t, 32, normalized.Width)
+	assert.Equal(t, 64, normalized.Height)
+
+	img, err := jpeg.Decode(bytes.NewReader(normalized.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 64), img.Bounds())
+	assert.Equal(t, 1, jpegOrientation(normalized.Data))
+
+	// The left (red) half is now on top
+	r, _, b, _ := img.At(16, 8).RGBA()
+	assert.Greater(t, r, b)
+	r, _, b, _ = img.At(16, 56).RGBA()
+	assert.Greater(t, b, r)
+}
+
+func TestNormalizeImageStripsPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10))))
+	encoded := buf.Bytes()
+
+	// Insert a tEXt chunk after IHDR
+	text := []byte("Comment\x00taken at 51.5007N 0.1246W")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(append([]byte("tEXt"), text...)))
+	ihdrEnd := len(pngSignature) + 12 + 13
+	original := append(append(append([]byte{}, encoded[:ihdrEnd]...), chunk...), encoded[ihdrEnd:]...)
+
+	normalized, err := NormalizeImage(bytes.NewReader(original), "image/png", NormalizeOptions{})
+	assert.NoError(t, err)
+	assert.False(t, normalized.Reencoded)
+	assert.Equal(t, encoded, normalized.Data)
+}
+
+func TestNormalizeImageReencodes(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 20))))
+
+	normalized, err := NormalizeImage(&buf, "image/png", NormalizeOptions{Format: MimeTypeJPEG})
+	assert.NoError(t, err)
+	assert.True(t, normalized.Reencoded)
+	assert.Equal(t, MimeTypeJPEG, normalized.ContentType)
+	_, err = jpeg.Decode(bytes.NewReader(normalized.Data))
+	assert.NoError(t, err)
+
+	_, err = NormalizeImage(bytes.NewReader([]byte("%PDF-1.7")), "application/pdf", NormalizeOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedImageFormat)
+	_, err = NormalizeImage(bytes.NewReader(normalized.Data), "image/jpeg", NormalizeOptions{Format: "image/heic"})
+	assert.ErrorIs(t, err, ErrUnsupportedImageFormat)
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -9,13 +10,29 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
 	"go.uber.org/zap"
 )
 
+// reEncrypter is implemented by KMS clients that can re-encrypt a ciphertext without exposing
+// its plaintext, such as the AWS SDK client and VaultTransitClient
+type reEncrypter interface {
+	ReEncrypt(ctx context.Context, input *kms.ReEncryptInput, opts ...func(*kms.Options)) (*kms.ReEncryptOutput, error)
+}
+
+// ErrRewrapUnsupported is returned by RewrapData when the KMS client cannot re-encrypt server side
+var ErrRewrapUnsupported = errors.New("kms client does not support re-encryption")
+
 type KMSUploader struct {
-	Client interfaces.KMSClient
-	KeyID  string // KMS Key ID (ARN or alias) used for generating data keys
+	Client     interfaces.KMSClient
+	KeyID      string // KMS Key ID (ARN or alias) used for generating data keys
+	KeyVersion int    // Version of KeyID recorded alongside wrapped data keys
+}
+
+// CurrentKey returns the KMS key new data keys are wrapped with
+func (k *KMSUploader) CurrentKey() (string, int) {
+	return k.KeyID, k.KeyVersion
 }
 
 func (k *KMSUploader) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
@@ -56,6 +73,25 @@ func (k *KMSUploader) DecryptData(ctx context.Context, encrypted []byte) ([]byte
 	return result.Plaintext, nil
 }
 
+// RewrapData re-encrypts a wrapped key under KeyID inside the KMS. It returns
+// ErrRewrapUnsupported when the client cannot re-encrypt.
+func (k *KMSUploader) RewrapData(ctx context.Context, encrypted []byte) ([]byte, error) {
+	logger := zaplogger.GetLogger()
+	client, ok := k.Client.(reEncrypter)
+	if !ok {
+		return nil, ErrRewrapUnsupported
+	}
+	result, err := client.ReEncrypt(ctx, &kms.ReEncryptInput{
+		CiphertextBlob:   encrypted,
+		DestinationKeyId: &k.KeyID,
+	})
+	if err != nil {
+		logger.Error("failed to re-encrypt data", zap.Error(err))
+		return nil, err
+	}
+	return result.CiphertextBlob, nil
+}
+
 func NewKMSUploader(region, accessKey, secretAccessKey, keyID string) (*KMSUploader, error) {
 	logger := zaplogger.GetLogger()
 	creds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
@@ -80,3 +116,40 @@ func NewKMSUploader(region, accessKey, secretAccessKey, keyID string) (*KMSUploa
 		KeyID:  keyID,
 	}, nil
 }
+
+// NewKMSUploaderFromConfig creates a KMS uploader backed by the provider selected in AWSConfig
+func NewKMSUploaderFromConfig(cfg models.AWSConfig) (*KMSUploader, error) {
+	switch cfg.KMSProvider {
+	case "", KMSProviderAWS:
+		uploader, err := NewKMSUploader(cfg.Region, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		uploader.KeyVersion = cfg.KeyVersion
+		return uploader, nil
+	case KMSProviderVault:
+		client, err := NewVaultTransitClientFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.KeyID == "" {
+			return nil, fmt.Errorf("vault transit requires a key name in KeyID")
+		}
+		return &KMSUploader{Client: client, KeyID: cfg.KeyID, KeyVersion: cfg.KeyVersion}, nil
+	case KMSProviderLocal:
+		client, err := NewLocalKMSClientFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		keyID := cfg.KeyID
+		if keyID == "" && len(client.KeyIDs()) == 1 {
+			keyID = client.KeyIDs()[0]
+		}
+		if _, ok := client.keys[keyID]; !ok {
+			return nil, fmt.Errorf("local KMS has no key %q", keyID)
+		}
+		return &KMSUploader{Client: client, KeyID: keyID, KeyVersion: cfg.KeyVersion}, nil
+	default:
+		return nil, fmt.Errorf("unsupported KMS provider %q", cfg.KMSProvider)
+	}
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+)
+
+const (
+	// KMSProviderAWS, KMSProviderVault and KMSProviderLocal select the KMS client built by
+	// NewKMSUploaderFromConfig
+	KMSProviderAWS   = "aws"
+	KMSProviderVault = "vault"
+	KMSProviderLocal = "local"
+
+	// LocalKMSKeysEnv holds local master keys as comma separated "<key id>:<base64 key>" pairs
+	LocalKMSKeysEnv = "VERUS_LOCAL_KMS_KEYS"
+
+	// localKMSMagic prefixes every ciphertext blob produced by LocalKMSClient, followed by the
+	// format version, the key ID length and the key ID, the nonce and the sealed plaintext
+	localKMSMagic   = "VLK"
+	localKMSVersion = 1
+)
+
+// LocalKMSClient is a software implementation of interfaces.KMSClient for development and
+// integration tests. Master keys are 256-bit AES keys held in memory; ciphertext blobs embed the
+// ID of the key that produced them so Decrypt does not need one, like AWS KMS.
+// It is not meant for production data.
+type LocalKMSClient struct {
+	keys map[string][]byte
+}
+
+// NewLocalKMSClient creates a local KMS holding the given master keys by key ID
+func NewLocalKMSClient(keys map[string][]byte) (*LocalKMSClient, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("local KMS requires at least one master key")
+	}
+	copied := make(map[string][]byte, len(keys))
+	for keyID, key := range keys {
+		if keyID == "" || len(keyID) > 255 {
+			return nil, fmt.Errorf("invalid local KMS key ID %q", keyID)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("local KMS key %s must be 32 bytes, got %d", keyID, len(key))
+		}
+		copied[keyID] = append([]byte(nil), key...)
+	}
+	return &LocalKMSClient{keys: copied}, nil
+}
+
+// LoadLocalKMSKeys reads master keys from a JSON keyfile mapping key IDs to base64 keys, or from
+// the LocalKMSKeysEnv environment variable when keyFile is empty
+func LoadLocalKMSKeys(keyFile string) (map[string][]byte, error) {
+	encoded := map[string]string{}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local KMS keyfile: %w", err)
+		}
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			return nil, fmt.Errorf("failed to parse local KMS keyfile: %w", err)
+		}
+	} else {
+		for _, pair := range strings.Split(os.Getenv(LocalKMSKeysEnv), ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			keyID, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed %s entry, expected <key id>:<base64 key>", LocalKMSKeysEnv)
+			}
+			encoded[keyID] = key
+		}
+	}
+
+	keys := make(map[string][]byte, len(encoded))
+	for keyID, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode local KMS key %s: %w", keyID, err)
+		}
+		keys[keyID] = key
+	}
+	return keys, nil
+}
+
+// NewLocalKMSClientFromConfig creates a local KMS from the keyfile configured in AWSConfig,
+// falling back to the LocalKMSKeysEnv environment variable
+func NewLocalKMSClientFromConfig(cfg models.AWSConfig) (*LocalKMSClient, error) {
+	keys, err := LoadLocalKMSKeys(cfg.LocalKMSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalKMSClient(keys)
+}
+
+// KeyIDs returns the IDs of the master keys held by the local KMS, sorted
+func (c *LocalKMSClient) KeyIDs() []string {
+	ids := make([]string, 0, len(c.keys))
+	for keyID := range c.keys {
+		ids = append(ids, keyID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// GenerateDataKey returns a random data key in plaintext and encrypted under the requested master key
+func (c *LocalKMSClient) GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	size := 32
+	switch {
+	case input.NumberOfBytes != nil:
+		size = int(*input.NumberOfBytes)
+	case input.KeySpec == types.DataKeySpecAes128:
+		size = 16
+	}
+	if size <= 0 || size > 1024 {
+		return nil, fmt.Errorf("invalid data key size %d", size)
+	}
+
+	plaintext := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	blob, keyID, err := c.seal(aws.ToString(input.KeyId), plaintext, input.EncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      plaintext,
+		CiphertextBlob: blob,
+		KeyId:          aws.String(keyID),
+	}, nil
+}
+
+// Encrypt encrypts plaintext under the requested master key
+func (c *LocalKMSClient) Encrypt(ctx context.Context, input *kms.EncryptInput, opts ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	blob, keyID, err := c.seal(aws.ToString(input.KeyId), input.Plaintext, input.EncryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.EncryptOutput{
+		CiphertextBlob:      blob,
+		KeyId:               aws.String(keyID),
+		EncryptionAlgorithm: types.EncryptionAlgorithmSpecSymmetricDefault,
+	}, nil
+}
+
+// Decrypt decrypts a ciphertext blob with the master key whose ID it embeds. When KeyId is set it
+// must match that key, as with AWS KMS.
+func (c *LocalKMSClient) Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	header, keyID, nonce, ciphertext, err := parseLocalKMSBlob(input.CiphertextBlob)
+	if err != nil {
+		return nil, err
+	}
+	if requested := aws.ToString(input.KeyId); requested != "" && requested != keyID {
+		return nil, &types.IncorrectKeyException{Message: aws.String(fmt.Sprintf("ciphertext was not encrypted under key %s", requested))}
+	}
+	key, ok := c.keys[keyID]
+	if !ok {
+		return nil, &types.NotFoundException{Message: aws.String(fmt.Sprintf("key %s not found", keyID))}
+	}
+
+	plaintext, err := openGCM(key, nonce, ciphertext, localKMSAssociatedData(header, input.EncryptionContext))
+	if err != nil {
+		return nil, &types.InvalidCiphertextException{Message: aws.String("ciphertext or encryption context is invalid")}
+	}
+	return &kms.DecryptOutput{
+		Plaintext:           plaintext,
+		KeyId:               aws.String(keyID),
+		EncryptionAlgorithm: types.EncryptionAlgorithmSpecSymmetricDefault,
+	}, nil
+}
+
+// seal encrypts plaintext under keyID, which defaults to the only key when there is exactly one
+func (c *LocalKMSClient) seal(keyID string, plaintext []byte, encryptionContext map[string]string) ([]byte, string, error) {
+	if keyID == "" && len(c.keys) == 1 {
+		keyID = c.KeyIDs()[0]
+	}
+	key, ok := c.keys[keyID]
+	if !ok {
+		return nil, "", &types.NotFoundException{Message: aws.String(fmt.Sprintf("key %s not found", keyID))}
+	}
+
+	var header bytes.Buffer
+	header.WriteString(localKMSMagic)
+	header.WriteByte(localKMSVersion)
+	header.WriteByte(byte(len(keyID)))
+	header.WriteString(keyID)
+
+	ciphertext, nonce, err := sealGCM(key, plaintext, localKMSAssociatedData(header.Bytes(), encryptionContext))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt with local key %s: %w", keyID, err)
+	}
+	blob := append(header.Bytes(), nonce...)
+	return append(blob, ciphertext...), keyID, nil
+}
+
+// parseLocalKMSBlob splits a ciphertext blob into its header, key ID, nonce and sealed plaintext
+func parseLocalKMSBlob(blob []byte) ([]byte, string, []byte, []byte, error) {
+	invalid := &types.InvalidCiphertextException{Message: aws.String("ciphertext blob was not produced by the local KMS")}
+	prefix := len(localKMSMagic) + 2
+	if len(blob) < prefix || string(blob[:len(localKMSMagic)]) != localKMSMagic || blob[len(localKMSMagic)] != localKMSVersion {
+		return nil, "", nil, nil, invalid
+	}
+	headerLen := prefix + int(blob[prefix-1])
+	if len(blob) < headerLen+gcmNonceSize {
+		return nil, "", nil, nil, invalid
+	}
+	return blob[:headerLen], string(blob[prefix:headerLen]), blob[headerLen : headerLen+gcmNonceSize], blob[headerLen+gcmNonceSize:], nil
+}
+
+// localKMSAssociatedData binds a ciphertext to its header, so the embedded key ID cannot be
+// altered, and to the caller's encryption context when one is given
+func localKMSAssociatedData(header []byte, encryptionContext map[string]string) []byte {
+	additionalData := append([]byte(nil), header...)
+	if len(encryptionContext) > 0 {
+		additionalData = append(additionalData, EncryptionContext(encryptionContext).AssociatedData()...)
+	}
+	return additionalData
+}
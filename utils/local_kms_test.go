@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLocalKMS(t *testing.T) *LocalKMSClient {
+	client, err := NewLocalKMSClient(map[string][]byte{
+		"key-a": []byte("0123456789abcdef0123456789abcdef"),
+		"key-b": []byte("fedcba9876543210fedcba9876543210"),
+	})
+	assert.NoError(t, err)
+	return client
+}
+
+func TestLocalKMSEncryptDecrypt(t *testing.T) {
+	client := newTestLocalKMS(t)
+
+	encrypted, err := client.Encrypt(context.TODO(), &kms.EncryptInput{KeyId: aws.String("key-b"), Plaintext: []byte("secret")})
+	assert.NoError(t, err)
+	assert.Equal(t, "key-b", aws.ToString(encrypted.KeyId))
+
+	// The key ID is read from the blob, no key needs to be passed
+	decrypted, err := client.Decrypt(context.TODO(), &kms.DecryptInput{CiphertextBlob: encrypted.CiphertextBlob})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decrypted.Plaintext)
+	assert.Equal(t, "key-b", aws.ToString(decrypted.KeyId))
+
+	var incorrectKey *types.IncorrectKeyException
+	_, err = client.Decrypt(context.TODO(), &kms.DecryptInput{CiphertextBlob: encrypted.CiphertextBlob, KeyId: aws.String("key-a")})
+	assert.True(t, errors.As(err, &incorrectKey))
+}
+
+func TestLocalKMSRejectsTamperedBlobs(t *testing.T) {
+	client := newTestLocalKMS(t)
+	encrypted, err := client.Encrypt(context.TODO(), &kms.EncryptInput{
+		KeyId:             aws.String("key-a"),
+		Plaintext:         []byte("secret"),
+		EncryptionContext: map[string]string{"applicant_id": "applicant123"},
+	})
+	assert.NoError(t, err)
+
+	var invalid *types.InvalidCiphertextException
+	_, err = client.Decrypt(context.TODO(), &kms.DecryptInput{CiphertextBlob: encrypted.CiphertextBlob})
+	assert.True(t, errors.As(err, &invalid), "missing encryption context")
+
+	tampered := append([]byte(nil), encrypted.CiphertextBlob...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = client.Decrypt(context.TODO(), &kms.DecryptInput{
+		CiphertextBlob:    tampered,
+		EncryptionContext: map[string]string{"applicant_id": "applicant123"},
+	})
+	assert.True(t, errors.As(err, &invalid))
+
+	_, err = client.Decrypt(context.TODO(), &kms.DecryptInput{CiphertextBlob: []byte("not a blob")})
+	assert.True(t, errors.As(err, &invalid))
+
+	var notFound *types.NotFoundException
+	_, err = client.Encrypt(context.TODO(), &kms.EncryptInput{KeyId: aws.String("missing"), Plaintext: []byte("secret")})
+	assert.True(t, errors.As(err, &notFound))
+}
+
+func TestLocalKMSThroughKMSUploader(t *testing.T) {
+	uploader := &KMSUploader{Client: newTestLocalKMS(t), KeyID: "key-a"}
+
+	plaintext, wrapped, err := uploader.GenerateDataKey(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, plaintext, 32)
+
+	unwrapped, err := uploader.DecryptData(context.TODO(), wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, unwrapped)
+}
+
+func TestNewKMSUploaderFromConfigLocal(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	keyFile := filepath.Join(t.TempDir(), "kms.json")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(`{"dev-key":"`+key+`"}`), 0600))
+
+	uploader, err := NewKMSUploaderFromConfig(models.AWSConfig{KMSProvider: KMSProviderLocal, LocalKMSKeyFile: keyFile})
+	assert.NoError(t, err)
+	assert.Equal(t, "dev-key", uploader.KeyID)
+
+	t.Setenv(LocalKMSKeysEnv, "env-key:"+key)
+	uploader, err = NewKMSUploaderFromConfig(models.AWSConfig{KMSProvider: KMSProviderLocal, KeyID: "env-key"})
+	assert.NoError(t, err)
+	assert.Equal(t, "env-key", uploader.KeyID)
+
+	_, err = NewKMSUploaderFromConfig(models.AWSConfig{KMSProvider: KMSProviderLocal, KeyID: "missing"})
+	assert.Error(t, err)
+	_, err = NewKMSUploaderFromConfig(models.AWSConfig{KMSProvider: "vault"})
+	assert.Error(t, err)
+}
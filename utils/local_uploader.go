@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+// localMetadataSuffix is appended to an object's path to name the file holding its metadata
+const localMetadataSuffix = ".meta.json"
+
+// LocalUploader stores encrypted uploads on the local filesystem. It is meant for development
+// and tests, objects are encrypted exactly as in S3 so the rest of the code cannot tell them apart.
+type LocalUploader struct {
+	Dir         string
+	SegmentSize int // Plaintext bytes per encrypted segment, defaults to DefaultStreamSegmentSize
+}
+
+// NewLocalUploader creates a local uploader storing objects under dir, creating it if needed
+func NewLocalUploader(dir string) (*LocalUploader, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no directory configured for local storage")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+	return &LocalUploader{Dir: dir}, nil
+}
+
+// UploadFile encrypts file with a fresh DEK and writes it under Dir, returning its object key
+func (u *LocalUploader) UploadFile(ctx context.Context, file io.Reader, fileName string, mimeType string, kmsUploader interfaces.KMSUploader) (string, error) {
+	if err := uploadEncrypted(ctx, u, file, fileName, mimeType, kmsUploader, u.SegmentSize); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// DownloadFile returns the raw object body, which is still encrypted, and its metadata
+func (u *LocalUploader) DownloadFile(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error) {
+	return u.getObject(ctx, objectKey)
+}
+
+// DownloadDecrypted returns the decrypted content of an object uploaded with UploadFile. The
+// caller must close the returned reader.
+func (u *LocalUploader) DownloadDecrypted(ctx context.Context, objectKey string, kmsUploader interfaces.KMSUploader) (io.ReadCloser, error) {
+	return downloadDecrypted(ctx, u, objectKey, kmsUploader)
+}
+
+// DeleteFile removes an object and its metadata, deleting a missing object is not an error
+func (u *LocalUploader) DeleteFile(ctx context.Context, objectKey string) error {
+	path, err := u.objectPath(objectKey)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{path, path + localMetadataSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			zaplogger.GetLogger().Error("failed to delete local object", zap.String("objectKey", objectKey), zap.Error(err))
+			return fmt.Errorf("failed to delete local object: %w", err)
+		}
+	}
+	return nil
+}
+
+// putObject writes body and its metadata through temporary files renamed into place, so a failed
+// upload never leaves a partial object behind
+func (u *LocalUploader) putObject(ctx context.Context, body io.Reader, info models.ObjectInfo) error {
+	path, err := u.objectPath(info.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create local object directory: %w", err)
+	}
+
+	info.Size, err = writeFileAtomic(path, body)
+	if err != nil {
+		zaplogger.GetLogger().Error("failed to write local object", zap.String("objectKey", info.Key), zap.Error(err))
+		return fmt.Errorf("failed to write local object: %w", err)
+	}
+	metadata, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode object metadata: %w", err)
+	}
+	if _, err := writeFileAtomic(path+localMetadataSuffix, bytes.NewReader(metadata)); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write local object metadata: %w", err)
+	}
+	return nil
+}
+
+func (u *LocalUploader) getObject(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error) {
+	path, err := u.objectPath(objectKey)
+	if err != nil {
+		return nil, models.ObjectInfo{}, err
+	}
+	var info models.ObjectInfo
+	metadata, err := os.ReadFile(path + localMetadataSuffix)
+	if err != nil {
+		return nil, info, fmt.Errorf("failed to read local object metadata: %w", err)
+	}
+	if err := json.Unmarshal(metadata, &info); err != nil {
+		return nil, info, fmt.Errorf("failed to decode local object metadata: %w", err)
+	}
+	body, err := os.Open(path)
+	if err != nil {
+		return nil, info, fmt.Errorf("failed to open local object: %w", err)
+	}
+	return body, info, nil
+}
+
+// objectPath maps an object key to a path under Dir, rejecting keys that could escape it
+func (u *LocalUploader) objectPath(objectKey string) (string, error) {
+	if objectKey == "" || strings.HasSuffix(objectKey, localMetadataSuffix) {
+		return "", fmt.Errorf("invalid object key %q", objectKey)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(objectKey), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("invalid object key %q", objectKey)
+		}
+	}
+	path := filepath.Join(u.Dir, filepath.FromSlash(objectKey))
+	if rel, err := filepath.Rel(u.Dir, path); err != nil || rel == "." {
+		return "", fmt.Errorf("invalid object key %q", objectKey)
+	}
+	return path, nil
+}
+
+// writeFileAtomic writes content to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, content io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,101 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalUploaderRoundTrip(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	dir := t.TempDir()
+	uploader, err := utils.NewLocalUploader(dir)
+	assert.NoError(t, err)
+	uploader.SegmentSize = 1024
+
+	content := bytes.Repeat([]byte("driving licence "), 500)
+	objectKey, err := uploader.UploadFile(context.Background(), bytes.NewReader(content), "applicant-1/licence.jpg", "image/jpeg", kmsUploader)
+	assert.NoError(t, err)
+	assert.Equal(t, "applicant-1/licence.jpg", objectKey)
+
+	// The stored object is encrypted
+	raw, info, err := uploader.DownloadFile(context.Background(), objectKey)
+	assert.NoError(t, err)
+	stored, _ := io.ReadAll(raw)
+	raw.Close()
+	assert.NotContains(t, string(stored), "driving licence")
+	assert.Equal(t, "image/jpeg", info.ContentType)
+	assert.Equal(t, int64(len(stored)), info.Size)
+	assert.Equal(t, "2", info.Metadata["format-version"])
+
+	reader, err := uploader.DownloadDecrypted(context.Background(), objectKey, kmsUploader)
+	assert.NoError(t, err)
+	decrypted, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, decrypted)
+
+	assert.NoError(t, uploader.DeleteFile(context.Background(), objectKey))
+	_, err = os.Stat(filepath.Join(dir, "applicant-1", "licence.jpg"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.NoError(t, uploader.DeleteFile(context.Background(), objectKey))
+}
+
+func TestLocalUploaderDetectsSwappedObjects(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	dir := t.TempDir()
+	uploader, err := utils.NewLocalUploader(dir)
+	assert.NoError(t, err)
+
+	_, err = uploader.UploadFile(context.Background(), bytes.NewReader([]byte("passport")), "a.jpg", "image/jpeg", kmsUploader)
+	assert.NoError(t, err)
+	_, err = uploader.UploadFile(context.Background(), bytes.NewReader([]byte("selfie")), "b.jpg", "image/jpeg", kmsUploader)
+	assert.NoError(t, err)
+
+	// Copy one object and its metadata over the other
+	for _, suffix := range []string{"", ".meta.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, "a.jpg"+suffix))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.jpg"+suffix), data, 0o600))
+	}
+
+	// Streamed objects are authenticated segment by segment as they are read
+	reader, err := uploader.DownloadDecrypted(context.Background(), "b.jpg", kmsUploader)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	var tampered *utils.TamperedObjectError
+	assert.ErrorAs(t, err, &tampered)
+}
+
+func TestLocalUploaderRejectsEscapingKeys(t *testing.T) {
+	uploader, err := utils.NewLocalUploader(t.TempDir())
+	assert.NoError(t, err)
+
+	for _, key := range []string{"", "/", "../outside.jpg", "a/../../outside.jpg", "a.jpg.meta.json"} {
+		_, err := uploader.UploadFile(context.Background(), bytes.NewReader([]byte("x")), key, "image/jpeg", newLocalKMSUploader(t))
+		assert.Error(t, err, key)
+	}
+}
+
+func TestNewUploaderFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	uploader, err := utils.NewUploaderFromConfig(models.AWSConfig{StorageBackend: utils.StorageBackendLocal, LocalStorageDir: dir})
+	assert.NoError(t, err)
+	assert.IsType(t, &utils.LocalUploader{}, uploader)
+
+	uploader, err = utils.NewUploaderFromConfig(models.AWSConfig{Region: "us-east-1", BucketName: "docs", S3Endpoint: "http://localhost:9000", S3UsePathStyle: true})
+	assert.NoError(t, err)
+	assert.IsType(t, &utils.S3Uploader{}, uploader)
+
+	_, err = utils.NewUploaderFromConfig(models.AWSConfig{StorageBackend: "ftp"})
+	assert.Error(t, err)
+}
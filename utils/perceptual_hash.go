@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	// DefaultSimilarityThreshold is the Hamming distance up to which two perceptual hashes are
+	// considered the same picture
+	DefaultSimilarityThreshold = 10
+
+	// dHashWidth x dHashHeight cells are compared horizontally, giving 64 bits
+	dHashWidth  = 9
+	dHashHeight = 8
+	// dHashSamples is the number of pixels sampled per cell side, bounding the cost for large images
+	dHashSamples = 8
+)
+
+// ImagePerceptualHash decodes an image and returns its perceptual hash, see PerceptualHash
+func ImagePerceptualHash(data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	return FormatPerceptualHash(PerceptualHash(img)), nil
+}
+
+// PerceptualHash returns the difference hash (dHash) of an image: the image is reduced to a 9x8
+// grayscale grid and each bit records whether a cell is brighter than its right neighbour. Unlike
+// a content hash it barely changes when the picture is re-compressed, resized or slightly cropped,
+// so near-duplicates are found by comparing hashes with HammingDistance.
+func PerceptualHash(img image.Image) uint64 {
+	var grid [dHashHeight][dHashWidth]float64
+	bounds := img.Bounds()
+	cellWidth := float64(bounds.Dx()) / dHashWidth
+	cellHeight := float64(bounds.Dy()) / dHashHeight
+	for row := 0; row < dHashHeight; row++ {
+		for col := 0; col < dHashWidth; col++ {
+			// Average a grid of samples spread over the cell
+			var sum float64
+			for sy := 0; sy < dHashSamples; sy++ {
+				for sx := 0; sx < dHashSamples; sx++ {
+					x := bounds.Min.X + int((float64(col)+(float64(sx)+0.5)/dHashSamples)*cellWidth)
+					y := bounds.Min.Y + int((float64(row)+(float64(sy)+0.5)/dHashSamples)*cellHeight)
+					r, g, b, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			grid[row][col] = sum
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < dHashHeight; row++ {
+		for col := 0; col < dHashWidth-1; col++ {
+			hash <<= 1
+			if grid[row][col] > grid[row][col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of bits two perceptual hashes differ in
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatPerceptualHash returns the 16 hex digit form a perceptual hash is stored in
+func FormatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParsePerceptualHash parses a hash formatted with FormatPerceptualHash
+func ParsePerceptualHash(hash string) (uint64, error) {
+	if len(hash) != 16 {
+		return 0, fmt.Errorf("invalid perceptual hash %q", hash)
+	}
+	return strconv.ParseUint(hash, 16, 64)
+}
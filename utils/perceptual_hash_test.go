@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPortrait draws a pattern of gradients and blocks
+func testPortrait(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x*7 + y*3 + 40) % 256)
+			if ((x/(width/6+1))+(y/(height/5)))%2 == 0 {
+				v = 255 - v/3
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func reencodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}))
+	return buf.Bytes()
+}
+
+func TestPerceptualHashFindsNearDuplicates(t *testing.T) {
+	original := testPortrait(600, 800)
+	hash, err := ImagePerceptualHash(reencodeJPEG(t, original, 95))
+	assert.NoError(t, err)
+
+	// Heavily re-compressed copy
+	recompressed, err := ImagePerceptualHash(reencodeJPEG(t, original, 30))
+	assert.NoError(t, err)
+
+	// Slightly cropped copy
+	cropped := image.NewRGBA(image.Rect(0, 0, 580, 780))
+	draw.Draw(cropped, cropped.Bounds(), original, image.Point{X: 10, Y: 10}, draw.Src)
+	croppedHash, err := ImagePerceptualHash(reencodeJPEG(t, cropped, 80))
+	assert.NoError(t, err)
+
+	// Another picture, here the mirror image which has the opposite gradients
+	other := image.NewRGBA(original.Bounds())
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 600; x++ {
+			other.Set(599-x, y, original.At(x, y))
+		}
+	}
+	otherHash, err := ImagePerceptualHash(reencodeJPEG(t, other, 95))
+	assert.NoError(t, err)
+
+	parse := func(s string) uint64 {
+		value, err := ParsePerceptualHash(s)
+		assert.NoError(t, err)
+		return value
+	}
+	assert.LessOrEqual(t, HammingDistance(parse(hash), parse(recompressed)), DefaultSimilarityThreshold)
+	assert.LessOrEqual(t, HammingDistance(parse(hash), parse(croppedHash)), DefaultSimilarityThreshold)
+	assert.Greater(t, HammingDistance(parse(hash), parse(otherHash)), DefaultSimilarityThreshold)
+}
+
+func TestParsePerceptualHash(t *testing.T) {
+	value, err := ParsePerceptualHash(FormatPerceptualHash(0x00ff00ff00ff00ff))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x00ff00ff00ff00ff), value)
+
+	_, err = ParsePerceptualHash("abc")
+	assert.Error(t, err)
+	_, err = ParsePerceptualHash("zzzzzzzzzzzzzzzz")
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedAccessURL(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now()
+	claims := AccessClaims{DocumentID: "doc-1", ClientID: "client123", Actor: "user1", ExpiresAt: now.Add(time.Minute)}
+
+	signed, err := SignAccessURL("https://api.example.com/", key, claims)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(signed, "https://api.example.com/documents/doc-1/content?"))
+	parsed, err := url.Parse(signed)
+	assert.NoError(t, err)
+
+	verified, err := VerifyAccessQuery(key, "doc-1", parsed.Query(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "client123", verified.ClientID)
+	assert.Equal(t, "user1", verified.Actor)
+
+	// Expiry is enforced by the server, not the URL
+	_, err = VerifyAccessQuery(key, "doc-1", parsed.Query(), now.Add(2*time.Minute))
+	assert.ErrorIs(t, err, ErrAccessURLExpired)
+
+	// The URL is only valid for the document it was issued for
+	_, err = VerifyAccessQuery(key, "doc-2", parsed.Query(), now)
+	assert.ErrorIs(t, err, ErrAccessURLInvalid)
+
+	extended := parsed.Query()
+	extended.Set("expires", "9999999999")
+	_, err = VerifyAccessQuery(key, "doc-1", extended, now)
+	assert.ErrorIs(t, err, ErrAccessURLInvalid)
+
+	_, err = VerifyAccessQuery([]byte("another key, also 32 bytes long!"), "doc-1", parsed.Query(), now)
+	assert.ErrorIs(t, err, ErrAccessURLInvalid)
+}
+
+func TestSignAccessURLRequiresKey(t *testing.T) {
+	_, err := SignAccessURL("https://api.example.com", nil, AccessClaims{DocumentID: "doc-1"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streaming AEAD format used for uploaded files (FileFormatStream). The plaintext is split into
+// fixed-size segments sealed one at a time with AES-GCM, so files of any size are encrypted and
+// decrypted with bounded memory:
+//
+//	header:  "VSA1" | segment size (uint32) | nonce prefix (7 bytes)
+//	segment: AES-GCM(segment plaintext), nonce = nonce prefix | segment index (uint32) | last flag
+//
+// The segment index in the nonce authenticates segment order, and the last flag, set only on the
+// final segment, detects truncation. Every segment is also bound to the header and the caller's
+// associated data (e.g. the object key).
+const (
+	streamMagic           = "VSA1"
+	streamNoncePrefixSize = 7
+	streamHeaderSize      = len(streamMagic) + 4 + streamNoncePrefixSize
+	streamTagSize         = 16
+
+	// DefaultStreamSegmentSize is the plaintext size of each encrypted segment
+	DefaultStreamSegmentSize = 64 * 1024
+	maxStreamSegmentSize     = 16 * 1024 * 1024
+)
+
+var (
+	// ErrStreamTruncated is returned when an encrypted stream ends before its final segment
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	// ErrStreamCorrupted is returned when a segment fails authentication, e.g. because it was
+	// modified, reordered, or the key or associated data do not match
+	ErrStreamCorrupted = errors.New("encrypted stream failed authentication")
+)
+
+// StreamCiphertextSize returns the size of the encrypted stream for a plaintext of the given size
+func StreamCiphertextSize(plaintextSize int64, segmentSize int) int64 {
+	segments := plaintextSize/int64(segmentSize) + 1
+	if plaintextSize > 0 && plaintextSize%int64(segmentSize) == 0 {
+		segments--
+	}
+	return int64(streamHeaderSize) + plaintextSize + segments*streamTagSize
+}
+
+type streamEncryptor struct {
+	src            *bufio.Reader
+	aead           cipher.AEAD
+	noncePrefix    []byte
+	additionalData []byte
+	plaintext      []byte
+	sealed         []byte
+	pending        []byte // Sealed bytes not yet returned to the caller
+	index          uint32
+	done           bool
+}
+
+// NewEncryptingReader returns a reader producing the streaming AEAD encryption of src under key.
+// Only one segment is held in memory at a time.
+func NewEncryptingReader(src io.Reader, key []byte, additionalData []byte, segmentSize int) (io.Reader, error) {
+	if segmentSize <= 0 || segmentSize > maxStreamSegmentSize {
+		return nil, fmt.Errorf("invalid stream segment size %d", segmentSize)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], uint32(segmentSize))
+	noncePrefix := header[len(streamMagic)+4:]
+	if _, err := io.ReadFull(rand.Reader, noncePrefix); err != nil {
+		return nil, err
+	}
+
+	return &streamEncryptor{
+		src:            bufio.NewReader(src),
+		aead:           aead,
+		noncePrefix:    noncePrefix,
+		additionalData: append(append([]byte(nil), header...), additionalData...),
+		plaintext:      make([]byte, segmentSize),
+		sealed:         make([]byte, 0, segmentSize+streamTagSize),
+		pending:        header,
+	}, nil
+}
+
+func (e *streamEncryptor) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+func (e *streamEncryptor) sealNext() error {
+	n, err := io.ReadFull(e.src, e.plaintext)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read plaintext: %w", err)
+	}
+	// The segment is the last one when the source has nothing more to give
+	last := err != nil
+	if !last {
+		if _, peekErr := e.src.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return fmt.Errorf("failed to read plaintext: %w", peekErr)
+		}
+	}
+
+	nonce := streamNonce(e.noncePrefix, e.index, last)
+	e.pending = e.aead.Seal(e.sealed[:0], nonce, e.plaintext[:n], e.additionalData)
+	e.index++
+	e.done = last
+	if e.index == 0 {
+		return fmt.Errorf("encrypted stream has too many segments")
+	}
+	return nil
+}
+
+type streamDecryptor struct {
+	src            *bufio.Reader
+	aead           cipher.AEAD
+	noncePrefix    []byte
+	additionalData []byte
+	ciphertext     []byte
+	plaintext      []byte
+	pending        []byte // Opened bytes not yet returned to the caller
+	index          uint32
+	done           bool
+}
+
+// NewDecryptingReader returns a reader decrypting a stream produced by NewEncryptingReader. Each
+// segment is authenticated before any of its plaintext is returned; a stream that is truncated,
+// reordered or modified fails with ErrStreamTruncated or ErrStreamCorrupted.
+func NewDecryptingReader(src io.Reader, key []byte, additionalData []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrStreamTruncated
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamCorrupted
+	}
+	segmentSize := int(binary.BigEndian.Uint32(header[len(streamMagic):]))
+	if segmentSize <= 0 || segmentSize > maxStreamSegmentSize {
+		return nil, ErrStreamCorrupted
+	}
+
+	return &streamDecryptor{
+		src:            bufio.NewReader(src),
+		aead:           aead,
+		noncePrefix:    header[len(streamMagic)+4:],
+		additionalData: append(append([]byte(nil), header...), additionalData...),
+		ciphertext:     make([]byte, segmentSize+streamTagSize),
+		plaintext:      make([]byte, 0, segmentSize),
+	}, nil
+}
+
+func (d *streamDecryptor) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *streamDecryptor) openNext() error {
+	n, err := io.ReadFull(d.src, d.ciphertext)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read ciphertext: %w", err)
+	}
+	if n < streamTagSize {
+		return ErrStreamTruncated
+	}
+	last := err != nil
+	if !last {
+		if _, peekErr := d.src.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return fmt.Errorf("failed to read ciphertext: %w", peekErr)
+		}
+	}
+
+	plaintext, openErr := d.aead.Open(d.plaintext[:0], streamNonce(d.noncePrefix, d.index, last), d.ciphertext[:n], d.additionalData)
+	if openErr != nil {
+		// A segment sealed as non-final at the end of the stream means later segments were cut off
+		if last {
+			if _, retryErr := d.aead.Open(nil, streamNonce(d.noncePrefix, d.index, false), d.ciphertext[:n], d.additionalData); retryErr == nil {
+				return ErrStreamTruncated
+			}
+		}
+		return ErrStreamCorrupted
+	}
+	d.pending = plaintext
+	d.index++
+	d.done = last
+	return nil
+}
+
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, gcmNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], index)
+	if last {
+		nonce[gcmNonceSize-1] = 1
+	}
+	return nonce
+}
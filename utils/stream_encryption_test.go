@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptStream(t *testing.T, plaintext []byte, segmentSize int) []byte {
+	reader, err := NewEncryptingReader(bytes.NewReader(plaintext), testFieldKey, []byte("object.pdf"), segmentSize)
+	assert.NoError(t, err)
+	ciphertext, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return ciphertext
+}
+
+func decryptStream(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	reader, err := NewDecryptingReader(bytes.NewReader(ciphertext), testFieldKey, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestStreamEncryptionRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 15, 16, 17, 64, 1000} {
+		plaintext := make([]byte, size)
+		_, _ = rand.Read(plaintext)
+
+		ciphertext := encryptStream(t, plaintext, 16)
+		assert.Equal(t, StreamCiphertextSize(int64(size), 16), int64(len(ciphertext)), "size %d", size)
+
+		decrypted, err := decryptStream(ciphertext, []byte("object.pdf"))
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, plaintext, append([]byte{}, decrypted...), "size %d", size)
+	}
+}
+
+func TestStreamEncryptionDetectsTampering(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 4) // Exactly four 16 byte segments
+	ciphertext := encryptStream(t, plaintext, 16)
+	segment := 16 + streamTagSize
+
+	// Dropping the final segment leaves a non-final segment at the end
+	_, err := decryptStream(ciphertext[:len(ciphertext)-segment], []byte("object.pdf"))
+	assert.ErrorIs(t, err, ErrStreamTruncated)
+
+	// Swapping two segments breaks the authenticated order
+	swapped := append([]byte{}, ciphertext...)
+	first := streamHeaderSize
+	copy(swapped[first:first+segment], ciphertext[first+segment:first+2*segment])
+	copy(swapped[first+segment:first+2*segment], ciphertext[first:first+segment])
+	_, err = decryptStream(swapped, []byte("object.pdf"))
+	assert.ErrorIs(t, err, ErrStreamCorrupted)
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[streamHeaderSize+3] ^= 1
+	_, err = decryptStream(flipped, []byte("object.pdf"))
+	assert.ErrorIs(t, err, ErrStreamCorrupted)
+
+	// A stream moved to another object key does not decrypt
+	_, err = decryptStream(ciphertext, []byte("other.pdf"))
+	assert.ErrorIs(t, err, ErrStreamCorrupted)
+
+	_, err = decryptStream(ciphertext[:streamHeaderSize-1], []byte("object.pdf"))
+	assert.ErrorIs(t, err, ErrStreamTruncated)
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Registers the JPEG decoder for image.DecodeConfig
+	_ "image/png"  // Registers the PNG decoder for image.DecodeConfig
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+)
+
+const (
+	MimeTypeJPEG = "image/jpeg"
+	MimeTypePNG  = "image/png"
+	MimeTypePDF  = "application/pdf"
+	MimeTypeMP4  = "video/mp4"
+	MimeTypeWebM = "video/webm"
+
+	// sniffSize is the number of bytes http.DetectContentType looks at
+	sniffSize = 512
+)
+
+// UploadRule restricts the files accepted for a document type
+type UploadRule struct {
+	AllowedTypes []string // Sniffed content types accepted
+	MaxSize      int64    // Maximum file size in bytes
+	MinWidth     int      // Minimum image width in pixels, images only
+	MinHeight    int      // Minimum image height in pixels, images only
+	MaxPixels    int64    // Maximum image width * height, guards against decompression bombs
+}
+
+// UploadRules maps each accepted document type to its rule, types without a rule are rejected
+type UploadRules map[models.DocumentType]UploadRule
+
+var (
+	identityDocumentRule = UploadRule{
+		AllowedTypes: []string{MimeTypeJPEG, MimeTypePNG, MimeTypePDF},
+		MaxSize:      10 << 20,
+		MinWidth:     600,
+		MinHeight:    400,
+		MaxPixels:    50_000_000,
+	}
+	supportingDocumentRule = UploadRule{
+		AllowedTypes: []string{MimeTypeJPEG, MimeTypePNG, MimeTypePDF},
+		MaxSize:      20 << 20,
+		MinWidth:     600,
+		MinHeight:    600,
+		MaxPixels:    50_000_000,
+	}
+)
+
+// DefaultUploadRules are the rules applied to document uploads. HEIC images are not accepted:
+// there is no decoder to strip their metadata, so clients must convert them to JPEG first.
+var DefaultUploadRules = UploadRules{
+	models.DocumentPassport:             identityDocumentRule,
+	models.DocumentDriverLicense:        identityDocumentRule,
+	models.DocumentNationalID:           identityDocumentRule,
+	models.DocumentIDCard:               identityDocumentRule,
+	models.DocumentUtilityBill:          supportingDocumentRule,
+	models.DocumentBankStatement:        supportingDocumentRule,
+	models.DocumentBusinessRegistration: supportingDocumentRule,
+	models.DocumentTaxDocument:          supportingDocumentRule,
+	models.DocumentProofOfAddress:       supportingDocumentRule,
+	models.DocumentFinancialStatement:   supportingDocumentRule,
+	models.DocumentOther:                supportingDocumentRule,
+	models.DocumentSelfie: {
+		AllowedTypes: []string{MimeTypeJPEG, MimeTypePNG},
+		MaxSize:      10 << 20,
+		MinWidth:     480,
+		MinHeight:    480,
+		MaxPixels:    50_000_000,
+	},
+	models.DocumentVideoSelfie: {
+		AllowedTypes: []string{MimeTypeMP4, MimeTypeWebM},
+		MaxSize:      100 << 20,
+	},
+}
+
+// mimeTypeAliases maps non-standard content types sent by clients to the sniffed equivalent
+var mimeTypeAliases = map[string]string{
+	"image/jpg":   MimeTypeJPEG,
+	"image/pjpeg": MimeTypeJPEG,
+	"image/x-png": MimeTypePNG,
+}
+
+// ValidatedUpload is a file that passed validation, ready to be encrypted and uploaded
+type ValidatedUpload struct {
+	Reader      io.Reader // Full file content; fails with a FieldError if it grows beyond the size limit
+	ContentType string    // Sniffed content type, to be stored instead of the declared one
+	Width       int       // Image dimensions, zero for other content
+	Height      int
+}
+
+// Validate checks a file uploaded as docType before it is encrypted. It sniffs the real content
+// type from the file content, rejects it if it is not allowed for docType or does not match the
+// declared content type, enforces the size limit and checks image dimensions. size is the size
+// announced by the client, or -1 if unknown; the limit is enforced on the content read either way.
+// Rejections are returned as *errors.FieldError.
+func (r UploadRules) Validate(file io.Reader, size int64, docType models.DocumentType, declaredType string) (ValidatedUpload, error) {
+	rule, ok := r[docType]
+	if !ok {
+		return ValidatedUpload{}, apperrors.NewFieldError("document_type", fmt.Sprintf("uploads are not accepted for document type %s", docType))
+	}
+	tooLarge := apperrors.NewFieldError("file", fmt.Sprintf("file exceeds the maximum size of %s for %s", formatSize(rule.MaxSize), docType))
+	if size > rule.MaxSize {
+		return ValidatedUpload{}, tooLarge
+	}
+	content := io.Reader(&sizeLimitedReader{r: file, max: rule.MaxSize, err: tooLarge})
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ValidatedUpload{}, err
+	}
+	if n == 0 {
+		return ValidatedUpload{}, apperrors.NewFieldError("file", "file is empty")
+	}
+	head = head[:n]
+	content = io.MultiReader(bytes.NewReader(head), content)
+
+	upload := ValidatedUpload{ContentType: normalizeMimeType(http.DetectContentType(head))}
+	if !slices.Contains(rule.AllowedTypes, upload.ContentType) {
+		return ValidatedUpload{}, apperrors.NewFieldError("file", fmt.Sprintf("file content %s is not accepted for %s, expected one of %s",
+			upload.ContentType, docType, strings.Join(rule.AllowedTypes, ", ")))
+	}
+	if declared := normalizeMimeType(declaredType); declared != "" && declared != "application/octet-stream" && declared != upload.ContentType {
+		return ValidatedUpload{}, apperrors.NewFieldError("file", fmt.Sprintf("declared content type %s does not match the file content %s", declared, upload.ContentType))
+	}
+
+	if strings.HasPrefix(upload.ContentType, "image/") {
+		// Keep the bytes the decoder consumes so the full file can still be read afterwards
+		var consumed bytes.Buffer
+		config, _, err := image.DecodeConfig(io.TeeReader(content, &consumed))
+		if err != nil {
+			if fieldErr, ok := err.(*apperrors.FieldError); ok {
+				return ValidatedUpload{}, fieldErr
+			}
+			return ValidatedUpload{}, apperrors.NewFieldError("file", "image is corrupted or truncated")
+		}
+		if err := rule.checkDimensions(config.Width, config.Height, docType); err != nil {
+			return ValidatedUpload{}, err
+		}
+		upload.Width, upload.Height = config.Width, config.Height
+		content = io.MultiReader(&consumed, content)
+	}
+
+	upload.Reader = content
+	return upload, nil
+}
+
+func (r UploadRule) checkDimensions(width, height int, docType models.DocumentType) error {
+	if width <= 0 || height <= 0 {
+		return apperrors.NewFieldError("file", "image has no pixels")
+	}
+	if r.MaxPixels > 0 && int64(width)*int64(height) > r.MaxPixels {
+		return apperrors.NewFieldError("file", fmt.Sprintf("image of %dx%d pixels is too large", width, height))
+	}
+	// Accept images in either orientation
+	short, long := min(width, height), max(width, height)
+	if short < min(r.MinWidth, r.MinHeight) || long < max(r.MinWidth, r.MinHeight) {
+		return apperrors.NewFieldError("file", fmt.Sprintf("image of %dx%d pixels is too small for %s, at least %dx%d is required",
+			width, height, docType, r.MinWidth, r.MinHeight))
+	}
+	return nil
+}
+
+// sizeLimitedReader fails with err once more than max bytes have been read
+type sizeLimitedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+	err  error
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return 0, l.err
+	}
+	return n, err
+}
+
+// normalizeMimeType strips parameters from a content type and resolves known aliases
+func normalizeMimeType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if alias, ok := mimeTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+func formatSize(size int64) string {
+	if size%(1<<20) == 0 {
+		return fmt.Sprintf("%d MB", size>>20)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+	return buf.Bytes()
+}
+
+func assertFieldError(t *testing.T, err error, field string) {
+	var fieldErr *apperrors.FieldError
+	if assert.ErrorAs(t, err, &fieldErr) {
+		assert.Equal(t, field, fieldErr.Field)
+	}
+}
+
+func TestValidateUploadAcceptsImage(t *testing.T) {
+	content := testPNG(t, 800, 600)
+	upload, err := DefaultUploadRules.Validate(bytes.NewReader(content), int64(len(content)), models.DocumentPassport, "image/png")
+	assert.NoError(t, err)
+	assert.Equal(t, MimeTypePNG, upload.ContentType)
+	assert.Equal(t, 800, upload.Width)
+	assert.Equal(t, 600, upload.Height)
+
+	// The full file is still readable after sniffing and decoding
+	read, err := io.ReadAll(upload.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	// Portrait images are accepted as well
+	content = testPNG(t, 600, 800)
+	_, err = DefaultUploadRules.Validate(bytes.NewReader(content), -1, models.DocumentPassport, "")
+	assert.NoError(t, err)
+}
+
+func TestValidateUploadRejects(t *testing.T) {
+	image := testPNG(t, 800, 600)
+	pdf := []byte("%PDF-1.7\n" + string(bytes.Repeat([]byte("0"), 1024)))
+	mp4 := append([]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p', 'm', 'p', '4', '2', 0, 0, 0, 0, 'm', 'p', '4', '1', 'i', 's', 'o', 'm'}, make([]byte, 64)...)
+
+	tests := []struct {
+		name     string
+		content  []byte
+		size     int64
+		docType  models.DocumentType
+		declared string
+		field    string
+	}{
+		{"video for passport", mp4, -1, models.DocumentPassport, "video/mp4", "file"},
+		{"image for video selfie", image, -1, models.DocumentVideoSelfie, "image/png", "file"},
+		{"pdf for selfie", pdf, -1, models.DocumentSelfie, "application/pdf", "file"},
+		{"declared type mismatch", pdf, -1, models.DocumentPassport, "image/jpeg", "file"},
+		{"announced size too large", image, 11 << 20, models.DocumentPassport, "image/png", "file"},
+		{"image too small", testPNG(t, 300, 200), -1, models.DocumentPassport, "image/png", "file"},
+		{"truncated image", image[:20], -1, models.DocumentPassport, "image/png", "file"},
+		{"empty file", nil, 0, models.DocumentPassport, "", "file"},
+		{"unknown document type", image, -1, models.DocumentType(99), "image/png", "document_type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DefaultUploadRules.Validate(bytes.NewReader(tt.content), tt.size, tt.docType, tt.declared)
+			assertFieldError(t, err, tt.field)
+		})
+	}
+}
+
+func TestValidateUploadAcceptsOtherFormats(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n")
+	upload, err := DefaultUploadRules.Validate(bytes.NewReader(pdf), -1, models.DocumentUtilityBill, "application/pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, MimeTypePDF, upload.ContentType)
+
+	mp4 := append([]byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p', 'm', 'p', '4', '2', 0, 0, 0, 0, 'm', 'p', '4', '1', 'i', 's', 'o', 'm'}, make([]byte, 64)...)
+	upload, err = DefaultUploadRules.Validate(bytes.NewReader(mp4), -1, models.DocumentVideoSelfie, "video/mp4")
+	assert.NoError(t, err)
+	assert.Equal(t, MimeTypeMP4, upload.ContentType)
+}
+
+func TestValidateUploadEnforcesSizeWhileReading(t *testing.T) {
+	rules := UploadRules{models.DocumentPassport: {AllowedTypes: []string{MimeTypePDF}, MaxSize: 2048}}
+	content := append([]byte("%PDF-1.7\n"), make([]byte, 4096)...)
+
+	// The client did not announce the size, the limit is hit while the file is read for upload
+	upload, err := rules.Validate(bytes.NewReader(content), -1, models.DocumentPassport, "")
+	assert.NoError(t, err)
+	_, err = io.ReadAll(upload.Reader)
+	assertFieldError(t, err, "file")
+}
+
+func TestNormalizeMimeType(t *testing.T) {
+	assert.Equal(t, MimeTypeJPEG, normalizeMimeType("image/jpg"))
+	assert.Equal(t, "text/plain", normalizeMimeType("text/plain; charset=utf-8"))
+	assert.Equal(t, MimeTypePNG, normalizeMimeType("IMAGE/PNG"))
+	assert.Equal(t, "", normalizeMimeType(""))
+}
@@ -3,127 +3,219 @@ package utils
 import (
 	"bytes"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/rachel-lawrie/verus_backend_core/interfaces"
+	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
 	"go.uber.org/zap"
 )
 
+const (
+	// Object formats recorded in the "format-version" metadata of uploaded files. Objects without
+	// it were sealed whole with AES-GCM and no associated data.
+	FileFormatSealed = 1 // Sealed whole with AES-GCM, bound to the object key, nonce in metadata
+	FileFormatStream = 2 // Streaming AEAD (see NewEncryptingReader), bound to the object key
+
+	// s3PartSize is the size of each multipart upload part, the S3 minimum for all but the last
+	s3PartSize = 5 * 1024 * 1024
+)
+
+// ErrObjectNotFound is returned, wrapped, by DeleteFile when the object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
 type S3Uploader struct {
-	Client     *s3.Client
-	BucketName string
+	Client      interfaces.S3Client
+	BucketName  string
+	SegmentSize int // Plaintext bytes per encrypted segment, defaults to DefaultStreamSegmentSize
 }
 
-func (u *S3Uploader) UploadFile(ctx context.Context, file multipart.File, fileName string, mimeType string, kmsUploader interfaces.KMSUploader) (string, error) { // Generate a DEK using KMSUploader
-
-	logger := zaplogger.GetLogger()
-	plaintextKey, encryptedKey, err := kmsUploader.GenerateDataKey(ctx)
-	if err != nil {
-		logger.Error("failed to generate data key", zap.Error(err))
-		return "", fmt.Errorf("failed to generate data key: %v", err)
+// UploadFile encrypts file with a fresh DEK and streams it to S3 as a multipart upload, so memory
+// use is bounded by one part regardless of the file size. It returns the object key to store on
+// the document; the object is private and only readable through DownloadDecrypted.
+func (u *S3Uploader) UploadFile(ctx context.Context, file io.Reader, fileName string, mimeType string, kmsUploader interfaces.KMSUploader) (string, error) {
+	if err := uploadEncrypted(ctx, u, file, fileName, mimeType, kmsUploader, u.SegmentSize); err != nil {
+		return "", err
 	}
+	return fileName, nil
+}
 
-	// Step 2: Read the file content into memory
-	var fileBuffer bytes.Buffer
-	_, err = io.Copy(&fileBuffer, file)
+// putObject uploads body to S3 part by part, with the encryption metadata as object metadata
+func (u *S3Uploader) putObject(ctx context.Context, body io.Reader, info models.ObjectInfo) error {
+	logger := zaplogger.GetLogger()
+	upload, err := u.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &u.BucketName,
+		Key:         &info.Key,
+		ContentType: &info.ContentType,
+		ACL:         types.ObjectCannedACLPrivate,
+		Metadata:    info.Metadata,
+	})
 	if err != nil {
-		logger.Error("failed to read file", zap.Error(err))
-		return "", fmt.Errorf("failed to read file: %v", err)
+		logger.Error("failed to create multipart upload", zap.Error(err))
+		return fmt.Errorf("failed to create multipart upload: %v", err)
 	}
-	plaintextData := fileBuffer.Bytes()
 
-	// Step 3: Encrypt the file using AES-GCM
-	block, err := aes.NewCipher(plaintextKey)
-	if err != nil {
-		logger.Error("failed to create AES cipher", zap.Error(err))
-		return "", fmt.Errorf("failed to create AES cipher: %v", err)
+	if err := u.uploadParts(ctx, info.Key, upload.UploadId, body); err != nil {
+		logger.Error("failed to upload encrypted file to S3", zap.Error(err))
+		// Abort so S3 does not keep (and bill for) the parts already uploaded
+		if _, abortErr := u.Client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   &u.BucketName,
+			Key:      &info.Key,
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			logger.Error("failed to abort multipart upload", zap.Error(abortErr))
+		}
+		return fmt.Errorf("failed to upload encrypted file to S3: %v", err)
 	}
+	return nil
+}
 
-	nonce := make([]byte, 12) // GCM nonce size is 12 bytes
-	if _, err = rand.Read(nonce); err != nil {
-		logger.Error("failed to generate nonce", zap.Error(err))
-		return "", fmt.Errorf("failed to generate nonce: %v", err)
+// uploadParts uploads body in s3PartSize parts and completes the multipart upload
+func (u *S3Uploader) uploadParts(ctx context.Context, fileName string, uploadID *string, body io.Reader) error {
+	part := make([]byte, s3PartSize)
+	var completed []types.CompletedPart
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(body, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// An empty stream still has a header, so the first part is never empty
+		if n == 0 {
+			break
+		}
+
+		output, uploadErr := u.Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        &u.BucketName,
+			Key:           &fileName,
+			UploadId:      uploadID,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(part[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if uploadErr != nil {
+			return fmt.Errorf("failed to upload part %d: %w", partNumber, uploadErr)
+		}
+		completed = append(completed, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(partNumber)})
+		if err != nil {
+			break
+		}
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	_, err := u.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &u.BucketName,
+		Key:             &fileName,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
 	if err != nil {
-		logger.Error("failed to create AES-GCM", zap.Error(err))
-		return "", fmt.Errorf("failed to create AES-GCM: %v", err)
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
 	}
+	return nil
+}
 
-	ciphertext := aesGCM.Seal(nil, nonce, plaintextData, nil)
+// DownloadFile returns the raw object body, which is still encrypted, and its metadata. Use
+// DownloadDecrypted to read its content.
+func (u *S3Uploader) DownloadFile(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error) {
+	return u.getObject(ctx, objectKey)
+}
 
-	// Step 4: Upload the encrypted file to S3 with metadata
-	_, err = u.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &u.BucketName,
-		Key:         &fileName,
-		Body:        bytes.NewReader(ciphertext),
-		ContentType: &mimeType,
-		ACL:         types.ObjectCannedACLPrivate,
-		Metadata: map[string]string{
-			"encrypted-key": base64.StdEncoding.EncodeToString(encryptedKey),
-			"nonce":         base64.StdEncoding.EncodeToString(nonce),
-		},
+// DownloadDecrypted downloads an object uploaded with UploadFile and returns its decrypted content.
+// The caller must close the returned reader. Missing metadata is reported as a
+// MissingMetadataError and failed authentication as a TamperedObjectError, which for large
+// streamed objects may only surface part way through reading.
+func (u *S3Uploader) DownloadDecrypted(ctx context.Context, objectKey string, kmsUploader interfaces.KMSUploader) (io.ReadCloser, error) {
+	return downloadDecrypted(ctx, u, objectKey, kmsUploader)
+}
+
+func (u *S3Uploader) getObject(ctx context.Context, objectKey string) (io.ReadCloser, models.ObjectInfo, error) {
+	logger := zaplogger.GetLogger()
+	output, err := u.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &u.BucketName,
+		Key:    &objectKey,
 	})
 	if err != nil {
-		logger.Error("failed to upload encrypted file to S3", zap.Error(err))
-		return "", fmt.Errorf("failed to upload encrypted file to S3: %v", err)
+		logger.Error("failed to get object from S3", zap.Error(err))
+		return nil, models.ObjectInfo{}, fmt.Errorf("failed to get object from S3: %w", err)
 	}
 
-	// Generate S3 file URL
-	fileURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", u.BucketName, fileName)
-	return fileURL, nil
+	info := models.ObjectInfo{
+		Key:         objectKey,
+		ContentType: aws.ToString(output.ContentType),
+		Size:        -1,
+		Metadata:    output.Metadata,
+	}
+	if output.ContentLength != nil {
+		info.Size = *output.ContentLength
+	}
+	return output.Body, info, nil
 }
 
-// This function is for testing purposes only
-func (u *S3Uploader) DownloadFile(ctx context.Context, objectKey string) (*s3.GetObjectOutput, error) {
-	// Call S3's GetObject API to fetch the file
+// DeleteFile removes an object from S3. S3 itself accepts deleting a missing object, S3-compatible
+// stores that reject it are reported as ErrObjectNotFound.
+func (u *S3Uploader) DeleteFile(ctx context.Context, objectKey string) error {
 	logger := zaplogger.GetLogger()
-	output, err := u.Client.GetObject(ctx, &s3.GetObjectInput{
+	_, err := u.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: &u.BucketName,
 		Key:    &objectKey,
 	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		return fmt.Errorf("failed to delete object %s from S3: %w", objectKey, ErrObjectNotFound)
+	}
 	if err != nil {
-		logger.Error("failed to get object from S3", zap.Error(err))
-		return nil, fmt.Errorf("failed to get object from S3: %w", err)
+		logger.Error("failed to delete object from S3", zap.Error(err))
+		return fmt.Errorf("failed to delete object from S3: %w", err)
 	}
-
-	return output, nil
+	return nil
 }
 
+// NewS3Uploader creates an uploader for an AWS S3 bucket
 func NewS3Uploader(bucketName string, region string, accessKey string, secretAccessKey string) (*S3Uploader, error) {
+	return NewS3UploaderFromConfig(models.AWSConfig{
+		BucketName:      bucketName,
+		Region:          region,
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretAccessKey,
+	})
+}
+
+// NewS3UploaderFromConfig creates an uploader for the bucket in AWSConfig. When S3Endpoint is set
+// it talks to that S3-compatible endpoint (MinIO, Ceph etc.) instead of AWS.
+func NewS3UploaderFromConfig(cfg models.AWSConfig) (*S3Uploader, error) {
 	logger := zaplogger.GetLogger()
 
-	creds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
-		accessKey,
-		secretAccessKey,
-		"",
-	))
+	options := []func(*config.LoadOptions) error{config.WithRegion(cfg.Region)}
+	if cfg.AccessKeyID != "" {
+		options = append(options, config.WithCredentialsProvider(aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
+			cfg.AccessKeyID,
+			cfg.SecretAccessKey,
+			"",
+		))))
+	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithCredentialsProvider(creds),
-		config.WithRegion(region),
-	)
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), options...)
 	if err != nil {
 		logger.Error("failed to load AWS configuration", zap.Error(err))
 		return nil, fmt.Errorf("unable to load AWS configuration: %v", err)
 	}
 
-	client := s3.NewFromConfig(cfg)
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		// Most S3-compatible stores do not support virtual-hosted bucket addressing
+		o.UsePathStyle = cfg.S3UsePathStyle
+	})
 	return &S3Uploader{
 		Client:     client,
-		BucketName: bucketName,
+		BucketName: cfg.BucketName,
 	}, nil
 }
@@ -3,10 +3,16 @@ package utils_test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"io"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rachel-lawrie/verus_backend_core/mocks"
+	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/rachel-lawrie/verus_backend_core/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -46,27 +52,30 @@ func TestUploadFile(t *testing.T) {
 
 func TestDownloadFile(t *testing.T) {
 	mockClient := new(mocks.MockS3Client)
-	uploader := &mocks.MockS3Uploader{
+	uploader := &utils.S3Uploader{
 		Client:     mockClient,
 		BucketName: "test-bucket",
 	}
 
 	objectKey := "testfile.txt"
-	expectedOutput := &s3.GetObjectOutput{}
-
 	mockClient.On("GetObject", mock.Anything, &s3.GetObjectInput{
 		Bucket: &uploader.BucketName,
 		Key:    &objectKey,
-	}).Return(expectedOutput, nil)
-
-	mockUploader := new(mocks.MockS3Uploader)
-	mockUploader.On("DownloadFile", mock.Anything, objectKey).Return(expectedOutput, nil)
-
-	output, err := mockUploader.DownloadFile(context.Background(), objectKey)
+	}).Return(&s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader([]byte("ciphertext"))),
+		ContentType:   aws.String("text/plain"),
+		ContentLength: aws.Int64(10),
+		Metadata:      map[string]string{"format-version": "2"},
+	}, nil)
+
+	body, info, err := uploader.DownloadFile(context.Background(), objectKey)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedOutput, output)
+	defer body.Close()
+	content, _ := io.ReadAll(body)
+	assert.Equal(t, "ciphertext", string(content))
+	assert.Equal(t, models.ObjectInfo{Key: objectKey, ContentType: "text/plain", Size: 10, Metadata: map[string]string{"format-version": "2"}}, info)
 
-	mockUploader.AssertExpectations(t)
+	mockClient.AssertExpectations(t)
 }
 
 func TestDownloadFileError(t *testing.T) {
@@ -74,12 +83,171 @@ func TestDownloadFileError(t *testing.T) {
 	objectKey := "testfile.txt"
 	expectedError := assert.AnError
 
-	mockUploader.On("DownloadFile", mock.Anything, objectKey).Return(nil, expectedError)
+	mockUploader.On("DownloadFile", mock.Anything, objectKey).Return(nil, models.ObjectInfo{}, expectedError)
 
-	output, err := mockUploader.DownloadFile(context.Background(), objectKey)
+	output, _, err := mockUploader.DownloadFile(context.Background(), objectKey)
 	assert.Error(t, err)
 	assert.Nil(t, output)
 	assert.Equal(t, expectedError, err)
 
 	mockUploader.AssertExpectations(t)
 }
+
+func TestS3UploaderStreamsMultipartUpload(t *testing.T) {
+	mockClient := new(mocks.MockS3Client)
+	mockKmsClient := new(mocks.MockKMSClient)
+	plaintextKey := []byte("0123456789abcdef0123456789abcdef")
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      plaintextKey,
+		CiphertextBlob: []byte("wrapped-key"),
+	}, nil)
+
+	var uploaded bytes.Buffer
+	var parts int
+	mockClient.On("CreateMultipartUpload", mock.Anything, mock.MatchedBy(func(input *s3.CreateMultipartUploadInput) bool {
+		return input.Metadata["format-version"] == "2" && input.Metadata["encrypted-key"] == "d3JhcHBlZC1rZXk="
+	})).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	mockClient.On("UploadPart", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		input := args.Get(1).(*s3.UploadPartInput)
+		assert.Equal(t, int32(parts+1), *input.PartNumber)
+		_, _ = io.Copy(&uploaded, input.Body)
+		parts++
+	}).Return(&s3.UploadPartOutput{ETag: aws.String("etag")}, nil)
+	mockClient.On("CompleteMultipartUpload", mock.Anything, mock.MatchedBy(func(input *s3.CompleteMultipartUploadInput) bool {
+		return len(input.MultipartUpload.Parts) == 2
+	})).Return(&s3.CompleteMultipartUploadOutput{}, nil)
+
+	// Larger than one 5 MiB part
+	content := bytes.Repeat([]byte("video selfie "), 500*1024)
+	uploader := &utils.S3Uploader{Client: mockClient, BucketName: "test-bucket"}
+	objectKey, err := uploader.UploadFile(context.Background(), &mockMultipartFile{Reader: bytes.NewReader(content)}, "selfie.mp4", "video/mp4",
+		&utils.KMSUploader{Client: mockKmsClient, KeyID: "test-key-id"})
+	assert.NoError(t, err)
+	assert.Equal(t, "selfie.mp4", objectKey)
+	assert.Equal(t, 2, parts)
+
+	reader, err := utils.NewDecryptingReader(&uploaded, plaintextKey, utils.FileContext("selfie.mp4").AssociatedData())
+	assert.NoError(t, err)
+	decrypted, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, content, decrypted)
+	mockClient.AssertExpectations(t)
+}
+
+func TestS3UploaderAbortsFailedMultipartUpload(t *testing.T) {
+	mockClient := new(mocks.MockS3Client)
+	mockKmsClient := new(mocks.MockKMSClient)
+	mockKmsClient.On("GenerateDataKey", mock.Anything, mock.Anything).Return(&kms.GenerateDataKeyOutput{
+		Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		CiphertextBlob: []byte("wrapped-key"),
+	}, nil)
+	mockClient.On("CreateMultipartUpload", mock.Anything, mock.Anything).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	mockClient.On("UploadPart", mock.Anything, mock.Anything).Return(&s3.UploadPartOutput{}, errors.New("connection reset"))
+	mockClient.On("AbortMultipartUpload", mock.Anything, mock.MatchedBy(func(input *s3.AbortMultipartUploadInput) bool {
+		return *input.UploadId == "upload-1"
+	})).Return(&s3.AbortMultipartUploadOutput{}, nil)
+
+	uploader := &utils.S3Uploader{Client: mockClient, BucketName: "test-bucket"}
+	_, err := uploader.UploadFile(context.Background(), &mockMultipartFile{Reader: bytes.NewReader([]byte("passport"))}, "passport.jpg", "image/jpeg",
+		&utils.KMSUploader{Client: mockKmsClient, KeyID: "test-key-id"})
+	assert.Error(t, err)
+	mockClient.AssertExpectations(t)
+}
+
+// uploadToMockS3 uploads content with a mocked S3 client and returns the stored body and metadata
+func uploadToMockS3(t *testing.T, kmsUploader *utils.KMSUploader, objectKey string, content []byte) ([]byte, map[string]string) {
+	mockClient := new(mocks.MockS3Client)
+	var body bytes.Buffer
+	var metadata map[string]string
+	mockClient.On("CreateMultipartUpload", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		metadata = args.Get(1).(*s3.CreateMultipartUploadInput).Metadata
+	}).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	mockClient.On("UploadPart", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		_, _ = io.Copy(&body, args.Get(1).(*s3.UploadPartInput).Body)
+	}).Return(&s3.UploadPartOutput{ETag: aws.String("etag")}, nil)
+	mockClient.On("CompleteMultipartUpload", mock.Anything, mock.Anything).Return(&s3.CompleteMultipartUploadOutput{}, nil)
+
+	uploader := &utils.S3Uploader{Client: mockClient, BucketName: "test-bucket", SegmentSize: 1024}
+	_, err := uploader.UploadFile(context.Background(), &mockMultipartFile{Reader: bytes.NewReader(content)}, objectKey, "image/jpeg", kmsUploader)
+	assert.NoError(t, err)
+	return body.Bytes(), metadata
+}
+
+func downloadFromMockS3(kmsUploader *utils.KMSUploader, objectKey string, body []byte, metadata map[string]string) ([]byte, error) {
+	mockClient := new(mocks.MockS3Client)
+	mockClient.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(body)),
+		Metadata: metadata,
+	}, nil)
+
+	uploader := &utils.S3Uploader{Client: mockClient, BucketName: "test-bucket"}
+	reader, err := uploader.DownloadDecrypted(context.Background(), objectKey, kmsUploader)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func newLocalKMSUploader(t *testing.T) *utils.KMSUploader {
+	client, err := utils.NewLocalKMSClient(map[string][]byte{"dev-key": []byte("0123456789abcdef0123456789abcdef")})
+	assert.NoError(t, err)
+	return &utils.KMSUploader{Client: client, KeyID: "dev-key"}
+}
+
+func TestDownloadDecrypted(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	content := bytes.Repeat([]byte("passport scan "), 1000)
+	body, metadata := uploadToMockS3(t, kmsUploader, "passport.jpg", content)
+
+	decrypted, err := downloadFromMockS3(kmsUploader, "passport.jpg", body, metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, content, decrypted)
+}
+
+func TestDownloadDecryptedDetectsTampering(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	content := bytes.Repeat([]byte("passport scan "), 1000)
+	body, metadata := uploadToMockS3(t, kmsUploader, "passport.jpg", content)
+	var tampered *utils.TamperedObjectError
+
+	modified := append([]byte{}, body...)
+	modified[len(modified)/2] ^= 1
+	_, err := downloadFromMockS3(kmsUploader, "passport.jpg", modified, metadata)
+	assert.True(t, errors.As(err, &tampered))
+
+	_, err = downloadFromMockS3(kmsUploader, "passport.jpg", body[:len(body)-(len(content)%1024+16)], metadata) // Drop the final segment
+	assert.True(t, errors.As(err, &tampered))
+	assert.ErrorIs(t, err, utils.ErrStreamTruncated)
+
+	// The object was bound to its key when it was uploaded
+	_, err = downloadFromMockS3(kmsUploader, "other.jpg", body, metadata)
+	assert.True(t, errors.As(err, &tampered))
+
+	var missing *utils.MissingMetadataError
+	_, err = downloadFromMockS3(kmsUploader, "passport.jpg", body, map[string]string{"format-version": "2"})
+	assert.True(t, errors.As(err, &missing))
+	assert.Equal(t, "encrypted-key", missing.Field)
+}
+
+func TestDownloadDecryptedLegacyObjects(t *testing.T) {
+	kmsUploader := newLocalKMSUploader(t)
+	key, wrapped, err := kmsUploader.GenerateDataKey(context.Background())
+	assert.NoError(t, err)
+
+	// Objects uploaded before format-version metadata existed were sealed whole without associated data
+	legacy, err := utils.EncryptField("legacy document", key)
+	assert.NoError(t, err)
+	metadata := map[string]string{
+		"encrypted-key": base64.StdEncoding.EncodeToString(wrapped),
+		"nonce":         base64.StdEncoding.EncodeToString(legacy.Nonce),
+	}
+	decrypted, err := downloadFromMockS3(kmsUploader, "legacy.pdf", legacy.Ciphertext, metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("legacy document"), decrypted)
+
+	var missing *utils.MissingMetadataError
+	delete(metadata, "nonce")
+	_, err = downloadFromMockS3(kmsUploader, "legacy.pdf", legacy.Ciphertext, metadata)
+	assert.True(t, errors.As(err, &missing))
+}
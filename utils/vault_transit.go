@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultVaultTransitMount is the path the Transit secrets engine is mounted at by default
+	defaultVaultTransitMount = "transit"
+
+	// vaultTransitBlobPrefix prefixes ciphertext blobs produced by VaultTransitClient. Vault
+	// ciphertexts ("vault:v<version>:<base64>") do not name their key, so the blob embeds it:
+	// "transit:<key name>:vault:v<version>:<base64>".
+	vaultTransitBlobPrefix = "transit:"
+)
+
+// VaultError is returned when the Vault API answers with a non-2xx status
+type VaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault request failed with status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// VaultTransitClient implements interfaces.KMSClient on top of the HashiCorp Vault Transit secrets
+// engine HTTP API, for clients who run Vault instead of AWS KMS. KeyId names a Transit key.
+type VaultTransitClient struct {
+	Address    string // e.g. https://vault.example.com:8200
+	Token      string
+	Namespace  string // Vault Enterprise namespace, optional
+	Mount      string // Transit mount path, defaults to "transit"
+	HTTPClient *http.Client
+}
+
+// NewVaultTransitClient creates a Transit client for the Vault server at address
+func NewVaultTransitClient(address, token, mount string) *VaultTransitClient {
+	if mount == "" {
+		mount = defaultVaultTransitMount
+	}
+	return &VaultTransitClient{
+		Address:    strings.TrimRight(address, "/"),
+		Token:      token,
+		Mount:      strings.Trim(mount, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewVaultTransitClientFromConfig creates a Transit client from the Vault settings in AWSConfig
+func NewVaultTransitClientFromConfig(cfg models.AWSConfig) (*VaultTransitClient, error) {
+	if cfg.VaultAddress == "" || cfg.VaultToken == "" {
+		return nil, fmt.Errorf("vault address and token are required")
+	}
+	client := NewVaultTransitClient(cfg.VaultAddress, cfg.VaultToken, cfg.VaultTransitMount)
+	client.Namespace = cfg.VaultNamespace
+	return client, nil
+}
+
+// GenerateDataKey asks Transit for a new data key, returned both in plaintext and wrapped by the key
+func (c *VaultTransitClient) GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	keyName := aws.ToString(input.KeyId)
+	bits := 256
+	switch {
+	case input.NumberOfBytes != nil:
+		bits = int(*input.NumberOfBytes) * 8
+	case input.KeySpec == "AES_128":
+		bits = 128
+	}
+
+	request := map[string]interface{}{"bits": bits}
+	addVaultContext(request, input.EncryptionContext)
+	var response struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := c.post(ctx, "datakey/plaintext/"+url.PathEscape(keyName), request, &response); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode vault data key: %w", err)
+	}
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      plaintext,
+		CiphertextBlob: vaultTransitBlob(keyName, response.Ciphertext),
+		KeyId:          aws.String(keyName),
+	}, nil
+}
+
+// Encrypt encrypts plaintext with a Transit key
+func (c *VaultTransitClient) Encrypt(ctx context.Context, input *kms.EncryptInput, opts ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	keyName := aws.ToString(input.KeyId)
+	request := map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(input.Plaintext)}
+	addVaultContext(request, input.EncryptionContext)
+	var response struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := c.post(ctx, "encrypt/"+url.PathEscape(keyName), request, &response); err != nil {
+		return nil, err
+	}
+	return &kms.EncryptOutput{
+		CiphertextBlob: vaultTransitBlob(keyName, response.Ciphertext),
+		KeyId:          aws.String(keyName),
+	}, nil
+}
+
+// Decrypt decrypts a blob with the Transit key it names. Bare Vault ciphertexts are decrypted with
+// input.KeyId.
+func (c *VaultTransitClient) Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	keyName, ciphertext, err := parseVaultTransitBlob(input.CiphertextBlob, aws.ToString(input.KeyId))
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{"ciphertext": ciphertext}
+	addVaultContext(request, input.EncryptionContext)
+	var response struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := c.post(ctx, "decrypt/"+url.PathEscape(keyName), request, &response); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode vault plaintext: %w", err)
+	}
+	return &kms.DecryptOutput{Plaintext: plaintext, KeyId: aws.String(keyName)}, nil
+}
+
+// ReEncrypt re-wraps a blob under the latest version of its Transit key without the plaintext
+// leaving Vault. Transit can only rewrap within a key, so DestinationKeyId must be empty or name it.
+func (c *VaultTransitClient) ReEncrypt(ctx context.Context, input *kms.ReEncryptInput, opts ...func(*kms.Options)) (*kms.ReEncryptOutput, error) {
+	keyName, ciphertext, err := parseVaultTransitBlob(input.CiphertextBlob, aws.ToString(input.DestinationKeyId))
+	if err != nil {
+		return nil, err
+	}
+	if destination := aws.ToString(input.DestinationKeyId); destination != "" && destination != keyName {
+		return nil, fmt.Errorf("vault transit cannot rewrap from key %s to key %s", keyName, destination)
+	}
+
+	request := map[string]interface{}{"ciphertext": ciphertext}
+	addVaultContext(request, input.DestinationEncryptionContext)
+	var response struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := c.post(ctx, "rewrap/"+url.PathEscape(keyName), request, &response); err != nil {
+		return nil, err
+	}
+	return &kms.ReEncryptOutput{
+		CiphertextBlob: vaultTransitBlob(keyName, response.Ciphertext),
+		KeyId:          aws.String(keyName),
+		SourceKeyId:    aws.String(keyName),
+	}, nil
+}
+
+// VaultCiphertextKeyVersion returns the Transit key version a blob was encrypted with
+func VaultCiphertextKeyVersion(blob []byte) (int, error) {
+	_, ciphertext, err := parseVaultTransitBlob(blob, "")
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[1], "v") {
+		return 0, fmt.Errorf("malformed vault ciphertext")
+	}
+	return strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+}
+
+// post sends a request to a Transit endpoint and decodes the "data" object of the response
+func (c *VaultTransitClient) post(ctx context.Context, path string, request interface{}, result interface{}) error {
+	logger := zaplogger.GetLogger()
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode vault request: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s", c.Address, c.Mount, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create vault request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", c.Token)
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error("vault request failed", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil && resp.StatusCode/100 == 2 {
+		return fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		logger.Error("vault request rejected", zap.String("path", path), zap.Int("status", resp.StatusCode), zap.Strings("errors", envelope.Errors))
+		return &VaultError{StatusCode: resp.StatusCode, Errors: envelope.Errors}
+	}
+	if err := json.Unmarshal(envelope.Data, result); err != nil {
+		return fmt.Errorf("failed to decode vault response data: %w", err)
+	}
+	return nil
+}
+
+// addVaultContext adds a KMS encryption context as the Transit "context" parameter, which requires
+// a key created with derived=true
+func addVaultContext(request map[string]interface{}, encryptionContext map[string]string) {
+	if len(encryptionContext) > 0 {
+		request["context"] = base64.StdEncoding.EncodeToString(EncryptionContext(encryptionContext).AssociatedData())
+	}
+}
+
+func vaultTransitBlob(keyName, ciphertext string) []byte {
+	return []byte(vaultTransitBlobPrefix + keyName + ":" + ciphertext)
+}
+
+// parseVaultTransitBlob returns the key name and Vault ciphertext of a blob, using defaultKey for
+// bare Vault ciphertexts
+func parseVaultTransitBlob(blob []byte, defaultKey string) (string, string, error) {
+	value := string(blob)
+	if strings.HasPrefix(value, "vault:") {
+		if defaultKey == "" {
+			return "", "", fmt.Errorf("vault ciphertext does not name its key and no key ID was given")
+		}
+		return defaultKey, value, nil
+	}
+	keyName, ciphertext, ok := strings.Cut(strings.TrimPrefix(value, vaultTransitBlobPrefix), ":")
+	if !strings.HasPrefix(value, vaultTransitBlobPrefix) || !ok || keyName == "" || !strings.HasPrefix(ciphertext, "vault:") {
+		return "", "", fmt.Errorf("ciphertext blob was not produced by vault transit")
+	}
+	return keyName, ciphertext, nil
+}
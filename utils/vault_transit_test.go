@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/rachel-lawrie/verus_backend_core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTransit is an httptest stand-in for the Vault Transit endpoints. Ciphertexts are the base64
+// plaintext tagged with the key version, which is enough to exercise the client.
+type fakeTransit struct {
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+func newFakeTransit(t *testing.T) (*fakeTransit, *httptest.Server) {
+	transit := &fakeTransit{versions: map[string]int{"verus": 1}}
+	server := httptest.NewServer(http.HandlerFunc(transit.serve))
+	t.Cleanup(server.Close)
+	return transit, server
+}
+
+func (f *fakeTransit) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	keyName := parts[len(parts)-1]
+	version, ok := f.versions[keyName]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"encryption key not found"}})
+		return
+	}
+
+	var request map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&request)
+	seal := func(plaintext string) string { return fmt.Sprintf("vault:v%d:%s", version, plaintext) }
+	open := func(ciphertext string) string { return ciphertext[strings.LastIndex(ciphertext, ":")+1:] }
+
+	var data map[string]interface{}
+	switch parts[0] {
+	case "datakey":
+		plaintext := base64.StdEncoding.EncodeToString(make([]byte, int(request["bits"].(float64))/8))
+		data = map[string]interface{}{"plaintext": plaintext, "ciphertext": seal(plaintext)}
+	case "encrypt":
+		data = map[string]interface{}{"ciphertext": seal(request["plaintext"].(string))}
+	case "decrypt":
+		data = map[string]interface{}{"plaintext": open(request["ciphertext"].(string))}
+	case "rewrap":
+		data = map[string]interface{}{"ciphertext": seal(open(request["ciphertext"].(string)))}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func TestVaultTransitRoundTrip(t *testing.T) {
+	_, server := newFakeTransit(t)
+	uploader := &KMSUploader{Client: NewVaultTransitClient(server.URL, "test-token", ""), KeyID: "verus"}
+
+	plaintext, wrapped, err := uploader.GenerateDataKey(context.TODO())
+	assert.NoError(t, err)
+	assert.Len(t, plaintext, 32)
+	assert.True(t, strings.HasPrefix(string(wrapped), "transit:verus:vault:v1:"))
+
+	unwrapped, err := uploader.DecryptData(context.TODO(), wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, unwrapped)
+
+	encrypted, err := uploader.EncryptData(context.TODO(), []byte("secret"))
+	assert.NoError(t, err)
+	decrypted, err := uploader.DecryptData(context.TODO(), encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decrypted)
+}
+
+func TestVaultTransitRewrap(t *testing.T) {
+	transit, server := newFakeTransit(t)
+	uploader := &KMSUploader{Client: NewVaultTransitClient(server.URL, "test-token", ""), KeyID: "verus", KeyVersion: 1}
+	_, wrapped, err := uploader.GenerateDataKey(context.TODO())
+	assert.NoError(t, err)
+
+	// Rotate the key, the envelope service rewraps inside Vault
+	transit.versions["verus"] = 2
+	uploader.KeyVersion = 2
+	envelope := NewEnvelopeService(uploader, "verus", 2, time.Minute)
+	rewrapped, err := envelope.Rewrap(context.TODO(), models.WrappedKey{EncryptedKey: wrapped, KeyID: "verus", KeyVersion: 1}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rewrapped.KeyVersion)
+
+	version, err := VaultCiphertextKeyVersion(rewrapped.EncryptedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	// The version Vault actually used is recorded, not the configured one
+	transit.versions["verus"] = 3
+	rewrapped, err = envelope.Rewrap(context.TODO(), models.WrappedKey{EncryptedKey: wrapped, KeyID: "verus", KeyVersion: 1}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, rewrapped.KeyVersion)
+	assert.False(t, envelope.NeedsRewrap(rewrapped))
+
+	// A key configured ahead of Vault is refused rather than rewrapped again on every run
+	envelope.KeyVersion = 4
+	_, err = envelope.Rewrap(context.TODO(), rewrapped, nil)
+	assert.ErrorIs(t, err, ErrKeyVersionBehind)
+}
+
+func TestVaultTransitErrors(t *testing.T) {
+	_, server := newFakeTransit(t)
+
+	client := NewVaultTransitClient(server.URL, "wrong-token", "")
+	_, err := client.Encrypt(context.TODO(), &kms.EncryptInput{KeyId: aws.String("verus"), Plaintext: []byte("secret")})
+	var vaultErr *VaultError
+	assert.True(t, errors.As(err, &vaultErr))
+	assert.Equal(t, http.StatusForbidden, vaultErr.StatusCode)
+
+	client = NewVaultTransitClient(server.URL, "test-token", "")
+	_, err = client.Encrypt(context.TODO(), &kms.EncryptInput{KeyId: aws.String("missing"), Plaintext: []byte("secret")})
+	assert.True(t, errors.As(err, &vaultErr))
+	assert.Equal(t, []string{"encryption key not found"}, vaultErr.Errors)
+
+	_, err = client.Decrypt(context.TODO(), &kms.DecryptInput{CiphertextBlob: []byte("not a vault blob")})
+	assert.Error(t, err)
+}
+
+func TestNewKMSUploaderFromConfigVault(t *testing.T) {
+	_, server := newFakeTransit(t)
+	uploader, err := NewKMSUploaderFromConfig(models.AWSConfig{
+		KMSProvider:  KMSProviderVault,
+		VaultAddress: server.URL,
+		VaultToken:   "test-token",
+		KeyID:        "verus",
+	})
+	assert.NoError(t, err)
+	_, _, err = uploader.GenerateDataKey(context.TODO())
+	assert.NoError(t, err)
+
+	_, err = NewKMSUploaderFromConfig(models.AWSConfig{KMSProvider: KMSProviderVault, KeyID: "verus"})
+	assert.Error(t, err)
+}
@@ -1,13 +1,16 @@
 package controllers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 
+	"github.com/rachel-lawrie/verus_backend_core/common"
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
 	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 
 	"github.com/gin-gonic/gin"
@@ -15,109 +18,47 @@ import (
 	"github.com/rachel-lawrie/verus_backend_core/interfaces"
 )
 
-// createVerificationLevelObject creates a new VerificationLevel object with provided name, dob, address, email, phone and auto-generates fields like VerificationLevel id and timestamps.
-
-func ParseDocumentTypes(csv string) ([]models.DocumentType, error) {
-	logger := zaplogger.GetLogger()
-	var docTypes []models.DocumentType
-	parts := strings.Split(csv, ",") // Split by comma
-
-	for _, part := range parts {
-		docTypeStr := strings.TrimSpace(part) // Remove extra spaces
-		if docType, err := models.ParseDocumentType(docTypeStr); err != nil {
-			logger.Error("Error parsing document type", zap.Error(err))
-			return nil, fmt.Errorf("invalid document type: %s", docTypeStr)
-		} else {
-			docTypes = append(docTypes, docType)
-		}
-	}
-	return docTypes, nil
-}
-func ParseOptionalGroups(input string) ([][]models.DocumentType, error) {
-	logger := zaplogger.GetLogger()
-	var groups [][]models.DocumentType
-	groupStrings := strings.Split(input, "|") // Split by group delimiter (e.g., "|")
-
-	for _, groupStr := range groupStrings {
-		if groupStr == "" {
-			continue // Skip empty groups
-		}
-		var docGroup []models.DocumentType
-		docStrings := strings.Split(groupStr, ",") // Split by comma within a group
-
-		for _, docStr := range docStrings {
-			docTypeStr := strings.TrimSpace(docStr) // Remove spaces
-			if docType, err := models.ParseDocumentType(docTypeStr); err != nil {
-				logger.Error("Error parsing document type", zap.Error(err))
-				return nil, fmt.Errorf("invalid document type: %s", docTypeStr)
-			} else {
-				docGroup = append(docGroup, docType)
-			}
-		}
-
-		// Append the parsed group if it's not empty
-		if len(docGroup) > 0 {
-			groups = append(groups, docGroup)
-		}
-	}
-
-	return groups, nil
+// bindStrictJSON decodes the request body into v, rejecting fields v does not have
+func bindStrictJSON(c *gin.Context, v interface{}) error {
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
 }
 
-func createVerificationLevelObject(name, requiredDocsStr, optionalGroupsStr string, maxAttempts int) (models.VerificationLevel, error) {
-	level := models.VerificationLevel{}
-
-	requiredDocs, err := ParseDocumentTypes(requiredDocsStr)
-	if err != nil {
-		return level, err
-	}
-	level.RequiredDocs = requiredDocs
-
-	optionalGroups, err := ParseOptionalGroups(optionalGroupsStr)
-	if err != nil {
-		return level, err
+// respondInvalidLevel responds to a request rejected by validation, with the offending field
+func respondInvalidLevel(c *gin.Context, err error) bool {
+	var fieldErr *apperrors.FieldError
+	if !errors.As(err, &fieldErr) {
+		return false
 	}
-	level.OptionalGroups = optionalGroups
-
-	level.Name = name
-	if maxAttempts > 5 {
-		return level, fmt.Errorf("maxAttempts cannot exceed 5")
-	}
-	level.MaxAttempts = maxAttempts
-	level.LevelID = uuid.New().String()
-	return level, nil
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fieldErr.Message, "field": fieldErr.Field})
+	return true
 }
 
 func CreateVerificationLevel(c *gin.Context, service interfaces.VerificationLevelService) {
 	logger := zaplogger.GetLogger()
-	// Define the input struct for the VerificationLevel
-	var input struct {
-		Name              string `json:"name" binding:"required"`        // VerificationLevel's name
-		RequiredDocsStr   string `json:"requiredDocsStr"`                // VerificationLevel's requiredDocs
-		OptionalGroupsStr string `json:"optionalGroupsStr"`              // VerificationLevel's optionalGroups
-		MaxAttempts       int    `json:"maxAttempts" binding:"required"` // VerificationLevel's maxAttempts
-	}
+	var input models.VerificationLevelRequest
 
 	// Set content type to application/json
 	c.Header("Content-Type", "application/json")
 
-	if err := c.ShouldBindJSON(&input); err != nil {
+	if err := bindStrictJSON(c, &input); err != nil {
 		logger.Error("CreateVerificationLevel: Error binding JSON", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	level, err := createVerificationLevelObject(input.Name, input.RequiredDocsStr, input.OptionalGroupsStr, input.MaxAttempts)
-	if err != nil {
-		logger.Error("Error creating VerificationLevel object", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	level := input.Level()
+	if err := level.Validate(); err != nil {
+		respondInvalidLevel(c, err)
 		return
 	}
+	level.LevelID = uuid.New().String()
 
 	logger.Debug("VerificationLevel object created", zap.Any("VerificationLevel", level))
 
 	// Call the upload service to handle the file upload
-	level, err = service.CreateVerificationLevel(c, &level)
+	level, err := service.CreateVerificationLevel(c, &level)
 	if err != nil {
 		logger.Error("Error creating VerificationLevel", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create VerificationLevel"})
@@ -137,51 +78,11 @@ func GetAllVerificationLevels(c *gin.Context, service interfaces.VerificationLev
 		return
 	}
 	// Respond with the list of VerificationLevels
-	//convert levels to a slice of maps for JSON serialization, also convert DocumentType to constant string that maps the value
-	var levelsMap []map[string]interface{}
+	responses := make([]models.VerificationLevelResponse, 0, len(levels))
 	for _, level := range levels {
-		levelMap := getReadableLevel(level)
-		levelsMap = append(levelsMap, levelMap)
-
+		responses = append(responses, level.Response())
 	}
-	c.JSON(http.StatusOK, levelsMap)
-}
-
-func getReadableLevel(level models.VerificationLevel) map[string]interface{} {
-	requiredDocs := ""
-	for j, docType := range level.RequiredDocs {
-		if j > 0 {
-			requiredDocs += "|"
-		}
-		requiredDocs += docType.String()
-	}
-
-	optionalGroups := ""
-	for j, group := range level.OptionalGroups {
-		if j > 0 {
-			optionalGroups += "|"
-		}
-
-		groupStr := ""
-		for k, docType := range group {
-			if k > 0 {
-				groupStr += ","
-			}
-			groupStr += docType.String()
-		}
-		optionalGroups += groupStr
-	}
-
-	levelMap := map[string]interface{}{
-		"level_id":        level.LevelID,
-		"name":            level.Name,
-		"max_attempts":    level.MaxAttempts,
-		"required_docs":   requiredDocs,
-		"optional_groups": optionalGroups,
-		"created_at":      level.CreatedAt,
-		"updated_at":      level.UpdatedAt,
-	}
-	return levelMap
+	c.JSON(http.StatusOK, responses)
 }
 
 // GetDocument is the handler function for retrieving document metadata by ID
@@ -198,9 +99,8 @@ func GetVerificationLevel(c *gin.Context, service interfaces.VerificationLevelSe
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-	levelMap := getReadableLevel(level)
 	// Respond with the document metadata
-	c.JSON(http.StatusOK, levelMap)
+	c.JSON(http.StatusOK, level.Response())
 }
 
 // GetDocument is the handler function for retrieving document metadata by ID
@@ -217,30 +117,163 @@ func GetVerificationLevelByName(c *gin.Context, service interfaces.VerificationL
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-	levelMap := getReadableLevel(level)
 	// Respond with the document metadata
-	c.JSON(http.StatusOK, levelMap)
+	c.JSON(http.StatusOK, level.Response())
 }
 
-// UpdateDocument is the handler function for updating the status of a document
+// UpdateVerificationLevel is the handler function for updating the draft of a VerificationLevel
 func UpdateVerificationLevel(c *gin.Context, service interfaces.VerificationLevelService) {
-	// Get the document ID from the URL parameter
-	appliantID := c.Param("id")
+	logger := zaplogger.GetLogger()
+	levelID := c.Param("id")
 
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
-		log.Printf("UpdateVerificationLevel: Error binding JSON: %v", err)
+	var update models.VerificationLevelUpdate
+	if err := bindStrictJSON(c, &update); err != nil {
+		logger.Error("UpdateVerificationLevel: Error binding JSON", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if update.Empty() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+		return
+	}
 
-	doc, err := service.UpdateVerificationLevel(c, appliantID, updates)
+	level, err := service.UpdateVerificationLevel(c, levelID, update)
+	if respondInvalidLevel(c, err) {
+		return
+	}
+	if errors.Is(err, models.ErrLevelVersionImmutable) {
+		c.JSON(http.StatusConflict, gin.H{"error": "VerificationLevel draft was published, update the new draft instead"})
+		return
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VerificationLevel not found"})
+		return
+	}
 	if err != nil {
-		// Return a JSON response with an error message if document not found
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		logger.Error("Error updating VerificationLevel", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update VerificationLevel"})
+		return
+	}
+
+	// Respond with the updated draft
+	c.JSON(http.StatusOK, level.Response())
+}
+
+// DeleteVerificationLevel is the handler function for soft deleting a VerificationLevel by ID
+func DeleteVerificationLevel(c *gin.Context, service interfaces.VerificationLevelService) {
+	logger := zaplogger.GetLogger()
+	levelID := c.Param("id")
+	logger.Debug("DeleteVerificationLevel: VerificationLevel ID", zap.String("id", levelID))
+
+	err := service.DeleteVerificationLevel(c, levelID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VerificationLevel not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete VerificationLevel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "VerificationLevel deleted successfully", "VerificationLevel_id": levelID})
+}
+
+// PublishVerificationLevel is the handler function for publishing the draft of a VerificationLevel
+func PublishVerificationLevel(c *gin.Context, service interfaces.VerificationLevelService) {
+	logger := zaplogger.GetLogger()
+	levelID := c.Param("id")
+	logger.Debug("PublishVerificationLevel: VerificationLevel ID", zap.String("id", levelID))
+
+	level, err := service.PublishVerificationLevel(c, levelID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VerificationLevel has no draft to publish"})
+		return
+	}
+	if respondInvalidLevel(c, err) {
+		return
+	}
+	if errors.Is(err, models.ErrLevelVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "VerificationLevel was published by another request"})
+		return
+	}
+	if err != nil {
+		logger.Error("Error publishing VerificationLevel", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not publish VerificationLevel"})
 		return
 	}
+	c.JSON(http.StatusOK, level.Response())
+}
 
-	// Respond with the updated document metadata
-	c.JSON(http.StatusOK, doc)
+// GetVerificationLevelHistory is the handler function for retrieving every version of a VerificationLevel
+func GetVerificationLevelHistory(c *gin.Context, service interfaces.VerificationLevelService) {
+	logger := zaplogger.GetLogger()
+	levelID := c.Param("id")
+	logger.Debug("GetVerificationLevelHistory: VerificationLevel ID", zap.String("id", levelID))
+
+	versions, err := service.GetVerificationLevelHistory(c, levelID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VerificationLevel not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("Error retrieving VerificationLevel history", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve VerificationLevel history"})
+		return
+	}
+
+	responses := make([]models.VerificationLevelResponse, 0, len(versions))
+	for _, version := range versions {
+		responses = append(responses, version.Response())
+	}
+	c.JSON(http.StatusOK, responses)
+}
+
+// MigrateVerificationLevelApplicants is the handler function for moving applicants of a
+// VerificationLevel to a newer published version
+func MigrateVerificationLevelApplicants(c *gin.Context, service interfaces.VerificationLevelService) {
+	logger := zaplogger.GetLogger()
+	levelID := c.Param("id")
+	var input struct {
+		ToVersion    int      `json:"to_version"`    // Published version to move to, the current one when omitted
+		FromVersions []int    `json:"from_versions"` // Only applicants on these versions
+		Statuses     []string `json:"statuses"`      // Only applicants in these statuses, pending when omitted
+		ApplicantIDs []string `json:"applicant_ids"` // Only these applicants
+		DryRun       bool     `json:"dry_run"`       // List the applicants without moving them
+	}
+	if err := bindStrictJSON(c, &input); err != nil {
+		logger.Error("MigrateVerificationLevelApplicants: Error binding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	migration := models.LevelMigration{
+		ToVersion:    input.ToVersion,
+		FromVersions: input.FromVersions,
+		ApplicantIDs: input.ApplicantIDs,
+		DryRun:       input.DryRun,
+	}
+	if input.ToVersion < 0 {
+		respondInvalidLevel(c, apperrors.NewFieldError("to_version", "must be a published version"))
+		return
+	}
+	for _, statusStr := range input.Statuses {
+		status, err := models.ParseApplicantStatus(statusStr)
+		if err != nil {
+			respondInvalidLevel(c, apperrors.NewFieldError("statuses", fmt.Sprintf("invalid applicant status: %s", statusStr)))
+			return
+		}
+		migration.Statuses = append(migration.Statuses, status)
+	}
+
+	result, err := service.MigrateApplicants(c, levelID, migration)
+	if errors.Is(err, common.ErrLevelVersionNotPublished) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Error("Error migrating VerificationLevel applicants", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not migrate applicants"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -10,10 +11,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rachel-lawrie/verus_backend_core/common"
 	"github.com/rachel-lawrie/verus_backend_core/constants"
+	apperrors "github.com/rachel-lawrie/verus_backend_core/errors"
 	"github.com/rachel-lawrie/verus_backend_core/models"
 	"github.com/rachel-lawrie/verus_backend_core/utils"
 	"github.com/rachel-lawrie/verus_backend_core/zaplogger"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	zap "go.uber.org/zap"
 )
 
@@ -45,12 +49,24 @@ func (vl *VerificationLevelServiceImpl) CreateVerificationLevel(c *gin.Context,
 	level.ClientID = clientIDStr
 
 	// Check if the VerificationLevel already exists with the levelName
-	existedLevel, _ := vl.GetVerificationLevelByName(c, level.Name)
-	if existedLevel.Name == level.Name {
+	taken, err := vl.nameTaken(c, clientIDStr, level.Name, "")
+	if err != nil {
+		return *level, err
+	}
+	if taken {
 		logger.Error("VerificationLevel already exists", zap.String("Name", level.Name))
 		return *level, fmt.Errorf("VerificationLevel already exists")
 	}
 
+	// New levels are published right away as their first version
+	now := time.Now()
+	level.CreatedAt = now
+	level.UpdatedAt = now
+	level.Version = 1
+	level.State = models.LevelStatePublished
+	level.Current = true
+	level.PublishedAt = &now
+
 	collection := common.GetCollection(vl.CollectionName)
 
 	_, err = collection.InsertOne(c.Request.Context(), level)
@@ -58,6 +74,9 @@ func (vl *VerificationLevelServiceImpl) CreateVerificationLevel(c *gin.Context,
 		logger.Error("Error inserting VerificationLevel into MongoDB", zap.Error(err))
 		return *level, err
 	}
+
+	// Evict cached list results for the client so the new level shows up
+	common.InvalidateTags(common.CacheTag(constants.CacheTagClient, clientIDStr))
 	return *level, nil
 }
 
@@ -72,8 +91,18 @@ func (vl *VerificationLevelServiceImpl) GetAllVerificationLevels(c *gin.Context)
 		return levels, err
 	}
 
+	filter := common.CurrentLevelFilter(clientIDStr)
+	cacheKey, err := common.GenerateCacheKey(vl.CollectionName, filter)
+	if err != nil {
+		logger.Error("Error generating cache key", zap.Error(err))
+		return nil, err
+	}
+	if found, err := common.GetCached(cacheKey, &levels); found {
+		return levels, err
+	}
+
 	collection := common.GetCollection(vl.CollectionName)
-	cursor, err := collection.Find(c.Request.Context(), bson.M{"client_id": clientIDStr, "deleted": false})
+	cursor, err := collection.Find(c.Request.Context(), filter)
 	if err != nil {
 		logger.Error("Error fetching VerificationLevels from MongoDB", zap.Error(err))
 		return nil, err
@@ -95,6 +124,15 @@ func (vl *VerificationLevelServiceImpl) GetAllVerificationLevels(c *gin.Context)
 		return nil, err
 	}
 
+	// Tag the list with every level it contains so an update to any of them evicts it
+	cacheTags := []string{common.CacheTag(constants.CacheTagClient, clientIDStr)}
+	for _, level := range levels {
+		cacheTags = append(cacheTags, common.CacheTag(constants.CacheTagVerificationLevel, level.LevelID))
+	}
+	if err := common.SetCached(cacheKey, levels, cacheTags...); err != nil {
+		logger.Warn("Error caching VerificationLevels", zap.Error(err))
+	}
+
 	// c.JSON(http.StatusOK, VerificationLevels)
 	return levels, nil
 }
@@ -109,19 +147,18 @@ func (vl *VerificationLevelServiceImpl) GetVerificationLevel(c *gin.Context, lev
 		return level, err
 	}
 
-	// Generate the filter
-	filter := bson.M{"client_id": clientIDStr, "level_id": levelID, "deleted": false}
-
-	// Fetch the VerificationLevel directly from the database
-	collection := common.GetCollection(vl.CollectionName)
-	if collection == nil {
-		err := fmt.Errorf("failed to get MongoDB collection: %s", vl.CollectionName)
-		logger.Error("Database collection not found", zap.Error(err))
+	// Generate the filter and cache key
+	filter, cacheKey, err := GenerateFilterAndCacheKey(levelID, clientIDStr, vl.CollectionName)
+	if err != nil {
+		logger.Error("Error generating filter and cache key", zap.Error(err))
 		return level, err
 	}
 
-	// Perform the database query
-	err = collection.FindOne(c.Request.Context(), filter).Decode(&level)
+	// Fetch the VerificationLevel from the cache or the database
+	err = common.CacheWrapper(c.Request.Context(), vl.CollectionName, cacheKey, filter, nil, &level,
+		common.CacheTag(constants.CacheTagClient, clientIDStr),
+		common.CacheTag(constants.CacheTagVerificationLevel, levelID),
+	)
 	if err != nil {
 		logger.Error("Error fetching VerificationLevel from MongoDB", zap.Error(err), zap.String("LevelID", levelID))
 		return level, err
@@ -143,22 +180,36 @@ func (vl *VerificationLevelServiceImpl) GetVerificationLevelByName(c *gin.Contex
 		return level, err
 	}
 
-	// Generate the filter
-	filter := bson.M{"client_id": clientIDStr, "name": levelName, "deleted": false}
+	// Generate the filter and cache key
+	filter := common.CurrentLevelFilter(clientIDStr)
+	filter["name"] = levelName
+	cacheKey, err := common.GenerateCacheKey(vl.CollectionName, filter)
+	if err != nil {
+		logger.Error("Error generating cache key", zap.Error(err))
+		return level, err
+	}
+
+	if found, err := common.GetCached(cacheKey, &level); found {
+		return level, err
+	}
 
-	// Fetch the VerificationLevel directly from the database
 	collection := common.GetCollection(vl.CollectionName)
 	if collection == nil {
-		err := fmt.Errorf("failed to get MongoDB collection: %s", vl.CollectionName)
-		logger.Error("Database collection not found", zap.Error(err))
-		return level, err
+		return level, fmt.Errorf("failed to get collection: %s", vl.CollectionName)
 	}
-
-	// Perform the database query
-	err = collection.FindOne(c.Request.Context(), filter).Decode(&level)
-	if err != nil {
+	if err := collection.FindOne(c.Request.Context(), filter).Decode(&level); err != nil {
 		logger.Error("Error fetching VerificationLevel from MongoDB", zap.Error(err), zap.String("LevelName", levelName))
-		return level, err
+		return level, fmt.Errorf("failed to fetch data from MongoDB: %w", err)
+	}
+
+	// The level id is only known after the fetch, the key is cached and tagged with it at once so
+	// an update of the level in between cannot leave the entry behind
+	cacheTags := []string{
+		common.CacheTag(constants.CacheTagClient, clientIDStr),
+		common.CacheTag(constants.CacheTagVerificationLevel, level.LevelID),
+	}
+	if err := common.SetCached(cacheKey, level, cacheTags...); err != nil {
+		logger.Warn("Error caching VerificationLevel", zap.Error(err))
 	}
 
 	// Add a debug log to inspect the fetched VerificationLevel record
@@ -166,7 +217,12 @@ func (vl *VerificationLevelServiceImpl) GetVerificationLevelByName(c *gin.Contex
 	return level, nil
 }
 
-func (vl *VerificationLevelServiceImpl) UpdateVerificationLevel(c *gin.Context, levelID string, updates map[string]interface{}) (models.VerificationLevel, error) {
+// UpdateVerificationLevel applies an update to the draft of the next version of a level, creating
+// it from the current version if there is none. Published versions are never changed, the draft
+// takes effect once published; models.ErrLevelVersionImmutable is returned when the draft was
+// published in the meantime. The updated draft is validated as a whole; rejections are
+// returned as *errors.FieldError.
+func (vl *VerificationLevelServiceImpl) UpdateVerificationLevel(c *gin.Context, levelID string, update models.VerificationLevelUpdate) (models.VerificationLevel, error) {
 	logger := zaplogger.GetLogger()
 	level := models.VerificationLevel{}
 	// Get the client ID from the context
@@ -175,45 +231,258 @@ func (vl *VerificationLevelServiceImpl) UpdateVerificationLevel(c *gin.Context,
 		return level, err
 	}
 
-	// Generate the filter and cache key
-	filter, cacheKey, err := GenerateFilterAndCacheKey(levelID, clientIDStr, vl.CollectionName)
+	draft, err := vl.findOrCreateDraft(c, clientIDStr, levelID)
 	if err != nil {
-		logger.Error("Error generating filter and cache key", zap.Error(err))
+		logger.Error("Error preparing VerificationLevel draft", zap.Error(err), zap.String("LevelID", levelID))
+		return level, err
+	}
+	if !draft.Editable() {
+		return level, models.ErrLevelVersionImmutable
+	}
+	updated := draft
+	update.Apply(&updated)
+	if err := updated.Validate(); err != nil {
 		return level, err
 	}
+	if updated.Name != draft.Name {
+		taken, err := vl.nameTaken(c, clientIDStr, updated.Name, levelID)
+		if err != nil {
+			return level, err
+		}
+		if taken {
+			return level, apperrors.NewFieldError("name", "a VerificationLevel with this name already exists")
+		}
+	}
 
-	// Build the update document
+	// Build the update document from the fields the update sets
 	updateDoc := bson.M{}
-	for field, value := range updates {
+	for field, value := range update.Fields() {
 		updateDoc[field] = value
 	}
 	updateDoc["updated_at"] = time.Now() // Always update the updated_at field
 
-	update := bson.M{"$set": updateDoc}
+	collection := common.GetCollection(vl.CollectionName)
+	err = collection.FindOneAndUpdate(c.Request.Context(),
+		bson.M{"client_id": clientIDStr, "level_id": levelID, "version": draft.Version, "state": models.LevelStateDraft, "deleted": false},
+		bson.M{"$set": updateDoc},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&level)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// The draft may have been published since it was read
+		if _, findErr := common.FindLevelVersion(c.Request.Context(), clientIDStr, levelID, draft.Version); findErr == nil {
+			return level, models.ErrLevelVersionImmutable
+		}
+	}
+	if err != nil {
+		logger.Error("Error updating VerificationLevel draft", zap.Error(err), zap.String("LevelID", levelID))
+		return level, err
+	}
+	return level, nil
+}
+
+// nameTaken reports whether another live level of the client uses name, in its current version or
+// in a draft that would take it once published. levelID is the level being renamed, if any.
+func (vl *VerificationLevelServiceImpl) nameTaken(c *gin.Context, clientID, name, levelID string) (bool, error) {
+	collection := common.GetCollection(vl.CollectionName)
+	count, err := collection.CountDocuments(c.Request.Context(), bson.M{
+		"client_id": clientID,
+		"name":      name,
+		"level_id":  bson.M{"$ne": levelID},
+		"deleted":   false,
+		"$or":       bson.A{bson.M{"current": bson.M{"$ne": false}}, bson.M{"state": models.LevelStateDraft}},
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("failed to check VerificationLevel name: %w", err)
+	}
+	return count > 0, nil
+}
+
+// findOrCreateDraft returns the draft of a level, copying the current version into a new draft
+// when there is none
+func (vl *VerificationLevelServiceImpl) findOrCreateDraft(c *gin.Context, clientID, levelID string) (models.VerificationLevel, error) {
+	var draft models.VerificationLevel
+	collection := common.GetCollection(vl.CollectionName)
+	draftFilter := bson.M{"client_id": clientID, "level_id": levelID, "state": models.LevelStateDraft, "deleted": false}
+	err := collection.FindOne(c.Request.Context(), draftFilter).Decode(&draft)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return draft, err
+	}
+
+	current, err := vl.GetVerificationLevel(c, levelID)
+	if err != nil {
+		return draft, err
+	}
+	var latest models.VerificationLevel
+	err = collection.FindOne(c.Request.Context(),
+		bson.M{"client_id": clientID, "level_id": levelID},
+		options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}}),
+	).Decode(&latest)
+	if err != nil {
+		return draft, err
+	}
+
+	now := time.Now()
+	draft = current.NewDraft(max(latest.Version, 1) + 1)
+	draft.CreatedAt = now
+	draft.UpdatedAt = now
+	if _, err := collection.InsertOne(c.Request.Context(), draft); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// Another request created the draft first
+			err = collection.FindOne(c.Request.Context(), draftFilter).Decode(&draft)
+		}
+		return draft, err
+	}
+	return draft, nil
+}
+
+// PublishVerificationLevel publishes the draft of a level, making it the current version new
+// applicants start on. Applicants pinned to older versions keep them until they are migrated.
+// Returns mongo.ErrNoDocuments when the level has no draft and models.ErrLevelVersionConflict
+// when another request published it at the same time.
+func (vl *VerificationLevelServiceImpl) PublishVerificationLevel(c *gin.Context, levelID string) (models.VerificationLevel, error) {
+	logger := zaplogger.GetLogger()
+	var level models.VerificationLevel
+	clientIDStr, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return level, err
+	}
+
+	collection := common.GetCollection(vl.CollectionName)
+	draftFilter := bson.M{"client_id": clientIDStr, "level_id": levelID, "state": models.LevelStateDraft, "deleted": false}
+	if err := collection.FindOne(c.Request.Context(), draftFilter).Decode(&level); err != nil {
+		return level, err
+	}
+	// Drafts are edited field by field, so check the whole version before it becomes immutable
+	if err := level.Validate(); err != nil {
+		return level, err
+	}
 
-	// Invalidate the cache after a successful update
-	err = common.InvalidateCache(c, vl.CollectionName, cacheKey, filter, update, nil)
+	// Retire the current version first, conditioned on it still being current, so that of two
+	// concurrent publishes only one gets past this point and there is never more than one
+	// current version. Reads find no current version until the draft is published below.
+	ctx := c.Request.Context()
+	currentFilter := common.CurrentLevelFilter(clientIDStr)
+	currentFilter["level_id"] = levelID
+	var current models.VerificationLevel
+	if err := collection.FindOne(ctx, currentFilter).Decode(&current); err != nil {
+		return level, err
+	}
+	now := time.Now()
+	currentFilter["version"] = current.Version
+	retired, err := collection.UpdateOne(ctx, currentFilter, bson.M{"$set": bson.M{"current": false, "updated_at": now}})
 	if err != nil {
-		logger.Error("Error invalidating cache", zap.Error(err))
+		logger.Error("Error retiring previous VerificationLevel version", zap.Error(err), zap.String("LevelID", levelID))
 		return level, err
 	}
+	if retired.MatchedCount == 0 {
+		return level, models.ErrLevelVersionConflict
+	}
 
-	// Retrieve the updated document
-	result, err := vl.GetVerificationLevel(c, levelID)
+	draftFilter["version"] = level.Version
+	err = collection.FindOneAndUpdate(ctx, draftFilter,
+		bson.M{"$set": bson.M{"state": models.LevelStatePublished, "current": true, "published_at": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&level)
 	if err != nil {
-		logger.Error("Error retrieving updated document", zap.Error(err))
+		logger.Error("Error publishing VerificationLevel draft", zap.Error(err), zap.String("LevelID", levelID))
+		// Put the retired version back so the level keeps a current version
+		delete(currentFilter, "current")
+		if _, restoreErr := collection.UpdateOne(ctx, currentFilter, bson.M{"$set": bson.M{"current": true}}); restoreErr != nil {
+			logger.Error("Error restoring VerificationLevel version", zap.Error(restoreErr), zap.String("LevelID", levelID))
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return level, models.ErrLevelVersionConflict
+		}
 		return level, err
 	}
-	return result, err
+
+	common.InvalidateTags(
+		common.CacheTag(constants.CacheTagVerificationLevel, levelID),
+		common.CacheTag(constants.CacheTagClient, clientIDStr),
+	)
+	logger.Info("Published VerificationLevel version", zap.String("LevelID", levelID), zap.Int("Version", level.Version))
+	return level, nil
 }
 
-// GenerateFilterAndCacheKey generates the filter and cache key for a document
-func GenerateFilterAndCacheKey(levelID, clientID, collectionName string) (bson.M, string, error) {
-	filter := bson.M{
-		"level_id":  levelID,
-		"client_id": clientID,
-		"deleted":   false,
+// GetVerificationLevelHistory returns every version of a level, oldest first, including its draft
+// and deleted versions. Returns mongo.ErrNoDocuments when the level does not exist.
+func (vl *VerificationLevelServiceImpl) GetVerificationLevelHistory(c *gin.Context, levelID string) ([]models.VerificationLevel, error) {
+	logger := zaplogger.GetLogger()
+	clientIDStr, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := common.GetCollection(vl.CollectionName)
+	cursor, err := collection.Find(c.Request.Context(),
+		bson.M{"client_id": clientIDStr, "level_id": levelID},
+		options.Find().SetSort(bson.D{{Key: "version", Value: 1}}),
+	)
+	if err != nil {
+		logger.Error("Error fetching VerificationLevel history", zap.Error(err), zap.String("LevelID", levelID))
+		return nil, err
+	}
+	var versions []models.VerificationLevel
+	if err := cursor.All(c.Request.Context(), &versions); err != nil {
+		logger.Error("Error decoding VerificationLevel history", zap.Error(err), zap.String("LevelID", levelID))
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return versions, nil
+}
+
+// MigrateApplicants moves applicants of a level to a newer published version, see
+// common.MigrateApplicantsToLevelVersion
+func (vl *VerificationLevelServiceImpl) MigrateApplicants(c *gin.Context, levelID string, migration models.LevelMigration) (models.LevelMigrationResult, error) {
+	clientIDStr, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return models.LevelMigrationResult{}, err
+	}
+	if migration.Actor, err = utils.GetActorFromContext(c); err != nil {
+		return models.LevelMigrationResult{}, err
 	}
+	return common.MigrateApplicantsToLevelVersion(c.Request.Context(), clientIDStr, levelID, migration)
+}
+
+func (vl *VerificationLevelServiceImpl) DeleteVerificationLevel(c *gin.Context, levelID string) error {
+	logger := zaplogger.GetLogger()
+	// Get the client ID from the context
+	clientIDStr, err := utils.GetClientIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	// Older published versions are kept for the applicants pinned to them
+	filter := common.CurrentLevelFilter(clientIDStr)
+	filter["level_id"] = levelID
+	err = common.SoftDelete(c, vl.CollectionName, filter,
+		common.CacheTag(constants.CacheTagVerificationLevel, levelID),
+		common.CacheTag(constants.CacheTagClient, clientIDStr),
+	)
+	if err != nil {
+		logger.Error("Error deleting VerificationLevel", zap.Error(err), zap.String("LevelID", levelID))
+		return err
+	}
+
+	// A pending draft must not bring the level back when published
+	now := time.Now()
+	_, err = common.GetCollection(vl.CollectionName).UpdateMany(c.Request.Context(),
+		bson.M{"client_id": clientIDStr, "level_id": levelID, "state": models.LevelStateDraft, "deleted": false},
+		bson.M{"$set": bson.M{"deleted": true, "deleted_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		logger.Error("Error deleting VerificationLevel draft", zap.Error(err), zap.String("LevelID", levelID))
+		return err
+	}
+	return nil
+}
+
+// GenerateFilterAndCacheKey generates the filter and cache key of the current version of a level
+func GenerateFilterAndCacheKey(levelID, clientID, collectionName string) (bson.M, string, error) {
+	filter := common.CurrentLevelFilter(clientID)
+	filter["level_id"] = levelID
 	cacheKey, err := common.GenerateCacheKey(collectionName, filter)
 	if err != nil {
 		return nil, "", err